@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pavelanni/ssh-login-monitor/pkg/config"
+	"github.com/pavelanni/ssh-login-monitor/pkg/sshloginmonitor"
+)
+
+// runCommand runs the subcommand given in args and returns the exit code.
+func runCommand(ctx context.Context, args []string, m *sshloginmonitor.Monitor) (int, error) {
+	switch args[0] {
+	case "top":
+		return 0, runTop(ctx, m)
+	case "report":
+		return runReport(ctx, m)
+	case "bans":
+		bans, err := m.GetBans()
+		if err != nil {
+			return 1, err
+		}
+		return 0, sshloginmonitor.PrintBans(os.Stdout, bans, config.K.String("output") == "json")
+	case "unban":
+		if len(args) < 2 {
+			return 1, errors.New("usage: sshlm unban IP...")
+		}
+		_, blocker, err := banConfig()
+		if err != nil {
+			return 1, err
+		}
+		defer blocker.Close()
+		code := 0
+		for _, ip := range args[1:] {
+			banned, err := m.Unban(ip, blocker)
+			if err != nil {
+				return 1, err
+			}
+			if !banned {
+				fmt.Fprintf(os.Stderr, "%s is not banned\n", ip)
+				code = 1
+			}
+		}
+		return code, nil
+	case "keys":
+		if len(args) < 2 {
+			return 1, errors.New("usage: sshlm keys audit|stale")
+		}
+		switch args[1] {
+		case "audit":
+			findings, err := m.AuditKeys()
+			if err != nil {
+				return 1, err
+			}
+			err = sshloginmonitor.PrintAudit(findings, config.K.String("output") == "json")
+			if err != nil {
+				return 1, err
+			}
+			return sshloginmonitor.AuditExitCode(findings), nil
+		case "stale":
+			olderThan, err := sshloginmonitor.ParseAge(config.K.String("older-than"))
+			if err != nil {
+				return 1, err
+			}
+			keys, err := m.StaleKeys(olderThan, time.Now())
+			if err != nil {
+				return 1, err
+			}
+			return 0, sshloginmonitor.PrintStale(keys, config.K.String("output") == "json")
+		}
+		return 1, fmt.Errorf("unknown keys command: %s", args[1])
+	}
+	return 1, fmt.Errorf("unknown command: %s", args[0])
+}
+
+// runReport writes the HTML access report of the stored events with
+// --stored, or of the events parsed from the log otherwise.
+func runReport(ctx context.Context, m *sshloginmonitor.Monitor) (int, error) {
+	if config.K.String("html") == "" {
+		return 1, errors.New("usage: sshlm report --html FILE [--stored] [--since AGE]")
+	}
+	// A followed log never ends, so the report would never be written
+	if config.K.Bool("follow") {
+		return 1, errors.New("report doesn't support --follow")
+	}
+	var since time.Time
+	if config.K.String("since") != "" {
+		age, err := sshloginmonitor.ParseAge(config.K.String("since"))
+		if err != nil {
+			return 1, err
+		}
+		since = time.Now().Add(-age)
+	}
+
+	// Correlate all the events, so sessions that started before since keep their logins
+	var all []sshloginmonitor.SessionEvent
+	var sessions sshloginmonitor.SessionLister
+	var err error
+	if config.K.Bool("stored") {
+		stored, err := m.GetEvents(time.Time{})
+		if err != nil {
+			return 1, err
+		}
+		correlator := sshloginmonitor.NewCorrelator()
+		for _, event := range stored {
+			all = append(all, correlator.Process(event))
+		}
+		sessions = correlator
+	} else {
+		collector := &sshloginmonitor.CollectSink{}
+		pipeline := sshloginmonitor.NewPipeline([]sshloginmonitor.Source{newSource(m)}, []sshloginmonitor.Sink{collector})
+		if storeEvents() {
+			pipeline.Store = sshloginmonitor.NewDBSink(m)
+		}
+		err = pipeline.Run(ctx)
+		if err != nil {
+			return 1, err
+		}
+		all = collector.Events()
+		sessions = pipeline
+	}
+	events := make([]sshloginmonitor.SessionEvent, 0, len(all))
+	for _, event := range all {
+		if !event.EventTime.Before(since) {
+			events = append(events, event)
+		}
+	}
+
+	f, err := os.Create(config.K.String("html"))
+	if err != nil {
+		return 1, err
+	}
+	defer f.Close()
+	err = sshloginmonitor.BuildReport(events, sshloginmonitor.SessionsBetween(sessions.Sessions(), since, time.Time{}), time.Now()).WriteHTML(f)
+	if err != nil {
+		return 1, err
+	}
+	return 0, f.Close()
+}
+
+// errNoMonitor is returned when no monitor serves the API at api-listen.
+var errNoMonitor = errors.New("no monitor serves the API")
+
+// runBansAPI runs the bans and unban subcommands through the API of the
+// monitor running at api-listen, which holds the database lock, and returns
+// the exit code. It returns errNoMonitor if no monitor is running there.
+func runBansAPI(args []string) (int, error) {
+	if args[0] == "bans" {
+		var bans []sshloginmonitor.Ban
+		_, err := apiRequest(http.MethodGet, "/bans", &bans)
+		if err != nil {
+			return 1, err
+		}
+		return 0, sshloginmonitor.PrintBans(os.Stdout, bans, config.K.String("output") == "json")
+	}
+	if len(args) < 2 {
+		return 1, errors.New("usage: sshlm unban IP...")
+	}
+	code := 0
+	for _, ip := range args[1:] {
+		status, err := apiRequest(http.MethodDelete, "/bans/"+url.PathEscape(ip), nil)
+		if status == http.StatusNotFound {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+			continue
+		}
+		if err != nil {
+			return 1, err
+		}
+	}
+	return code, nil
+}
+
+// apiRequest sends a request with the API token to the monitor running at
+// api-listen and decodes the JSON response into v, unless v is nil. It
+// returns the response status, and the error message of error responses.
+func apiRequest(method, path string, v interface{}) (int, error) {
+	host, port, err := net.SplitHostPort(config.K.String("api-listen"))
+	if err != nil {
+		return 0, err
+	}
+	// A monitor listening on every interface also listens on loopback
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	scheme := "http"
+	if certFile := config.K.String("api-cert"); certFile != "" {
+		data, err := os.ReadFile(certFile)
+		if err != nil {
+			return 0, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return 0, fmt.Errorf("no certificate in %s", certFile)
+		}
+		// Accept the monitor's own certificate, whatever names it is issued for
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+				if len(raw) == 0 || !bytes.Equal(raw[0], block.Bytes) {
+					return fmt.Errorf("the API certificate isn't the one in %s", certFile)
+				}
+				return nil
+			},
+		}}
+		scheme = "https"
+	}
+	req, err := http.NewRequest(method, scheme+"://"+net.JoinHostPort(host, port)+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	if token := config.K.String("api-token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return 0, errNoMonitor
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body) != nil || body.Error == "" {
+			body.Error = resp.Status
+		}
+		return resp.StatusCode, errors.New(body.Error)
+	}
+	if v == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/syslog"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/knadh/koanf/parsers/json"
-	"github.com/knadh/koanf/providers/rawbytes"
+	"github.com/knadh/koanf/v2"
 	"github.com/pavelanni/ssh-login-monitor/pkg/config"
 	"github.com/pavelanni/ssh-login-monitor/pkg/sshloginmonitor"
 	bolt "go.etcd.io/bbolt"
@@ -21,21 +25,57 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	// Open database file
-	db, err := bolt.Open(config.K.String("database"), 0600, nil)
+	// sshd waits for this command on every login, so run it before loading anything else.
+	// It doesn't open the database: a running monitor holds its lock.
+	if len(config.Args) > 0 && config.Args[0] == "authorized-keys-command" {
+		// Called by sshd as: sshlm authorized-keys-command %u %f
+		if len(config.Args) < 2 {
+			log.Fatal("usage: sshlm authorized-keys-command <account> [<fingerprint>]")
+		}
+		var fingerprint string
+		if len(config.Args) > 2 {
+			fingerprint = config.Args[2]
+		}
+		// The monitor reads the offered key back from the auth log
+		var logger *log.Logger
+		w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, sshloginmonitor.OfferedKeyIdentifier)
+		if err != nil {
+			log.Println(err) // don't lock the user out because of the record
+		} else {
+			defer w.Close()
+			logger = log.New(w, "", 0)
+		}
+		err = sshloginmonitor.AuthorizedKeysCommand(os.Stdout, logger, keysFile(), config.Args[1], fingerprint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// A running monitor holds the database lock, so ask it to list and lift its bans
+	if len(config.Args) > 0 && (config.Args[0] == "bans" || config.Args[0] == "unban") && config.K.String("api-listen") != "" {
+		code, err := runBansAPI(config.Args)
+		if !errors.Is(err, errNoMonitor) {
+			if err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(code)
+		}
+	}
+
+	// Open database file; don't wait forever if another instance holds the lock
+	db, err := bolt.Open(config.K.String("database"), 0600, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	// Create bucket if it doesn't exist
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(config.K.String("bucket")))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
-		}
-		return nil
-	})
+	// Create the monitor; this creates the bucket if it doesn't exist
+	opts, err := newOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := sshloginmonitor.NewMonitor(db, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -44,91 +84,424 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	// Create a channel to receive signals
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
+	// Cancel the context and let the pipeline stop cleanly
 	go func() {
 		<-sigs
-		cancel()
 		log.Println("interrupt received, exiting...")
-		os.Exit(0)
+		cancel()
 	}()
 
 	// Check if authkeys file is provided
 	if config.K.Strings("authkeys") != nil {
 		if config.K.Bool("followauthkeys") {
 			go func() {
-				err = sshloginmonitor.UpdateKeysDB(ctx, config.K.Strings("authkeys"), db, config.K.String("bucket"), true)
+				err = m.UpdateKeysDB(ctx, config.K.Strings("authkeys"), true)
 				if err != nil {
 					log.Fatal(err)
 				}
 			}()
 		} else {
-			err = sshloginmonitor.UpdateKeysDB(ctx, config.K.Strings("authkeys"), db, config.K.String("bucket"), false)
+			err = m.UpdateKeysDB(ctx, config.K.Strings("authkeys"), false)
 			if err != nil {
 				log.Fatal(err)
 			}
 		}
 	}
 
+	// Load the key owner registry, which takes precedence over key comments
+	if config.K.String("owners") != "" {
+		err = m.UpdateOwnersDB(config.K.String("owners"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Run the subcommand, if any
+	if len(config.Args) > 0 {
+		code, err := runCommand(ctx, config.Args, m)
+		if err != nil {
+			log.Fatal(err)
+		}
+		db.Close()
+		os.Exit(code)
+	}
+
 	if config.K.String("log") == "" {
 		fmt.Println("No log file specified. Exiting...")
 		os.Exit(1)
 	}
 
-	var events []sshloginmonitor.SessionEvent
-	var sessions []sshloginmonitor.Session
-
-	if config.K.String("log") == "journal" {
-		err := sshloginmonitor.JournalToEvents(ctx, db, config.K.String("bucket"))
+	// The API streams the events stored by the database sink
+	var stream *sshloginmonitor.EventStream
+	if config.K.String("api-listen") != "" {
+		stream = sshloginmonitor.NewEventStream()
+	}
+	// The sinks showing sessions use the pipeline's
+	pipeline := sshloginmonitor.NewPipeline([]sshloginmonitor.Source{newSource(m)}, nil)
+	if storeEvents() {
+		pipeline.Store = sshloginmonitor.NewDBSink(m)
+		pipeline.Store.Stream = stream
+	}
+	sinks, err := newSinks(pipeline)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if addr := config.K.String("metrics-listen"); addr != "" {
+		metrics := sshloginmonitor.NewMetricsSink(m)
+		pipeline.Sinks = append(pipeline.Sinks, metrics)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go serveHTTP(ctx, addr, mux, "", "")
+	}
+	// The API lifts the bans of the running monitor
+	var bans *sshloginmonitor.BanSink
+	if config.K.Bool("follow") && config.K.Exists("bans") {
+		cfg, blocker, err := banConfig()
 		if err != nil {
 			log.Fatal(err)
 		}
-	} else {
-		logFile, err := os.Open(config.K.String("log"))
+		defer blocker.Close()
+		bans, err = sshloginmonitor.NewBanSink(m, cfg, blocker)
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer logFile.Close()
-
-		events, err = sshloginmonitor.LogToEvents(logFile, db, config.K.String("bucket"))
-		if err != nil {
-			log.Fatal(err)
+	}
+	if addr := config.K.String("api-listen"); addr != "" {
+		// Other hosts could read the logins and, without TLS, the token
+		if config.K.String("api-token") == "" && !sshloginmonitor.LoopbackAddress(addr) {
+			log.Fatalf("refusing to serve the API on %s without --api-token", addr)
 		}
-
+		api := sshloginmonitor.NewAPI(m, config.K.String("api-token"))
+		api.Sessions = pipeline
+		api.Stream = stream
+		api.Bans = bans
+		go serveHTTP(ctx, addr, api, config.K.String("api-cert"), config.K.String("api-key"))
 	}
-	sessions = sshloginmonitor.EventsToSessions(&events)
 
-	// Check if follow flag is set to true
+	// In follow mode print events as they arrive
 	if config.K.Bool("follow") {
-		// Update configuration to output log to console
-		b := []byte(`{"output": "log"}`)
-		err := config.K.Load(rawbytes.Provider(b), json.Parser())
+		// Export the keys even if none were loaded now, for authorized-keys-command
+		err = m.ExportKeys()
 		if err != nil {
 			log.Fatal(err)
 		}
+		var output sshloginmonitor.Sink
+		// A template given with --template replaces the structured log lines
+		if config.K.String("log") == "journal" && config.K.String("output") == "log" && config.K.String("template") == "" {
+			output = sshloginmonitor.NewLoggerSink(os.Stdout)
+		} else {
+			output, err = sshloginmonitor.NewOutputSink(m, config.K.String("output"), os.Stdout, pipeline)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		notifiers, err := newNotifiers(m, pipeline)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The events replayed from the database aren't sent or notified again,
+		// nor are those logged before the start, even if the database is empty
+		pipeline.LiveSinks = append(sinks, notifiers...)
+		if bans != nil {
+			pipeline.LiveSinks = append(pipeline.LiveSinks, bans)
+		}
+		pipeline.Sinks = append(pipeline.Sinks, output)
+		// Log times have a one-second resolution
+		pipeline.LiveSince = time.Now().Truncate(time.Second)
+		pipeline.Rules, err = newRuleEngine()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = pipeline.Run(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	collector := &sshloginmonitor.CollectSink{}
+	pipeline.Sinks = append(append(pipeline.Sinks, sinks...), collector)
+	err = pipeline.Run(ctx)
+	if err != nil {
+		log.Fatal(err)
 	}
+	events := collector.Events()
+	sessions := pipeline.Sessions()
+
 	// Switch output format based on configuration
 	switch config.K.String("output") {
 	case "sum":
-		sshloginmonitor.PrintSummary(sessions, config.K.Bool("color"))
+		m.PrintSummary(sessions)
 	case "log":
-		sshloginmonitor.PrintLog(events, config.K.Bool("color"))
+		m.PrintLog(events)
+	case "json":
+		err = sshloginmonitor.PrintJSON(os.Stdout, events)
+	case "csv":
+		err = sshloginmonitor.PrintCSV(os.Stdout, events)
+	case "stats":
+		err = sshloginmonitor.PrintStats(os.Stdout, sshloginmonitor.ComputeStats(sessions), "table")
+	case "stats-json":
+		err = sshloginmonitor.PrintStats(os.Stdout, sshloginmonitor.ComputeStats(sessions), "json")
+	case "stats-csv":
+		err = sshloginmonitor.PrintStats(os.Stdout, sshloginmonitor.ComputeStats(sessions), "csv")
+	case "cef", "leef", "ecs":
+		err = printEncoded(config.K.String("output"), events, nil)
+	case "sessions-json", "sessions-cef", "sessions-leef", "sessions-ecs":
+		err = printEncoded(strings.TrimPrefix(config.K.String("output"), "sessions-"), nil, sessions)
+	default:
+		err = fmt.Errorf("unknown output format %q", config.K.String("output"))
 	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	// Check if follow flag is set to true
-	if config.K.Bool("follow") {
-		if config.K.String("log") != "journal" {
-			// Watch log file for changes
-			logFile, err := os.Open(config.K.String("log"))
+// newSource returns the event source for the configured log.
+func newSource(m *sshloginmonitor.Monitor) sshloginmonitor.Source {
+	if config.K.String("log") == "journal" {
+		return sshloginmonitor.NewJournalSource(m, config.K.Bool("follow"))
+	}
+	return sshloginmonitor.NewFileSource(m, config.K.String("log"), config.K.Bool("follow"))
+}
+
+// printEncoded prints the events and sessions with the encoder of the format.
+func printEncoded(format string, events []sshloginmonitor.SessionEvent, sessions []sshloginmonitor.Session) error {
+	enc, err := sshloginmonitor.NewEncoder(format)
+	if err != nil {
+		return err
+	}
+	err = sshloginmonitor.EncodeEvents(os.Stdout, enc, events)
+	if err != nil {
+		return err
+	}
+	return sshloginmonitor.EncodeSessions(os.Stdout, enc, sessions)
+}
+
+// newSinks returns the sinks configured with --sink: file:PATH appends NDJSON to a file,
+// tcp://HOST:PORT and udp://HOST:PORT send NDJSON over the network,
+// syslog://HOST:PORT and gelf://HOST:PORT send syslog and GELF messages,
+// journal writes to the systemd journal (journal:SOCKET for another socket). A
+// ?format=FORMAT suffix encodes the events with another format, see
+// sshloginmonitor.NewEncoder. The Loki and OpenTelemetry sinks are added if
+// the loki and otlp sections of the configuration exist; the OpenTelemetry
+// sink exports the sessions of sessions, the pipeline feeding the sinks.
+func newSinks(sessions sshloginmonitor.SessionLister) ([]sshloginmonitor.Sink, error) {
+	sinks := make([]sshloginmonitor.Sink, 0)
+	for _, spec := range config.K.Strings("sink") {
+		if spec == "journal" {
+			spec = "journal:"
+		}
+		scheme, target, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid sink %q", spec)
+		}
+		var enc sshloginmonitor.Encoder
+		if i := strings.LastIndex(target, "?format="); i >= 0 {
+			var err error
+			enc, err = sshloginmonitor.NewEncoder(target[i+len("?format="):])
 			if err != nil {
-				log.Fatal(err)
+				return nil, fmt.Errorf("sink %q: %w", spec, err)
 			}
-			defer logFile.Close()
-			err = sshloginmonitor.WatchLog(ctx, logFile, db, config.K.String("bucket"), &sessions)
-			if err != nil {
-				log.Fatal(err)
+			target = target[:i]
+		}
+		switch scheme {
+		case "file":
+			sinks = append(sinks, &sshloginmonitor.FileSink{Path: target, Encoder: enc})
+		case "tcp", "udp":
+			sinks = append(sinks, &sshloginmonitor.NetworkSink{Network: scheme, Address: strings.TrimPrefix(target, "//"), Encoder: enc})
+		case "syslog", "syslog+udp", "syslog+tcp", "syslog+tls":
+			network := strings.TrimPrefix(strings.TrimPrefix(scheme, "syslog"), "+")
+			if network == "" {
+				network = "udp"
 			}
+			sinks = append(sinks, &sshloginmonitor.SyslogSink{Network: network, Address: strings.TrimPrefix(target, "//"), Encoder: enc})
+		case "journal":
+			sinks = append(sinks, &sshloginmonitor.JournalSink{Socket: target})
+		case "gelf", "gelf+udp", "gelf+tcp":
+			network := strings.TrimPrefix(strings.TrimPrefix(scheme, "gelf"), "+")
+			if network == "" {
+				network = "udp"
+			}
+			sinks = append(sinks, &sshloginmonitor.GELFSink{Network: network, Address: strings.TrimPrefix(target, "//"), Encoder: enc})
+		default:
+			return nil, fmt.Errorf("unknown sink type %q", scheme)
+		}
+	}
+	if config.K.Exists("loki") {
+		var cfg sshloginmonitor.Loki
+		err := config.K.UnmarshalWithConf("loki", &cfg, koanf.UnmarshalConf{Tag: "json"})
+		if err != nil {
+			return nil, err
+		}
+		sink, err := sshloginmonitor.NewLokiSink(cfg)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if config.K.Exists("otlp") {
+		var cfg sshloginmonitor.OTLP
+		err := config.K.UnmarshalWithConf("otlp", &cfg, koanf.UnmarshalConf{Tag: "json"})
+		if err != nil {
+			return nil, err
+		}
+		sink, err := sshloginmonitor.NewOTLPSink(cfg)
+		if err != nil {
+			return nil, err
+		}
+		sink.Sessions = sessions
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
 
+// newRuleEngine returns the engine for the alert rules in the alerts section
+// of the configuration, or nil if there are none.
+func newRuleEngine() (*sshloginmonitor.RuleEngine, error) {
+	var rules []sshloginmonitor.Rule
+	err := config.K.UnmarshalWithConf("alerts", &rules, koanf.UnmarshalConf{Tag: "json"})
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return sshloginmonitor.NewRuleEngine(rules)
+}
+
+// newNotifiers returns the sinks notifying people and other systems of the
+// events in follow mode: the webhooks, hooks and email sections of the configuration.
+// The email digest lists the sessions of sessions, the pipeline feeding the sinks.
+func newNotifiers(m *sshloginmonitor.Monitor, sessions sshloginmonitor.SessionLister) ([]sshloginmonitor.Sink, error) {
+	notifiers := make([]sshloginmonitor.Sink, 0)
+	var webhooks []sshloginmonitor.Webhook
+	err := config.K.UnmarshalWithConf("webhooks", &webhooks, koanf.UnmarshalConf{Tag: "json"})
+	if err != nil {
+		return nil, err
+	}
+	if len(webhooks) > 0 {
+		sink, err := sshloginmonitor.NewWebhookSink(m, webhooks)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, sink)
+	}
+	var hooks []sshloginmonitor.Hook
+	err = config.K.UnmarshalWithConf("hooks", &hooks, koanf.UnmarshalConf{Tag: "json"})
+	if err != nil {
+		return nil, err
+	}
+	if len(hooks) > 0 {
+		sink, err := sshloginmonitor.NewHookSink(hooks)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, sink)
+	}
+	if config.K.Exists("email") {
+		var email sshloginmonitor.Email
+		err = config.K.UnmarshalWithConf("email", &email, koanf.UnmarshalConf{Tag: "json"})
+		if err != nil {
+			return nil, err
+		}
+		sink, err := sshloginmonitor.NewEmailSink(m, email)
+		if err != nil {
+			return nil, err
+		}
+		sink.Sessions = sessions
+		notifiers = append(notifiers, sink)
+	}
+	return notifiers, nil
+}
+
+// banConfig returns the bans section of the configuration and its blocker.
+func banConfig() (sshloginmonitor.BanConfig, sshloginmonitor.Blocker, error) {
+	var cfg sshloginmonitor.BanConfig
+	err := config.K.UnmarshalWithConf("bans", &cfg, koanf.UnmarshalConf{Tag: "json"})
+	if err != nil {
+		return cfg, nil, err
+	}
+	blocker, err := sshloginmonitor.NewBlocker(cfg)
+	return cfg, blocker, err
+}
+
+// serveHTTP serves the handler at addr until ctx is cancelled, over TLS if
+// certFile and keyFile are set.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler, certFile, keyFile string) {
+	server := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	var err error
+	if certFile != "" || keyFile != "" {
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// newOptions builds the monitor options from the configuration.
+func newOptions() (sshloginmonitor.Options, error) {
+	eventTmpl, err := templateText(config.K.String("template"))
+	if err != nil {
+		return sshloginmonitor.Options{}, err
+	}
+	sessionTmpl, err := templateText(config.K.String("session-template"))
+	if err != nil {
+		return sshloginmonitor.Options{}, err
+	}
+	return sshloginmonitor.Options{
+		Bucket:          config.K.String("bucket"),
+		UpdateKeys:      config.K.Bool("updatekeys"),
+		Follow:          config.K.Bool("follow"),
+		Color:           config.K.Bool("color"),
+		Theme:           config.K.StringMap("theme"),
+		EventTemplate:   eventTmpl,
+		SessionTemplate: sessionTmpl,
+		KeysFile:        keysFile(),
+	}, nil
+}
+
+// storeEvents reports whether parsed events are stored in the database:
+// always when following the log, and on request for one-off parses.
+func storeEvents() bool {
+	return config.K.Bool("follow") || config.K.Bool("store")
+}
+
+// keysFile returns the file the keys are exported to for authorized-keys-command.
+func keysFile() string {
+	if file := config.K.String("keys-file"); file != "" {
+		return file
+	}
+	return config.K.String("database") + ".keys"
+}
+
+// templateText returns the output template given with --template or
+// --session-template: the template of that name in the templates section of
+// the configuration, the contents of that file, or the value itself if it
+// contains an action. Anything else is most likely a mistyped name.
+func templateText(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if named := config.K.String("templates." + value); named != "" {
+		return named, nil
+	}
+	data, err := os.ReadFile(value)
+	if err == nil {
+		return string(data), nil
+	}
+	if !strings.Contains(value, "{{") {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("template %q is neither a name from templates, a file nor a template", value)
 		}
+		return "", err
 	}
+	return value, nil
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pavelanni/ssh-login-monitor/pkg/config"
+	"github.com/pavelanni/ssh-login-monitor/pkg/sshloginmonitor"
+	"golang.org/x/sys/unix"
+)
+
+// runTop runs the interactive dashboard until the user quits or ctx is cancelled.
+func runTop(ctx context.Context, m *sshloginmonitor.Monitor) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fd := int(os.Stdin.Fd())
+	restore, err := rawMode(fd)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	// Log lines would scribble over the screen
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	os.Stdout.WriteString("\033[?1049h\033[?25l") // alternate screen, hide cursor
+	defer os.Stdout.WriteString("\033[?25h\033[?1049l")
+
+	source := newFollowSource(m)
+	pipeline := sshloginmonitor.NewPipeline([]sshloginmonitor.Source{source}, nil)
+	dashboard := sshloginmonitor.NewDashboard(m, pipeline)
+	pipeline.Sinks = []sshloginmonitor.Sink{dashboard}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- pipeline.Run(ctx)
+	}()
+
+	// Stop the key reader before the terminal is restored
+	keys := make(chan byte)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		readKeys(ctx, fd, keys)
+	}()
+	defer func() {
+		cancel()
+		<-readerDone
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	editing := false
+	var input []byte
+	for {
+		prompt := ""
+		if editing {
+			prompt = "filter: " + string(input) + "_"
+		}
+		width, height := terminalSize(int(os.Stdout.Fd()))
+		dashboard.Render(os.Stdout, width, height, time.Now(), prompt)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errc:
+			return err
+		case <-ticker.C:
+		case <-dashboard.Changed():
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			switch {
+			case editing && (key == '\r' || key == '\n'):
+				editing = false
+				dashboard.SetFilter(string(input))
+			case editing && (key == 127 || key == 8): // backspace
+				if len(input) > 0 {
+					input = input[:len(input)-1]
+				}
+			case key == 27: // escape
+				editing = false
+				input = nil
+				dashboard.SetFilter("")
+			case editing:
+				if key >= ' ' {
+					input = append(input, key)
+				}
+			case key == 'q':
+				return nil
+			case key == '/':
+				editing = true
+				input = []byte(dashboard.Filter())
+			}
+		}
+	}
+}
+
+// readKeys sends the keys typed on the terminal to keys until ctx is
+// cancelled or the terminal is closed, then closes keys. It polls the
+// terminal instead of blocking in a read, so it notices the cancellation.
+func readKeys(ctx context.Context, fd int, keys chan<- byte) {
+	defer close(keys)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	buf := make([]byte, 1)
+	for ctx.Err() == nil {
+		n, err := unix.Poll(fds, 100)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		n, err = unix.Read(fd, buf)
+		if err != nil || n == 0 {
+			return
+		}
+		select {
+		case keys <- buf[0]:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newFollowSource returns the configured log source in follow mode.
+func newFollowSource(m *sshloginmonitor.Monitor) sshloginmonitor.Source {
+	if config.K.String("log") == "journal" {
+		return sshloginmonitor.NewJournalSource(m, true)
+	}
+	return sshloginmonitor.NewFileSource(m, config.K.String("log"), true)
+}
+
+// rawMode turns off line buffering and echo on the terminal and returns a
+// function restoring the previous settings. Signals still work, so Ctrl-C
+// stops the dashboard like any other command.
+func rawMode(fd int) (func(), error) {
+	saved, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	raw := *saved
+	raw.Lflag &^= unix.ICANON | unix.ECHO
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	err = unix.IoctlSetTermios(fd, unix.TCSETS, &raw)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		unix.IoctlSetTermios(fd, unix.TCSETS, saved)
+	}, nil
+}
+
+// terminalSize returns the size of the terminal, or 80x24 if it is unknown.
+func terminalSize(fd int) (int, int) {
+	ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 || ws.Row == 0 {
+		return 80, 24
+	}
+	return int(ws.Col), int(ws.Row)
+}
@@ -15,6 +15,10 @@ import (
 
 var K *koanf.Koanf
 
+// Args holds the positional arguments left after parsing flags: the subcommand
+// and its operands, e.g. "authorized-keys-command root SHA256:...".
+var Args []string
+
 const defaultConfig = `
 authkeys:
   - /tmp/authorized_keys
@@ -35,7 +39,10 @@ theme:
   starttime: green
   endtime: red
   duration: yellow
-  port: blue`
+  port: blue
+templates:
+  event: '{{.EventTime.Format "2006-01-02 15:04:05"}} {{.EventType}} {{.Username}} {{.KeyUser}} {{.SourceIP}}:{{.Port}}'
+  session: '{{.StartTime.Format "2006-01-02 15:04:05"}} {{.Username}} {{.KeyUser}} {{.SourceIP}}:{{.Port}} {{duration .StartTime .EndTime}}'`
 
 func LoadKonfig() error {
 	var err error
@@ -48,16 +55,32 @@ func LoadKonfig() error {
 	configFile := f.StringP("config", "c", "config.yaml", "Configuration file")
 	f.StringSliceP("authkeys", "a", []string{}, "authorized_keys files containing public keys")
 	f.BoolP("followauthkeys", "k", false, "Follow authorized_keys file")
+	f.StringP("owners", "O", "", "Key owner registry (CSV or YAML) mapping fingerprints to people")
 	f.StringP("bucket", "b", "LoginMonitor", "Database bucket name")
-	f.StringP("output", "o", "sum", "Output format: sum, log, csv, json")
+	f.StringP("output", "o", "sum", "Output format: sum, log, csv, json, stats, stats-json, stats-csv, cef, leef, ecs, sessions-json, sessions-cef, sessions-leef, sessions-ecs")
 	f.StringP("log", "l", "journal", "Log file to parse. Default is watching the journal.")
 	f.StringP("database", "d", "fingerprints.db", "Fingerprints database")
 	f.BoolP("updatekeys", "u", true, "Update keys in database")
+	f.String("keys-file", "", "Keys file read by authorized-keys-command (default: the database path with .keys appended)")
 	f.BoolP("follow", "f", false, "Watch log file for changes")
+	f.Bool("store", false, "Store the parsed events in the database; always on with --follow")
+	f.StringSlice("sink", []string{}, "Also send events to: file:PATH, tcp://HOST:PORT, udp://HOST:PORT, syslog[+tcp|+tls]://HOST:PORT, gelf[+tcp]://HOST:PORT, journal[:SOCKET], with an optional ?format=cef|leef|ecs")
 	f.Bool("color", false, "Color output")
+	f.String("metrics-listen", "", "Serve Prometheus metrics on /metrics at this address, e.g. :9310")
+	f.String("api-listen", "", "Serve the JSON API at this address, e.g. 127.0.0.1:9311")
+	f.String("api-token", "", "Bearer token required by the JSON API; without it the API is read-only and only listens on loopback")
+	f.String("api-cert", "", "TLS certificate file of the JSON API; remote clients can only change keys over TLS")
+	f.String("api-key", "", "TLS private key file of the JSON API")
+	f.StringP("template", "t", "", "Event template for the log output: a name from templates, a file or a Go template")
+	f.StringP("session-template", "T", "", "Session template for the sum output: a name from templates, a file or a Go template")
+	f.String("older-than", "90d", "keys stale: report keys not used for this long, e.g. 90d, 2w, 12h")
+	f.String("html", "", "report: write the HTML report to this file")
+	f.Bool("stored", false, "report: use the events stored in the database instead of parsing the log")
+	f.String("since", "", "report: only include events newer than this, e.g. 7d")
 	if err := f.Parse(os.Args[1:]); err != nil {
 		return err
 	}
+	Args = f.Args()
 
 	err = K.Load(rawbytes.Provider([]byte(defaultConfig)), yaml.Parser())
 	if err != nil {
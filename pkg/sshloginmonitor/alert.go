@@ -0,0 +1,326 @@
+package sshloginmonitor
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule is an alert rule from the alerts section of the configuration, e.g.
+//
+//	alerts:
+//	  - name: root-unknown-key
+//	    severity: critical
+//	    when: 'type == "login" && username == "root" && key_user == ""'
+//	  - name: brute-force
+//	    when: 'type == "failure"'
+//	    threshold: 5
+//	    window: 10m
+//
+// Every condition set in the rule must hold for an event to match.
+type Rule struct {
+	Name     string `json:"name"`
+	Severity string `json:"severity"` // SeverityInfo, SeverityWarning (default) or SeverityCritical
+	// When is an expression on the event, see ParseExpr
+	When string `json:"when"`
+	// OutsideHours matches events outside the given hours, e.g. "08:00-19:00";
+	// "22:00-06:00" spans midnight
+	OutsideHours string `json:"outside_hours"`
+	// AllowedCIDRs matches events from source IPs outside all of these networks
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+	// Threshold fires the rule when this many events match within Window,
+	// counted separately for each value of the GroupBy fields (source_ip by default)
+	Threshold int      `json:"threshold"`
+	Window    string   `json:"window"`
+	GroupBy   []string `json:"group_by"`
+	// Message replaces the generated alert message
+	Message string `json:"message"`
+}
+
+// Alert describes why a rule fired. It is attached to the events with the
+// event type "alert" that the RuleEngine produces.
+type Alert struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Trigger  string `json:"trigger"`         // event type of the event that fired the rule
+	Count    int    `json:"count,omitempty"` // matching events, for threshold rules
+}
+
+// compiledRule is a Rule ready to be evaluated.
+type compiledRule struct {
+	Rule
+	when       Expr
+	start, end int // minutes since midnight
+	networks   []*net.IPNet
+	window     time.Duration
+	groupBy    []func(SessionEvent) string
+	seen       map[string][]time.Time // event times per group, for threshold rules
+	lastPurge  time.Time
+	hasHours   bool
+	hasWindow  bool
+	hasNetwork bool
+}
+
+// RuleEngine evaluates alert rules against session events.
+// It is safe for concurrent use.
+type RuleEngine struct {
+	mu    sync.Mutex
+	rules []*compiledRule
+}
+
+// NewRuleEngine checks and compiles the rules.
+//
+// Parameters:
+//   - rules: the alert rules, usually from the alerts section of the configuration
+//
+// Returns:
+//   - *RuleEngine: the engine evaluating the rules
+//   - error: an error naming the first invalid rule
+func NewRuleEngine(rules []Rule) (*RuleEngine, error) {
+	engine := &RuleEngine{}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("alert rule %s: %w", rule.Name, err)
+		}
+		engine.rules = append(engine.rules, compiled)
+	}
+	return engine, nil
+}
+
+// compileRule parses the expression, hours, networks and window of the rule.
+func compileRule(rule Rule) (*compiledRule, error) {
+	switch rule.Severity {
+	case "":
+		rule.Severity = SeverityWarning
+	case SeverityInfo, SeverityWarning, SeverityCritical:
+	default:
+		return nil, fmt.Errorf("unknown severity %q", rule.Severity)
+	}
+	c := &compiledRule{Rule: rule, seen: make(map[string][]time.Time)}
+	var err error
+	c.when, err = ParseExpr(rule.When)
+	if err != nil {
+		return nil, fmt.Errorf("when: %w", err)
+	}
+	if rule.OutsideHours != "" {
+		c.start, c.end, err = parseHours(rule.OutsideHours)
+		if err != nil {
+			return nil, err
+		}
+		c.hasHours = true
+	}
+	for _, cidr := range rule.AllowedCIDRs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		c.networks = append(c.networks, network)
+		c.hasNetwork = true
+	}
+	if rule.Threshold < 0 {
+		return nil, fmt.Errorf("threshold must not be negative")
+	}
+	if rule.Threshold > 1 {
+		if rule.Window == "" {
+			return nil, fmt.Errorf("a threshold needs a window, e.g. 10m")
+		}
+		c.window, err = ParseAge(rule.Window)
+		if err != nil {
+			return nil, fmt.Errorf("window: %w", err)
+		}
+		if c.window <= 0 {
+			return nil, fmt.Errorf("window must be positive")
+		}
+		c.hasWindow = true
+		groupBy := rule.GroupBy
+		if len(groupBy) == 0 {
+			groupBy = []string{"source_ip"}
+		}
+		for _, name := range groupBy {
+			field, ok := exprFields[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown group_by field %q", name)
+			}
+			c.groupBy = append(c.groupBy, field)
+		}
+	}
+	return c, nil
+}
+
+// parseHours parses a range of hours such as "08:00-19:00" into minutes since midnight.
+func parseHours(s string) (int, int, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid hours %q, expected e.g. 08:00-19:00", s)
+	}
+	parse := func(hm string) (int, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(hm))
+		if err != nil {
+			return 0, fmt.Errorf("invalid hours %q, expected e.g. 08:00-19:00", s)
+		}
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	start, err := parse(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parse(to)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// Evaluate checks the event against every rule.
+//
+// Parameters:
+//   - event: a correlated session event; alert events are ignored
+//
+// Returns:
+//   - []SessionEvent: an event of type "alert" for every rule that fired,
+//     carrying the fields of the triggering event and the Alert
+func (e *RuleEngine) Evaluate(event SessionEvent) []SessionEvent {
+	if event.EventType == "alert" {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alerts := make([]SessionEvent, 0)
+	for _, rule := range e.rules {
+		if alert, ok := rule.evaluate(event); ok {
+			a := event
+			a.ID = 0
+			a.EventType = "alert"
+			a.Alert = &alert
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts
+}
+
+// evaluate returns the alert if the event fires the rule.
+func (r *compiledRule) evaluate(event SessionEvent) (Alert, bool) {
+	if !r.when.Eval(event) {
+		return Alert{}, false
+	}
+	if r.hasHours && r.withinHours(event.EventTime) {
+		return Alert{}, false
+	}
+	if r.hasNetwork && r.allowed(event.SourceIP) {
+		return Alert{}, false
+	}
+	count := 0
+	if r.hasWindow {
+		count = r.count(event)
+		if count < r.Threshold {
+			return Alert{}, false
+		}
+	}
+	return Alert{
+		Rule:     r.Name,
+		Severity: r.Severity,
+		Message:  r.message(event, count),
+		Trigger:  event.EventType,
+		Count:    count,
+	}, true
+}
+
+// withinHours reports whether t falls inside the allowed hours.
+// Event times are the local times of the log.
+func (r *compiledRule) withinHours(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if r.start <= r.end {
+		return minute >= r.start && minute < r.end
+	}
+	return minute >= r.start || minute < r.end
+}
+
+// allowed reports whether the IP is in one of the allowed networks.
+func (r *compiledRule) allowed(sourceIP string) bool {
+	ip := net.ParseIP(sourceIP)
+	if ip == nil {
+		return false
+	}
+	for _, network := range r.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// count records the event in its group and returns the number of events of
+// the group within the window. When the threshold is reached the group starts
+// over, so the rule fires once per Threshold events.
+func (r *compiledRule) count(event SessionEvent) int {
+	values := make([]string, len(r.groupBy))
+	for i, field := range r.groupBy {
+		values[i] = field(event)
+	}
+	key := strings.Join(values, "\x00")
+	since := event.EventTime.Add(-r.window)
+
+	times := append(r.seen[key], event.EventTime)
+	kept := times[:0]
+	for _, t := range times {
+		if t.After(since) {
+			kept = append(kept, t)
+		}
+	}
+	count := len(kept)
+	if count >= r.Threshold {
+		delete(r.seen, key)
+	} else {
+		r.seen[key] = kept
+	}
+
+	// Forget the groups that have been quiet for a whole window
+	if event.EventTime.Sub(r.lastPurge) > r.window {
+		for k, times := range r.seen {
+			if !times[len(times)-1].After(since) {
+				delete(r.seen, k)
+			}
+		}
+		r.lastPurge = event.EventTime
+	}
+	return count
+}
+
+// message describes why the rule fired.
+func (r *compiledRule) message(event SessionEvent, count int) string {
+	if r.Message != "" {
+		return r.Message
+	}
+	who := event.KeyUser
+	switch {
+	case event.EventType == "failure":
+		who = event.AuthMethod
+	case who == "" || who == UnknownOwner:
+		who = "unknown key"
+	}
+	msg := fmt.Sprintf("%s of %s (%s) from %s", event.EventType, event.Username, who, event.SourceIP)
+	if r.hasHours {
+		msg += " outside " + r.OutsideHours
+	}
+	if r.hasNetwork {
+		msg += " outside the allowed networks"
+	}
+	if r.hasWindow {
+		msg += fmt.Sprintf(", %d times in %s", count, r.Window)
+	}
+	return msg
+}
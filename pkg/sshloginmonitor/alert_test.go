@@ -0,0 +1,271 @@
+package sshloginmonitor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRuleEngine(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr bool
+	}{
+		{name: "valid", rule: Rule{When: `type == "login"`, OutsideHours: "08:00-19:00", AllowedCIDRs: []string{"10.0.0.0/8", "192.168.1.1"}}},
+		{name: "bad severity", rule: Rule{Severity: "fatal"}, wantErr: true},
+		{name: "bad expression", rule: Rule{When: `type ==`}, wantErr: true},
+		{name: "bad hours", rule: Rule{OutsideHours: "8-19"}, wantErr: true},
+		{name: "bad cidr", rule: Rule{AllowedCIDRs: []string{"10.0.0.0/33"}}, wantErr: true},
+		{name: "threshold without window", rule: Rule{Threshold: 5}, wantErr: true},
+		{name: "bad window", rule: Rule{Threshold: 5, Window: "ten minutes"}, wantErr: true},
+		{name: "bad group", rule: Rule{Threshold: 5, Window: "10m", GroupBy: []string{"host"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRuleEngine([]Rule{tt.rule})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewRuleEngine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRuleEngineEvaluate(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.Parse("15:04:05", clock)
+		return t.AddDate(2023, 3, 26)
+	}
+	login := func(clock, ip string) SessionEvent {
+		return SessionEvent{EventType: "login", EventTime: at(clock), Username: "root", SourceIP: ip, KeyUser: "alice"}
+	}
+	failure := func(clock, ip string) SessionEvent {
+		return SessionEvent{EventType: "failure", EventTime: at(clock), Username: "admin", SourceIP: ip, AuthMethod: "password"}
+	}
+	tests := []struct {
+		name   string
+		rule   Rule
+		events []SessionEvent
+		want   []int // number of alerts for each event
+	}{
+		{
+			name:   "expression",
+			rule:   Rule{When: `type == "login" && key_user == ""`},
+			events: []SessionEvent{login("10:00:00", "10.0.0.1"), {EventType: "login", KeyUser: UnknownOwner}},
+			want:   []int{0, 1},
+		},
+		{
+			name:   "outside hours",
+			rule:   Rule{When: `type == "login"`, OutsideHours: "08:00-19:00"},
+			events: []SessionEvent{login("07:59:59", "10.0.0.1"), login("08:00:00", "10.0.0.1"), login("18:59:00", "10.0.0.1"), login("19:00:00", "10.0.0.1")},
+			want:   []int{1, 0, 0, 1},
+		},
+		{
+			name:   "outside overnight hours",
+			rule:   Rule{OutsideHours: "22:00-06:00"},
+			events: []SessionEvent{login("23:00:00", "10.0.0.1"), login("05:00:00", "10.0.0.1"), login("12:00:00", "10.0.0.1")},
+			want:   []int{0, 0, 1},
+		},
+		{
+			name:   "allowed networks",
+			rule:   Rule{AllowedCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}},
+			events: []SessionEvent{login("10:00:00", "10.1.2.3"), login("10:00:00", "192.168.1.24"), login("10:00:00", "2001:db8::1")},
+			want:   []int{0, 1, 0},
+		},
+		{
+			name: "failures in window",
+			rule: Rule{When: `type == "failure"`, Threshold: 3, Window: "10m"},
+			events: []SessionEvent{
+				failure("10:00:00", "203.0.113.1"),
+				failure("10:01:00", "203.0.113.1"),
+				failure("10:02:00", "198.51.100.7"), // another group
+				failure("10:10:30", "203.0.113.1"),  // the first failure left the window
+				failure("10:10:45", "203.0.113.1"),
+				failure("10:10:50", "203.0.113.1"), // counting starts over
+				login("10:14:00", "203.0.113.1"),
+			},
+			want: []int{0, 0, 0, 0, 1, 0, 0},
+		},
+		{
+			name: "group by account",
+			rule: Rule{When: `type == "failure"`, Threshold: 2, Window: "1h", GroupBy: []string{"account"}},
+			events: []SessionEvent{
+				failure("10:00:00", "203.0.113.1"),
+				failure("10:30:00", "198.51.100.7"),
+			},
+			want: []int{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine, err := NewRuleEngine([]Rule{tt.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, event := range tt.events {
+				alerts := engine.Evaluate(event)
+				if len(alerts) != tt.want[i] {
+					t.Errorf("event %d: got %d alerts, want %d", i, len(alerts), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRuleEngineAlert(t *testing.T) {
+	engine, err := NewRuleEngine([]Rule{
+		{Name: "root-unknown-key", Severity: SeverityCritical, When: `username == "root" && key_user == ""`},
+		{When: `type == "failure"`, Threshold: 2, Window: "5m", Message: "password guessing"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := SessionEvent{ID: 7, EventType: "login", Username: "root", SourceIP: "192.168.1.24", Port: "49090", KeyUser: UnknownOwner}
+	alerts := engine.Evaluate(event)
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1", len(alerts))
+	}
+	want := SessionEvent{EventType: "alert", Username: "root", SourceIP: "192.168.1.24", Port: "49090", KeyUser: UnknownOwner,
+		Alert: &Alert{Rule: "root-unknown-key", Severity: SeverityCritical, Trigger: "login",
+			Message: "login of root (unknown key) from 192.168.1.24"}}
+	if alerts[0].Alert == nil || *alerts[0].Alert != *want.Alert {
+		t.Errorf("alert = %+v, want %+v", alerts[0].Alert, want.Alert)
+	}
+	alerts[0].Alert, want.Alert = nil, nil
+	if alerts[0] != want {
+		t.Errorf("event = %+v, want %+v", alerts[0], want)
+	}
+	if got := engine.Evaluate(alerts[0]); len(got) != 0 {
+		t.Errorf("alert events must not fire rules, got %d alerts", len(got))
+	}
+
+	failure := SessionEvent{EventType: "failure", Username: "admin", SourceIP: "203.0.113.1"}
+	engine.Evaluate(failure)
+	alerts = engine.Evaluate(failure)
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1", len(alerts))
+	}
+	want.Alert = &Alert{Rule: "rule-2", Severity: SeverityWarning, Message: "password guessing", Trigger: "failure", Count: 2}
+	if *alerts[0].Alert != *want.Alert {
+		t.Errorf("alert = %+v, want %+v", alerts[0].Alert, want.Alert)
+	}
+}
+
+func TestPipelineRules(t *testing.T) {
+	m := newTestMonitor(t)
+	engine, err := NewRuleEngine([]Rule{{Name: "root", When: `type == "login" && username == "root"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := &CollectSink{}
+	p := NewPipeline([]Source{NewReaderSource(m, strings.NewReader(testLog))}, []Sink{collector})
+	p.Rules = engine
+	err = p.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make([]string, 0)
+	for _, event := range collector.Events() {
+		types = append(types, event.EventType)
+	}
+	want := "login alert logout login alert"
+	if got := strings.Join(types, " "); got != want {
+		t.Errorf("event types = %q, want %q", got, want)
+	}
+}
+
+func TestPipelineReplay(t *testing.T) {
+	m := newTestMonitor(t)
+	engine, err := NewRuleEngine([]Rule{{Name: "root", When: `type == "login" && username == "root"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second run reads the same log again, as a restarted follower does
+	runs := []struct {
+		live string
+		all  int
+	}{
+		{live: "login alert logout login alert", all: 5},
+		{live: "", all: 3},
+	}
+	for run, want := range runs {
+		all, live := &CollectSink{}, &CollectSink{}
+		p := NewPipeline([]Source{NewReaderSource(m, strings.NewReader(testLog))}, []Sink{all})
+		p.LiveSinks = []Sink{live}
+		p.Rules = engine
+		p.Store = NewDBSink(m)
+		err = p.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		types := make([]string, 0)
+		for _, event := range live.Events() {
+			types = append(types, event.EventType)
+		}
+		if got := strings.Join(types, " "); got != want.live {
+			t.Errorf("run %d: live event types = %q, want %q", run, got, want.live)
+		}
+		if got := len(all.Events()); got != want.all {
+			t.Errorf("run %d: got %d events, want %d", run, got, want.all)
+		}
+	}
+	stored, err := m.GetEvents(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 5 {
+		t.Errorf("stored %d events, want 5", len(stored))
+	}
+}
+
+func TestPipelineBacklog(t *testing.T) {
+	engine, err := NewRuleEngine([]Rule{{Name: "root", When: `type == "login" && username == "root"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The store is empty, as on a first run, but the events logged before
+	// the monitor started are the backlog all the same
+	tests := []struct {
+		since string
+		live  string
+		all   int
+	}{
+		{since: "10:21:30", live: "login alert", all: 4},
+		{since: "10:22:00", live: "", all: 3},
+	}
+	for _, tt := range tests {
+		m := newTestMonitor(t)
+		since, err := parseLogTime("Apr 27", tt.since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, live := &CollectSink{}, &CollectSink{}
+		p := NewPipeline([]Source{NewReaderSource(m, strings.NewReader(testLog))}, []Sink{all})
+		p.LiveSinks = []Sink{live}
+		p.Rules = engine
+		p.Store = NewDBSink(m)
+		p.LiveSince = since
+		err = p.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		types := make([]string, 0)
+		for _, event := range live.Events() {
+			types = append(types, event.EventType)
+		}
+		if got := strings.Join(types, " "); got != tt.live {
+			t.Errorf("since %s: live event types = %q, want %q", tt.since, got, tt.live)
+		}
+		if got := len(all.Events()); got != tt.all {
+			t.Errorf("since %s: got %d events, want %d", tt.since, got, tt.all)
+		}
+		stored, err := m.GetEvents(time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != tt.all {
+			t.Errorf("since %s: stored %d events, want %d", tt.since, len(stored), tt.all)
+		}
+	}
+}
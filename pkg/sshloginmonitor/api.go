@@ -0,0 +1,320 @@
+package sshloginmonitor
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// APIKey is a key of the key store as returned by the HTTP API.
+type APIKey struct {
+	Account     string `json:"account"`
+	Fingerprint string `json:"fingerprint"`
+	KeyUser     string `json:"key_user"`
+	Key         string `json:"key"`
+}
+
+// apiKeyRequest is the body of POST /keys.
+type apiKeyRequest struct {
+	Account string `json:"account"`
+	Key     string `json:"key"`
+}
+
+// API serves the sessions, events and keys stored in the monitor's database
+// as JSON:
+//
+//	GET    /health
+//	GET    /sessions?open=true&since=...
+//	GET    /events?since=...&type=...
+//	GET    /keys?account=...
+//	POST   /keys                      {"account": "root", "key": "ssh-ed25519 AAAA... alice"}
+//	DELETE /keys/FINGERPRINT?account=...
+//	GET    /stream?account=...&key_user=...&type=...
+//	GET    /bans
+//	DELETE /bans/IP
+//
+// since is an RFC 3339 time or an age such as 7d. If Token is set, every
+// request must carry it as a bearer token; without a token the keys can't be
+// changed. Changes from other hosts than the local one also need TLS. /sessions needs Sessions and /stream needs Stream to be set.
+// Unbanning needs Bans to be set.
+type API struct {
+	m        *Monitor
+	Token    string
+	Sessions SessionLister // the sessions of the monitor's pipeline for /sessions
+	Stream   *EventStream  // live events for /stream
+	Bans     *BanSink      // the monitor's bans, lifted by DELETE /bans/IP
+	mux      *http.ServeMux
+}
+
+// NewAPI returns the HTTP API of the monitor.
+func NewAPI(m *Monitor, token string) *API {
+	api := &API{m: m, Token: token, mux: http.NewServeMux()}
+	api.mux.HandleFunc("/health", api.health)
+	api.mux.HandleFunc("/sessions", api.sessions)
+	api.mux.HandleFunc("/events", api.events)
+	api.mux.HandleFunc("/keys", api.keys)
+	api.mux.HandleFunc("/keys/", api.keys)
+	api.mux.HandleFunc("/stream", api.stream)
+	api.mux.HandleFunc("/bans", api.bans)
+	api.mux.HandleFunc("/bans/", api.bans)
+	return api
+}
+
+// ServeHTTP implements http.Handler.
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The token must not cross the network in clear to change the keys sshd accepts
+	if r.Method != http.MethodGet && r.TLS == nil && !LoopbackAddress(r.RemoteAddr) {
+		writeError(w, http.StatusForbidden, errors.New("changes from remote clients require TLS"))
+		return
+	}
+	if api.Token != "" {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+api.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		writeError(w, http.StatusForbidden, errors.New("changes are disabled without an API token"))
+		return
+	}
+	api.mux.ServeHTTP(w, r)
+}
+
+// LoopbackAddress reports whether the host of the host:port address is a
+// loopback address or localhost. An empty host, which listens on every
+// interface, isn't.
+func LoopbackAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// parseSince parses the since parameter: an RFC 3339 time or an age.
+func parseSince(r *http.Request, now time.Time) (time.Time, error) {
+	value := r.URL.Query().Get("since")
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	age, err := ParseAge(value)
+	if err != nil {
+		return time.Time{}, errors.New("since must be an RFC 3339 time or an age such as 7d")
+	}
+	return now.Add(-age), nil
+}
+
+// allowGet rejects the request unless it is a GET.
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return false
+	}
+	return true
+}
+
+func (api *API) health(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	stored := 0
+	err := api.m.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(eventsBucket(api.m.opts.Bucket)); b != nil {
+			stored = b.Stats().KeyN
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        "ok",
+		"stored_events": stored,
+		"parse_errors":  api.m.ParseErrors(),
+	})
+}
+
+func (api *API) sessions(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	since, err := parseSince(r, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if api.Sessions == nil {
+		writeError(w, http.StatusNotFound, errors.New("sessions are not available"))
+		return
+	}
+	sessions := SessionsBetween(api.Sessions.Sessions(), since, time.Time{})
+	if r.URL.Query().Get("open") == "true" {
+		open := make([]Session, 0)
+		for _, session := range sessions {
+			if session.EndTime.IsZero() {
+				open = append(open, session)
+			}
+		}
+		sessions = open
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (api *API) events(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	since, err := parseSince(r, time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	events, err := api.m.GetEvents(since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if eventType := r.URL.Query().Get("type"); eventType != "" {
+		filtered := make([]SessionEvent, 0)
+		for _, event := range events {
+			if event.EventType == eventType {
+				filtered = append(filtered, event)
+			}
+		}
+		events = filtered
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+func (api *API) keys(w http.ResponseWriter, r *http.Request) {
+	fingerprint := strings.TrimPrefix(r.URL.Path, "/keys/")
+	if r.URL.Path == "/keys" {
+		fingerprint = ""
+	}
+	switch {
+	case r.Method == http.MethodGet && fingerprint == "":
+		users, err := api.m.GetAllKeys()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		account := r.URL.Query().Get("account")
+		keys := make([]APIKey, 0, len(users))
+		for _, user := range users {
+			if account != "" && user.Account != account {
+				continue
+			}
+			key, err := api.apiKey(user)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			keys = append(keys, key)
+		}
+		writeJSON(w, http.StatusOK, keys)
+	case r.Method == http.MethodPost && fingerprint == "":
+		var req apiKeyRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		user, err := api.m.AddKey(req.Account, req.Key)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		key, err := api.apiKey(user)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, key)
+	case r.Method == http.MethodDelete && fingerprint != "":
+		deleted, err := api.m.DeleteKey(r.URL.Query().Get("account"), fingerprint)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if deleted == 0 {
+			writeError(w, http.StatusNotFound, errors.New("key not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"deleted": deleted})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (api *API) bans(w http.ResponseWriter, r *http.Request) {
+	ip := strings.TrimPrefix(r.URL.Path, "/bans/")
+	if r.URL.Path == "/bans" {
+		ip = ""
+	}
+	switch {
+	case r.Method == http.MethodGet && ip == "":
+		bans, err := api.m.GetBans()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, bans)
+	case r.Method == http.MethodDelete && ip != "":
+		if api.Bans == nil {
+			writeError(w, http.StatusNotFound, errors.New("bans are not enabled"))
+			return
+		}
+		banned, err := api.Bans.Unban(ip)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !banned {
+			writeError(w, http.StatusNotFound, errors.New(ip+" is not banned"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"unbanned": ip})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// apiKey returns the key with its key user from the owner registry or the comment.
+func (api *API) apiKey(user User) (APIKey, error) {
+	owner, err := api.m.GetOwnerByFingerprint(user.Fingerprint)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return APIKey{
+		Account:     user.Account,
+		Fingerprint: user.Fingerprint,
+		KeyUser:     owner.Name,
+		Key:         user.Key,
+	}, nil
+}
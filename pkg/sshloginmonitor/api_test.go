@@ -0,0 +1,178 @@
+package sshloginmonitor
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPI(t *testing.T) {
+	m := newTestMonitor(t)
+	pipeline := NewPipeline([]Source{NewReaderSource(m, strings.NewReader(testLog))}, []Sink{NewDBSink(m)})
+	err := pipeline.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans, err := NewBanSink(m, BanConfig{}, &fakeBlocker{blocked: make(map[string]time.Duration)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bans.ban("203.0.113.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(m, "secret")
+	api.Sessions = pipeline
+	api.Bans = bans
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	const charlieKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDcxpEoyTxsGZT4tzhYqKNvAPN/3eq7Ll0CXY0tl7FVv charlie@fedora"
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+		wantLen    int      // number of items in a JSON array response, -1 if not an array
+		wantBody   []string // substrings of the response
+	}{
+		{"no token", "GET", "/health", "", "", http.StatusUnauthorized, -1, []string{"token"}},
+		{"health", "GET", "/health", "secret", "", http.StatusOK, -1, []string{`"status":"ok"`, `"stored_events":3`}},
+		{"all sessions", "GET", "/sessions", "secret", "", http.StatusOK, 2, nil},
+		{"open sessions", "GET", "/sessions?open=true", "secret", "", http.StatusOK, 1, []string{`"key_user":"bob@fedora"`}},
+		{"events", "GET", "/events?since=2000-01-01T00:00:00Z", "secret", "", http.StatusOK, 3, nil},
+		{"logout events", "GET", "/events?type=logout", "secret", "", http.StatusOK, 1, []string{`"key_user":"alice@fedora"`}},
+		{"bad since", "GET", "/events?since=yesterday", "secret", "", http.StatusBadRequest, -1, []string{"RFC 3339"}},
+		{"keys", "GET", "/keys", "secret", "", http.StatusOK, 2, []string{`"account":"root"`}},
+		{"add key", "POST", "/keys", "secret", `{"account": "deploy", "key": "` + charlieKey + `"}`, http.StatusCreated, -1, []string{`"key_user":"charlie@fedora"`, `"account":"deploy"`}},
+		{"add invalid key", "POST", "/keys", "secret", `{"account": "deploy", "key": "ssh-ed25519 AAAA"}`, http.StatusBadRequest, -1, nil},
+		{"deploy keys", "GET", "/keys?account=deploy", "secret", "", http.StatusOK, 1, nil},
+		{"delete key", "DELETE", "/keys/SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8?account=root", "secret", "", http.StatusOK, -1, []string{`"deleted":1`}},
+		{"delete missing key", "DELETE", "/keys/5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8", "secret", "", http.StatusNotFound, -1, nil},
+		{"root keys", "GET", "/keys?account=root", "secret", "", http.StatusOK, 1, []string{"bob@fedora"}},
+		{"wrong method", "PUT", "/sessions", "secret", "", http.StatusMethodNotAllowed, -1, nil},
+		{"bans", "GET", "/bans", "secret", "", http.StatusOK, 1, []string{`"ip":"203.0.113.1"`}},
+		{"unban", "DELETE", "/bans/203.0.113.1", "secret", "", http.StatusOK, -1, nil},
+		{"unban again", "DELETE", "/bans/203.0.113.1", "secret", "", http.StatusNotFound, -1, []string{"not banned"}},
+		{"bans after unban", "GET", "/bans", "secret", "", http.StatusOK, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantLen >= 0 {
+				var items []json.RawMessage
+				err = json.Unmarshal(body, &items)
+				if err != nil {
+					t.Fatalf("%s: %s", err, body)
+				}
+				if len(items) != tt.wantLen {
+					t.Errorf("got %d items, want %d: %s", len(items), tt.wantLen, body)
+				}
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(string(body), want) {
+					t.Errorf("response %s doesn't contain %s", body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIReadOnly(t *testing.T) {
+	m := newTestMonitor(t)
+	server := httptest.NewServer(NewAPI(m, ""))
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /keys status = %d, want 200", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("DELETE", server.URL+"/keys/5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8", nil)
+	resp, err = server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("DELETE /keys status = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestAPIRemoteWrites(t *testing.T) {
+	m := newTestMonitor(t)
+	api := NewAPI(m, "secret")
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		wantStatus int
+	}{
+		{"local client", "127.0.0.1:40000", false, http.StatusNotFound},
+		{"remote client over HTTP", "192.0.2.1:40000", false, http.StatusForbidden},
+		{"remote client over HTTPS", "192.0.2.1:40000", true, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("DELETE", "/keys/SHA256:unknown", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestLoopbackAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:9311", true},
+		{"[::1]:9311", true},
+		{"localhost:9311", true},
+		{":9311", false},
+		{"0.0.0.0:9311", false},
+		{"192.0.2.1:9311", false},
+	}
+	for _, tt := range tests {
+		if got := LoopbackAddress(tt.addr); got != tt.want {
+			t.Errorf("LoopbackAddress(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package sshloginmonitor
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Finding severities, from the least to the most serious.
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Exit codes of "sshlm keys audit" for use in CI checks.
+// 1 is left for runtime errors reported by log.Fatal.
+const (
+	AuditExitOK       = 0
+	AuditExitWarning  = 2
+	AuditExitCritical = 3
+)
+
+// minRSABits is the RSA key size below which keys are flagged.
+const minRSABits = 3072
+
+// Finding is a problem found by AuditKeys.
+type Finding struct {
+	Severity    string   `json:"severity"`
+	Check       string   `json:"check"`
+	Fingerprint string   `json:"fingerprint"`
+	KeyType     string   `json:"key_type"`
+	Bits        int      `json:"bits,omitempty"`
+	Accounts    []string `json:"accounts"`
+	Owners      []string `json:"owners,omitempty"`
+	Message     string   `json:"message"`
+}
+
+// auditedKey collects what the key store knows about one fingerprint.
+type auditedKey struct {
+	key      ssh.PublicKey
+	accounts []string
+	owners   []string
+}
+
+// AuditKeys checks every key in the key store and returns the findings:
+// DSA keys, RSA keys shorter than 3072 bits, ssh-rsa keys and certificates
+// relying on SHA-1 signatures, keys authorized on several accounts, and keys
+// claimed by several owners. The owner of a key in the owner registry takes
+// precedence over the comments of the key.
+func (m *Monitor) AuditKeys() ([]Finding, error) {
+	users, err := m.GetAllKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*auditedKey)
+	fingerprints := make([]string, 0)
+	for _, user := range users {
+		k, ok := keys[user.Fingerprint]
+		if !ok {
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(user.Key))
+			if err != nil {
+				return nil, err
+			}
+			k = &auditedKey{key: pub}
+			keys[user.Fingerprint] = k
+			fingerprints = append(fingerprints, user.Fingerprint)
+		}
+		k.accounts = appendUnique(k.accounts, user.Account)
+		if user.Username != "" {
+			k.owners = appendUnique(k.owners, user.Username)
+		}
+	}
+	sort.Strings(fingerprints)
+
+	findings := make([]Finding, 0)
+	for _, fp := range fingerprints {
+		k := keys[fp]
+		owner, registered, err := m.registeredOwner(fp)
+		if err != nil {
+			return nil, err
+		}
+		if registered {
+			k.owners = []string{owner.Name}
+		}
+		findings = append(findings, auditKey(fp, k)...)
+	}
+	return findings, nil
+}
+
+// auditKey runs all the checks on one key.
+func auditKey(fp string, k *auditedKey) []Finding {
+	findings := make([]Finding, 0)
+	add := func(severity, check, message string, bits int) {
+		findings = append(findings, Finding{
+			Severity:    severity,
+			Check:       check,
+			Fingerprint: fp,
+			KeyType:     k.key.Type(),
+			Bits:        bits,
+			Accounts:    k.accounts,
+			Owners:      k.owners,
+			Message:     message,
+		})
+	}
+
+	pub := k.key
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		if cert.Signature != nil && cert.Signature.Format == ssh.KeyAlgoRSA {
+			add(SeverityCritical, "sha1-signature", "certificate is signed with an ssh-rsa (SHA-1) signature", 0)
+		}
+		pub = cert.Key
+	}
+
+	switch pub.Type() {
+	case ssh.KeyAlgoDSA:
+		add(SeverityCritical, "dsa", "DSA keys are deprecated and disabled by default since OpenSSH 7.0", 0)
+	case ssh.KeyAlgoRSA:
+		bits := rsaBits(pub)
+		if bits < 2048 {
+			add(SeverityCritical, "rsa-size", fmt.Sprintf("RSA key is only %d bits", bits), bits)
+		} else if bits < minRSABits {
+			add(SeverityWarning, "rsa-size", fmt.Sprintf("RSA key is %d bits, less than %d", bits, minRSABits), bits)
+		}
+		add(SeverityInfo, "sha1-signature", "ssh-rsa key; clients must use rsa-sha2-256/512, ssh-rsa (SHA-1) signatures are deprecated", bits)
+	}
+
+	if len(k.accounts) > 1 {
+		add(SeverityWarning, "duplicate", "key is authorized on accounts "+strings.Join(k.accounts, ", "), 0)
+	}
+	if len(k.owners) > 1 {
+		add(SeverityWarning, "shared", "key is claimed by owners "+strings.Join(k.owners, ", "), 0)
+	}
+	return findings
+}
+
+// rsaBits returns the modulus size of an RSA public key, or 0 if it isn't one.
+func rsaBits(pub ssh.PublicKey) int {
+	cpk, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	rsaKey, ok := cpk.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return 0
+	}
+	return rsaKey.N.BitLen()
+}
+
+// AuditExitCode returns the exit code for the most serious finding.
+func AuditExitCode(findings []Finding) int {
+	code := AuditExitOK
+	for _, f := range findings {
+		switch f.Severity {
+		case SeverityCritical:
+			return AuditExitCritical
+		case SeverityWarning:
+			code = AuditExitWarning
+		}
+	}
+	return code
+}
+
+// appendUnique appends s to the slice unless it's already there.
+func appendUnique(slice []string, s string) []string {
+	for _, v := range slice {
+		if v == s {
+			return slice
+		}
+	}
+	return append(slice, s)
+}
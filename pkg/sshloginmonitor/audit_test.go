@@ -0,0 +1,90 @@
+package sshloginmonitor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	testKeyDSA = "ssh-dss AAAAB3NzaC1kc3MAAACBAOF6cOfB7ttjTo8v1eU9MxWSYlsRdXNqOEMZ4hGAHCMFwV7Cr8bcFU+sS49hQ7cT4BrSsXmsPBylNU4POgoGIUj99cihKlghC+VlKqrvSceyXRR4++8qP6EBzv4jo4/qX9opfrXq7v0nX6zVFilD3eqMDeW5OsXn1LfnKBGqXPQhAAAAFQCFi9ecIav08sjQTlWA+gYJTndTiwAAAIEA1edHq3TgRIAhBuAlHKQbfoZCGXqibp0DZaXNEUTgIpuWOSC8DTmsNlah2EU1FKplSkllA4LXF/B3VqY5ehZgnNaTyMrRAPpFWMhQavmuBOxirVc6qRxd28Z7u8kIsmD+xJ1hYJGSh97EQmGY9rWbmg3kIPBlCaYNp8JUCGk2bewAAACBAKLYOQgkn/reBNFUjNC3UYDdc4ovMRYT5TU5CptvJi8pINQiiN+Z9ia8rJucbbtwCXF0pJ6tGHin2qdEY1ouyrj8loQ+8cMAUqtoILG2MRt0DA14LaWE6PffaRr6FLbIbNku0Iy9hmApVcRiIGJ2qD/YP3a/EN/tShJTeouyzy3w dave@old"
+	testKeyRSA = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCjRf2uhNckiyU+/atanUGHlLJ0UGhPjtP38urBUXpWSk9iws2G3Lh7nNYTB/tlD9KO3DPzIPeqj/8vLJDJ5Bn7jm+Si1qXE7ivSus4ZSI9UuMtFBJEbaOBP4JmNBlhxNCCmbkZHUGnGBa9A79uxkkSMwVidh9URQYptM21QD19mAgMkXlKWGFumlWCRGSDDUaRThV+VlYR/m9w7eluK9i1y6alN3q/Q/OLGl6M9U5+cpn3uYksQlzY3CUUVAY/dVbeKEaPZMFLV2xeEKrz61ygFr24vrjNRSTUtrtNG6TAtMFbsgaYr1eBQ3DrVj5hfJrzA4abCYn9FlWfwNgAbtNT carol@laptop"
+)
+
+func TestAuditKeys(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := NewMonitor(db, Options{Bucket: "LoginMonitor", UpdateKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"root": `ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG8Obx1FsUu1jlYDtzfEDHYSDjG82xE7ysxZVzhgpGC5 alice@fedora
+` + testKeyRSA + "\n" + testKeyDSA,
+		"deploy": `ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG8Obx1FsUu1jlYDtzfEDHYSDjG82xE7ysxZVzhgpGC5 bob@fedora`,
+	}
+	for account, keys := range files {
+		users := make([]User, 0)
+		err = getAuthKeys(strings.NewReader(keys), &users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setAccount(users, account)
+		err = m.addUsersToDB(users)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	findings, err := m.AuditKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for _, f := range findings {
+		got[f.Fingerprint] = append(got[f.Fingerprint], f.Severity+" "+f.Check)
+	}
+	want := map[string][]string{
+		"5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8": {"warning duplicate", "warning shared"},
+		"8lBB+v/4OAoZs4HAd2z6Ydn8oMCaI1OK/mQYv8iTc0o": {"warning rsa-size", "info sha1-signature"},
+	}
+	for fp, checks := range want {
+		if !reflect.DeepEqual(got[fp], checks) {
+			t.Errorf("AuditKeys() findings for %s = %v, want %v", fp, got[fp], checks)
+		}
+	}
+	if AuditExitCode(findings) != AuditExitCritical {
+		t.Errorf("AuditExitCode() = %d, want %d (DSA key)", AuditExitCode(findings), AuditExitCritical)
+	}
+	if AuditExitCode(nil) != AuditExitOK {
+		t.Errorf("AuditExitCode(nil) = %d, want %d", AuditExitCode(nil), AuditExitOK)
+	}
+
+	// The registry owner replaces the comments of a registered key
+	owners := filepath.Join(t.TempDir(), "owners.csv")
+	err = os.WriteFile(owners, []byte("Alice Smith,SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.UpdateOwnersDB(owners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	findings, err = m.AuditKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range findings {
+		if f.Check == "shared" {
+			t.Errorf("registered key reported as shared by %v", f.Owners)
+		}
+	}
+}
@@ -0,0 +1,620 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BanConfig configures brute-force detection and blocking, from the bans
+// section of the configuration, e.g.
+//
+//	bans:
+//	  backend: nftables
+//	  set: inet filter sshlm
+//	  per_ip: {failures: 5, window: 10m}
+//	  per_account: {failures: 20, window: 10m}
+//	  duration: 1h
+//	  whitelist: [10.0.0.0/8]
+type BanConfig struct {
+	// Backend is "nftables", "ipset", "hosts.deny" or "dry-run", which
+	// writes the nftables commands instead of running them
+	Backend string `json:"backend"`
+	// Set is the nftables set ("inet filter sshlm" by default) or the ipset
+	// ("sshlm" by default) holding IPv4 addresses; Set6 holds IPv6 addresses
+	// (Set with a 6 appended by default)
+	Set  string `json:"set"`
+	Set6 string `json:"set6"`
+	// HostsDeny is the hosts.deny file, /etc/hosts.deny by default
+	HostsDeny string `json:"hosts_deny"`
+	// DryRunFile receives the commands of the dry-run backend; they are
+	// logged if empty
+	DryRunFile string `json:"dry_run_file"`
+	// PerIP bans a source IP with too many failures; PerAccount bans all the
+	// source IPs failing on an account that has too many failures. PerIP is
+	// 5 failures in 10 minutes if neither is set
+	PerIP      BanThreshold `json:"per_ip"`
+	PerAccount BanThreshold `json:"per_account"`
+	Duration   string       `json:"duration"` // 1h if empty; 0 bans forever
+	// Whitelist lists the addresses and networks never banned, in addition
+	// to the loopback addresses
+	Whitelist []string `json:"whitelist"`
+}
+
+// BanThreshold is a number of failures within a time window.
+type BanThreshold struct {
+	Failures int    `json:"failures"`
+	Window   string `json:"window"`
+}
+
+// Ban is a banned source IP, as stored in the database.
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until,omitempty"` // zero for a permanent ban
+}
+
+// bansBucket returns the name of the bucket storing bans by IP.
+func bansBucket(bucket string) []byte {
+	return []byte(bucket + "/bans")
+}
+
+// Blocker blocks source IPs in a firewall or a similar backend.
+type Blocker interface {
+	// Block blocks the IP for d, or until it is unblocked if d is zero.
+	Block(ip string, d time.Duration) error
+	// Unblock lifts the block of the IP.
+	Unblock(ip string) error
+	// Close releases the resources of the blocker; the blocks stay.
+	Close() error
+}
+
+// NewBlocker returns the blocker of the configured backend.
+func NewBlocker(cfg BanConfig) (Blocker, error) {
+	switch cfg.Backend {
+	case "nftables", "dry-run":
+		set := cfg.Set
+		if set == "" {
+			set = "inet filter sshlm"
+		}
+		set6 := cfg.Set6
+		if set6 == "" {
+			set6 = set + "6"
+		}
+		b := &commandBlocker{
+			block: func(ip string, d time.Duration) []string {
+				element := ip
+				if d > 0 {
+					element += " timeout " + strconv.Itoa(int(d.Seconds())) + "s"
+				}
+				return append(append([]string{"nft", "add", "element"}, strings.Fields(pickSet(ip, set, set6))...), "{ "+element+" }")
+			},
+			unblock: func(ip string) []string {
+				return append(append([]string{"nft", "delete", "element"}, strings.Fields(pickSet(ip, set, set6))...), "{ "+ip+" }")
+			},
+			run: runBlockCommand,
+		}
+		if cfg.Backend == "dry-run" {
+			w := io.Writer(nil)
+			if cfg.DryRunFile != "" {
+				f, err := os.OpenFile(cfg.DryRunFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+				if err != nil {
+					return nil, err
+				}
+				w = f
+				b.closer = f
+			}
+			b.run = func(args []string) error {
+				if w == nil {
+					log.Printf("dry run: %s", strings.Join(args, " "))
+					return nil
+				}
+				_, err := fmt.Fprintln(w, strings.Join(args, " "))
+				return err
+			}
+		}
+		return b, nil
+	case "ipset", "iptables":
+		set := cfg.Set
+		if set == "" {
+			set = "sshlm"
+		}
+		set6 := cfg.Set6
+		if set6 == "" {
+			set6 = set + "6"
+		}
+		return &commandBlocker{
+			block: func(ip string, d time.Duration) []string {
+				args := []string{"ipset", "add", pickSet(ip, set, set6), ip}
+				if d > 0 {
+					args = append(args, "timeout", strconv.Itoa(int(d.Seconds())))
+				}
+				return append(args, "-exist")
+			},
+			unblock: func(ip string) []string {
+				return []string{"ipset", "del", pickSet(ip, set, set6), ip, "-exist"}
+			},
+			run: runBlockCommand,
+		}, nil
+	case "hosts.deny":
+		path := cfg.HostsDeny
+		if path == "" {
+			path = "/etc/hosts.deny"
+		}
+		return &hostsDenyBlocker{path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown ban backend %q", cfg.Backend)
+}
+
+// pickSet returns set6 for IPv6 addresses and set otherwise.
+func pickSet(ip, set, set6 string) string {
+	if strings.Contains(ip, ":") {
+		return set6
+	}
+	return set
+}
+
+// commandBlocker runs a command to block or unblock an IP.
+type commandBlocker struct {
+	block   func(ip string, d time.Duration) []string
+	unblock func(ip string) []string
+	run     func(args []string) error
+	closer  io.Closer // the file of the dry-run backend, if any
+}
+
+func (b *commandBlocker) Block(ip string, d time.Duration) error {
+	return b.run(b.block(ip, d))
+}
+
+func (b *commandBlocker) Unblock(ip string) error {
+	return b.run(b.unblock(ip))
+}
+
+func (b *commandBlocker) Close() error {
+	if b.closer == nil {
+		return nil
+	}
+	return b.closer.Close()
+}
+
+// runBlockCommand runs the command, returning its output in the error if it fails.
+func runBlockCommand(args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// hostsDenyBlocker adds "sshd: IP # sshlm" lines to a hosts.deny file.
+// It only blocks the new connections of a TCP wrappers enabled sshd.
+// It is safe for concurrent use.
+type hostsDenyBlocker struct {
+	mu   sync.Mutex // serializes the read-modify-write of the file
+	path string
+}
+
+// line returns the hosts.deny line blocking the IP.
+func (b *hostsDenyBlocker) line(ip string) string {
+	if strings.Contains(ip, ":") {
+		ip = "[" + ip + "]"
+	}
+	return "sshd: " + ip + " # sshlm"
+}
+
+func (b *hostsDenyBlocker) Block(ip string, d time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, err := os.ReadFile(b.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	line := b.line(ip)
+	for _, l := range strings.Split(string(data), "\n") {
+		if l == line {
+			return nil
+		}
+	}
+	f, err := os.OpenFile(b.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, line)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (b *hostsDenyBlocker) Unblock(ip string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	line := b.line(ip)
+	lines := strings.SplitAfter(string(data), "\n")
+	kept := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if strings.TrimSuffix(l, "\n") != line {
+			kept = append(kept, l)
+		}
+	}
+	if len(kept) == len(lines) {
+		return nil
+	}
+	// Replace the file in one step, so sshd never reads a partial file
+	tmp := b.path + ".sshlm"
+	err = os.WriteFile(tmp, []byte(strings.Join(kept, "")), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+func (b *hostsDenyBlocker) Close() error {
+	return nil
+}
+
+// failure is a failed attempt in a sliding window.
+type failure struct {
+	at time.Time
+	ip string
+}
+
+// banWindow counts the failures per key within a sliding window.
+type banWindow struct {
+	failures int
+	window   time.Duration
+	seen     map[string][]failure
+}
+
+// newBanWindow parses the threshold; it returns nil if it isn't set.
+func newBanWindow(t BanThreshold, name string) (*banWindow, error) {
+	if t.Failures == 0 && t.Window == "" {
+		return nil, nil
+	}
+	if t.Failures <= 0 {
+		return nil, fmt.Errorf("bans: %s: failures must be positive", name)
+	}
+	window, err := ParseAge(t.Window)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("bans: %s: invalid window %q", name, t.Window)
+	}
+	return &banWindow{failures: t.Failures, window: window, seen: make(map[string][]failure)}, nil
+}
+
+// add records the failure and returns the failures of the key within the
+// window before now once there are enough of them; the key then starts over.
+// A failure logged before the window is ignored.
+func (w *banWindow) add(key string, f failure, now time.Time) []failure {
+	since := now.Add(-w.window)
+	if !f.at.After(since) {
+		return nil
+	}
+	kept := make([]failure, 0, len(w.seen[key])+1)
+	for _, old := range w.seen[key] {
+		if old.at.After(since) {
+			kept = append(kept, old)
+		}
+	}
+	kept = append(kept, f)
+	if len(kept) >= w.failures {
+		delete(w.seen, key)
+		return kept
+	}
+	w.seen[key] = kept
+	return nil
+}
+
+// purge forgets the keys without failures within the window before now.
+func (w *banWindow) purge(now time.Time) {
+	since := now.Add(-w.window)
+	for key, failures := range w.seen {
+		recent := false
+		for _, f := range failures {
+			recent = recent || f.at.After(since)
+		}
+		if !recent {
+			delete(w.seen, key)
+		}
+	}
+}
+
+// BanSink detects brute-force attacks in the failed attempts and bans their
+// source IPs. Bans are stored in the database and lifted when they expire.
+type BanSink struct {
+	blocker    Blocker
+	perIP      *banWindow
+	perAccount *banWindow
+	duration   time.Duration
+	whitelist  []*net.IPNet
+	m          *Monitor
+	now        func() time.Time
+}
+
+// NewBanSink returns a Sink banning the sources of brute-force attacks.
+//
+// Parameters:
+//   - m: the monitor whose database stores the bans
+//   - cfg: the ban configuration
+//   - blocker: the backend blocking the IPs, usually NewBlocker(cfg)
+//
+// Returns:
+//   - *BanSink: the sink
+//   - error: an error if the configuration is invalid
+func NewBanSink(m *Monitor, cfg BanConfig, blocker Blocker) (*BanSink, error) {
+	s := &BanSink{blocker: blocker, duration: time.Hour, m: m, now: time.Now}
+	var err error
+	s.perIP, err = newBanWindow(cfg.PerIP, "per_ip")
+	if err != nil {
+		return nil, err
+	}
+	s.perAccount, err = newBanWindow(cfg.PerAccount, "per_account")
+	if err != nil {
+		return nil, err
+	}
+	if s.perIP == nil && s.perAccount == nil {
+		s.perIP = &banWindow{failures: 5, window: 10 * time.Minute, seen: make(map[string][]failure)}
+	}
+	if cfg.Duration != "" {
+		s.duration, err = ParseAge(cfg.Duration)
+		if err != nil || s.duration < 0 {
+			return nil, fmt.Errorf("bans: invalid duration %q", cfg.Duration)
+		}
+	}
+	for _, cidr := range append([]string{"127.0.0.0/8", "::1"}, cfg.Whitelist...) {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("bans: whitelist: %w", err)
+		}
+		s.whitelist = append(s.whitelist, network)
+	}
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bansBucket(m.opts.Bucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Consume implements Sink. Expired bans are lifted every minute.
+func (s *BanSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	s.expire()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			err := s.add(event)
+			if err != nil {
+				return err
+			}
+		case <-ticker.C:
+			s.expire()
+		}
+	}
+}
+
+// add counts the failed attempt and bans its source if there are too many.
+// The windows count the failures by the time they were logged, so a failure
+// delivered late, e.g. by the journal, only counts if it is still recent.
+func (s *BanSink) add(event SessionEvent) error {
+	if event.EventType != "failure" || s.whitelisted(event.SourceIP) {
+		return nil
+	}
+	now := s.now()
+	f := failure{at: event.EventTime, ip: event.SourceIP}
+	if s.perIP != nil {
+		if failures := s.perIP.add(event.SourceIP, f, now); failures != nil {
+			reason := fmt.Sprintf("%d failures from %s in %s", len(failures), event.SourceIP, s.perIP.window)
+			err := s.ban(event.SourceIP, reason)
+			if err != nil {
+				return err
+			}
+		}
+		s.perIP.purge(now)
+	}
+	if s.perAccount != nil {
+		if failures := s.perAccount.add(event.Username, f, now); failures != nil {
+			reason := fmt.Sprintf("%d failures on account %s in %s", len(failures), event.Username, s.perAccount.window)
+			ips := make([]string, 0)
+			for _, f := range failures {
+				ips = appendUnique(ips, f.ip)
+			}
+			for _, ip := range ips {
+				err := s.ban(ip, reason)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		s.perAccount.purge(now)
+	}
+	return nil
+}
+
+// Unban lifts the ban of the IP in the sink's backend and removes it from
+// the database. It reports whether the IP was banned.
+func (s *BanSink) Unban(ip string) (bool, error) {
+	return s.m.Unban(ip, s.blocker)
+}
+
+// whitelisted reports whether the IP must never be banned; invalid IPs
+// can't be banned either.
+func (s *BanSink) whitelisted(sourceIP string) bool {
+	ip := net.ParseIP(sourceIP)
+	if ip == nil {
+		return true
+	}
+	for _, network := range s.whitelist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ban blocks the IP and stores the ban, unless it is already banned.
+// A backend failure is logged; only database errors are returned.
+func (s *BanSink) ban(ip, reason string) error {
+	now := s.now()
+	banned := false
+	err := s.m.db.View(func(tx *bolt.Tx) error {
+		banned = tx.Bucket(bansBucket(s.m.opts.Bucket)).Get([]byte(ip)) != nil
+		return nil
+	})
+	if err != nil || banned {
+		return err
+	}
+	err = s.blocker.Block(ip, s.duration)
+	if err != nil {
+		log.Printf("ban %s: %s", ip, err)
+		return nil
+	}
+	ban := Ban{IP: ip, Reason: reason, Since: now}
+	if s.duration > 0 {
+		ban.Until = now.Add(s.duration)
+	}
+	log.Printf("banned %s: %s", ip, reason)
+	return s.m.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(ban)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bansBucket(s.m.opts.Bucket)).Put([]byte(ip), data)
+	})
+}
+
+// expire lifts the bans that have expired.
+func (s *BanSink) expire() {
+	bans, err := s.m.GetBans()
+	if err != nil {
+		log.Printf("bans: %s", err)
+		return
+	}
+	now := s.now()
+	for _, ban := range bans {
+		if ban.Until.IsZero() || ban.Until.After(now) {
+			continue
+		}
+		// Backends with timeouts may have lifted the ban already
+		err := s.blocker.Unblock(ban.IP)
+		if err != nil {
+			log.Printf("unban %s: %s", ban.IP, err)
+		}
+		err = s.m.deleteBan(ban.IP)
+		if err != nil {
+			log.Printf("bans: %s", err)
+			continue
+		}
+		log.Printf("ban of %s expired", ban.IP)
+	}
+}
+
+// GetBans returns the stored bans, ordered by IP.
+func (m *Monitor) GetBans() ([]Ban, error) {
+	bans := make([]Ban, 0)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bansBucket(m.opts.Bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var ban Ban
+			err := json.Unmarshal(v, &ban)
+			if err != nil {
+				return err
+			}
+			bans = append(bans, ban)
+			return nil
+		})
+	})
+	return bans, err
+}
+
+// Unban lifts the ban of the IP in the backend and removes it from the database.
+//
+// Parameters:
+//   - ip: the banned IP
+//   - blocker: the backend that blocked it
+//
+// Returns:
+//   - bool: whether the IP was banned
+//   - error: an error if the backend or the database fails
+func (m *Monitor) Unban(ip string, blocker Blocker) (bool, error) {
+	banned := false
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bansBucket(m.opts.Bucket))
+		banned = b != nil && b.Get([]byte(ip)) != nil
+		return nil
+	})
+	if err != nil || !banned {
+		return false, err
+	}
+	err = blocker.Unblock(ip)
+	if err != nil {
+		return true, err
+	}
+	return true, m.deleteBan(ip)
+}
+
+// deleteBan removes the ban of the IP from the database.
+func (m *Monitor) deleteBan(ip string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bansBucket(m.opts.Bucket)).Delete([]byte(ip))
+	})
+}
+
+// PrintBans prints the bans as a table, or as JSON if jsonFlag is set.
+func PrintBans(w io.Writer, bans []Ban, jsonFlag bool) error {
+	if jsonFlag {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(bans)
+	}
+	fmt.Fprintf(w, "%-40s %-20s %-20s %s\n", "IP", "SINCE", "UNTIL", "REASON")
+	for _, ban := range bans {
+		until := "forever"
+		if !ban.Until.IsZero() {
+			until = ban.Until.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%-40s %-20s %-20s %s\n", ban.IP, ban.Since.Local().Format("2006-01-02 15:04:05"), until, ban.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBlocker records the IPs it blocks.
+type fakeBlocker struct {
+	blocked map[string]time.Duration
+}
+
+func (b *fakeBlocker) Block(ip string, d time.Duration) error {
+	b.blocked[ip] = d
+	return nil
+}
+
+func (b *fakeBlocker) Unblock(ip string) error {
+	delete(b.blocked, ip)
+	return nil
+}
+
+func (b *fakeBlocker) Close() error {
+	return nil
+}
+
+func TestBanSink(t *testing.T) {
+	start := time.Date(2023, 4, 27, 10, 0, 0, 0, time.UTC)
+	failure := func(minute int, account, ip string) SessionEvent {
+		return SessionEvent{EventType: "failure", EventTime: start.Add(time.Duration(minute) * time.Minute),
+			Username: account, SourceIP: ip, AuthMethod: "password"}
+	}
+	tests := []struct {
+		name   string
+		cfg    BanConfig
+		events []SessionEvent
+		want   []string
+	}{
+		{
+			name: "per IP",
+			cfg:  BanConfig{PerIP: BanThreshold{Failures: 3, Window: "10m"}},
+			events: []SessionEvent{
+				failure(0, "root", "203.0.113.1"), failure(1, "admin", "203.0.113.1"),
+				failure(2, "root", "198.51.100.7"), failure(3, "root", "203.0.113.1"),
+			},
+			want: []string{"203.0.113.1"},
+		},
+		{
+			name: "window slides",
+			cfg:  BanConfig{PerIP: BanThreshold{Failures: 3, Window: "10m"}},
+			events: []SessionEvent{
+				failure(0, "root", "203.0.113.1"), failure(6, "root", "203.0.113.1"),
+				failure(11, "root", "203.0.113.1"), failure(17, "root", "203.0.113.1"),
+			},
+			want: []string{},
+		},
+		{
+			name: "per account",
+			cfg:  BanConfig{PerAccount: BanThreshold{Failures: 3, Window: "1h"}},
+			events: []SessionEvent{
+				failure(0, "root", "203.0.113.1"), failure(10, "admin", "203.0.113.9"),
+				failure(20, "root", "198.51.100.7"), failure(30, "root", "192.0.2.5"),
+			},
+			want: []string{"192.0.2.5", "198.51.100.7", "203.0.113.1"},
+		},
+		{
+			name: "whitelist",
+			cfg:  BanConfig{PerIP: BanThreshold{Failures: 2, Window: "10m"}, Whitelist: []string{"10.0.0.0/8", "192.0.2.5"}},
+			events: []SessionEvent{
+				failure(0, "root", "10.1.1.1"), failure(1, "root", "10.1.1.1"),
+				failure(0, "root", "192.0.2.5"), failure(1, "root", "192.0.2.5"),
+				failure(0, "root", "127.0.0.1"), failure(1, "root", "127.0.0.1"),
+			},
+			want: []string{},
+		},
+		{
+			name: "logins don't count",
+			cfg:  BanConfig{PerIP: BanThreshold{Failures: 2, Window: "10m"}},
+			events: []SessionEvent{
+				{EventType: "login", SourceIP: "203.0.113.1"}, {EventType: "login", SourceIP: "203.0.113.1"},
+			},
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMonitor(t)
+			blocker := &fakeBlocker{blocked: make(map[string]time.Duration)}
+			sink, err := NewBanSink(m, tt.cfg, blocker)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, event := range tt.events {
+				now := event.EventTime // each failure arrives as it happens
+				sink.now = func() time.Time { return now }
+				err = sink.add(event)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			bans, err := m.GetBans()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0)
+			for _, ban := range bans {
+				got = append(got, ban.IP)
+				if blocker.blocked[ban.IP] != time.Hour {
+					t.Errorf("%s blocked for %s, want 1h", ban.IP, blocker.blocked[ban.IP])
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("banned %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBanSinkLateEvents(t *testing.T) {
+	m := newTestMonitor(t)
+	blocker := &fakeBlocker{blocked: make(map[string]time.Duration)}
+	sink, err := NewBanSink(m, BanConfig{PerIP: BanThreshold{Failures: 3, Window: "10m"}}, blocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 4, 27, 10, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time { return now }
+	// Failures delivered together count by the time they were logged:
+	// minutes ago they are within the window, hours ago they are too old
+	for i := 3; i > 0; i-- {
+		for _, event := range []SessionEvent{
+			{EventType: "failure", SourceIP: "203.0.113.1", EventTime: now.Add(-time.Duration(i) * time.Minute)},
+			{EventType: "failure", SourceIP: "198.51.100.7", EventTime: now.Add(-time.Duration(i) * time.Hour)},
+		} {
+			err = sink.add(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	bans, err := m.GetBans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].IP != "203.0.113.1" || !bans[0].Since.Equal(now) {
+		t.Errorf("bans = %+v, want 203.0.113.1 banned since %s", bans, now)
+	}
+}
+
+func TestBanExpiry(t *testing.T) {
+	m := newTestMonitor(t)
+	blocker := &fakeBlocker{blocked: make(map[string]time.Duration)}
+	sink, err := NewBanSink(m, BanConfig{PerIP: BanThreshold{Failures: 1, Window: "1m"}, Duration: "30m"}, blocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 4, 27, 10, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time { return now }
+	for _, ip := range []string{"203.0.113.1", "198.51.100.7"} {
+		err = sink.add(SessionEvent{EventType: "failure", SourceIP: ip, EventTime: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	banned, err := m.Unban("198.51.100.7", blocker)
+	if err != nil || !banned {
+		t.Fatalf("Unban() = %v, %v", banned, err)
+	}
+	banned, err = m.Unban("192.0.2.1", blocker)
+	if err != nil || banned {
+		t.Fatalf("Unban() of an IP that isn't banned = %v, %v", banned, err)
+	}
+
+	now = now.Add(29 * time.Minute)
+	sink.expire()
+	if _, ok := blocker.blocked["203.0.113.1"]; !ok {
+		t.Fatal("ban lifted too early")
+	}
+	now = now.Add(time.Minute)
+	sink.expire()
+	bans, err := m.GetBans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 0 || len(blocker.blocked) != 0 {
+		t.Errorf("bans left: %v, blocked: %v", bans, blocker.blocked)
+	}
+}
+
+func TestBlockerCommands(t *testing.T) {
+	tests := []struct {
+		cfg         BanConfig
+		ip          string
+		d           time.Duration
+		block       string
+		unblock     string
+		permanently string
+	}{
+		{
+			cfg: BanConfig{Backend: "nftables"}, ip: "203.0.113.1", d: time.Hour,
+			block:   "nft add element inet filter sshlm { 203.0.113.1 timeout 3600s }",
+			unblock: "nft delete element inet filter sshlm { 203.0.113.1 }",
+		},
+		{
+			cfg: BanConfig{Backend: "nftables", Set: "ip fw banned", Set6: "ip6 fw banned"}, ip: "2001:db8::1",
+			block:   "nft add element ip6 fw banned { 2001:db8::1 }",
+			unblock: "nft delete element ip6 fw banned { 2001:db8::1 }",
+		},
+		{
+			cfg: BanConfig{Backend: "ipset"}, ip: "203.0.113.1", d: 10 * time.Minute,
+			block:   "ipset add sshlm 203.0.113.1 timeout 600 -exist",
+			unblock: "ipset del sshlm 203.0.113.1 -exist",
+		},
+		{
+			cfg: BanConfig{Backend: "iptables"}, ip: "2001:db8::1",
+			block:   "ipset add sshlm6 2001:db8::1 -exist",
+			unblock: "ipset del sshlm6 2001:db8::1 -exist",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.block, func(t *testing.T) {
+			blocker, err := NewBlocker(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var run []string
+			blocker.(*commandBlocker).run = func(args []string) error {
+				run = append(run, strings.Join(args, " "))
+				return nil
+			}
+			blocker.Block(tt.ip, tt.d)
+			blocker.Unblock(tt.ip)
+			if want := []string{tt.block, tt.unblock}; !reflect.DeepEqual(run, want) {
+				t.Errorf("commands = %q, want %q", run, want)
+			}
+		})
+	}
+}
+
+func TestDryRunBlocker(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.sh")
+	blocker, err := NewBlocker(BanConfig{Backend: "dry-run", DryRunFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker.Block("203.0.113.1", time.Minute)
+	blocker.Unblock("203.0.113.1")
+	err = blocker.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "nft add element inet filter sshlm { 203.0.113.1 timeout 60s }\nnft delete element inet filter sshlm { 203.0.113.1 }\n"
+	if string(got) != want {
+		t.Errorf("dry run wrote %q, want %q", got, want)
+	}
+}
+
+func TestHostsDenyBlocker(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts.deny")
+	err := os.WriteFile(file, []byte("# existing rules\nALL: 192.0.2.0/24\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker, err := NewBlocker(BanConfig{Backend: "hosts.deny", HostsDeny: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"203.0.113.1", "2001:db8::1", "203.0.113.1"} {
+		err = blocker.Block(ip, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, _ := os.ReadFile(file)
+	want := "# existing rules\nALL: 192.0.2.0/24\nsshd: 203.0.113.1 # sshlm\nsshd: [2001:db8::1] # sshlm\n"
+	if string(got) != want {
+		t.Errorf("hosts.deny = %q, want %q", got, want)
+	}
+	err = blocker.Unblock("203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = os.ReadFile(file)
+	want = "# existing rules\nALL: 192.0.2.0/24\nsshd: [2001:db8::1] # sshlm\n"
+	if string(got) != want {
+		t.Errorf("hosts.deny = %q, want %q", got, want)
+	}
+}
+
+func TestHostsDenyBlockerConcurrent(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts.deny")
+	blocker, err := NewBlocker(BanConfig{Backend: "hosts.deny", HostsDeny: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 20; i++ {
+		err = blocker.Block(fmt.Sprintf("198.51.100.%d", i), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The pipeline bans while the API unbans
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := blocker.Block(fmt.Sprintf("203.0.113.%d", i), time.Hour); err != nil {
+				t.Error(err)
+			}
+			if err := blocker.Unblock(fmt.Sprintf("198.51.100.%d", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	got, _ := os.ReadFile(file)
+	if n := strings.Count(string(got), "sshd: 203.0.113."); n != 20 || strings.Contains(string(got), "198.51.100.") {
+		t.Errorf("hosts.deny has %d of the 20 new lines or old ones left:\n%s", n, got)
+	}
+}
+
+func TestPrintBans(t *testing.T) {
+	var buf bytes.Buffer
+	since := time.Date(2023, 4, 27, 10, 0, 0, 0, time.Local)
+	err := PrintBans(&buf, []Ban{{IP: "203.0.113.1", Reason: "5 failures", Since: since}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "203.0.113.1") || !strings.Contains(buf.String(), "forever") {
+		t.Errorf("PrintBans() = %q", buf.String())
+	}
+}
+
+func TestNewBanSink(t *testing.T) {
+	m := newTestMonitor(t)
+	tests := []struct {
+		name    string
+		cfg     BanConfig
+		wantErr bool
+	}{
+		{name: "defaults", cfg: BanConfig{}},
+		{name: "bad failures", cfg: BanConfig{PerIP: BanThreshold{Window: "10m"}}, wantErr: true},
+		{name: "bad window", cfg: BanConfig{PerAccount: BanThreshold{Failures: 5, Window: "soon"}}, wantErr: true},
+		{name: "bad duration", cfg: BanConfig{Duration: "a while"}, wantErr: true},
+		{name: "bad whitelist", cfg: BanConfig{Whitelist: []string{"10.0.0.0/40"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewBanSink(m, tt.cfg, &fakeBlocker{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewBanSink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	_, err := NewBlocker(BanConfig{Backend: "pf"})
+	if err == nil {
+		t.Error("NewBlocker() accepted an unknown backend")
+	}
+}
@@ -0,0 +1,291 @@
+package sshloginmonitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dashboardFeedSize is the number of recent events the dashboard keeps.
+const dashboardFeedSize = 500
+
+// Dashboard keeps the state shown by `sshlm top`: open sessions, recent
+// events, failed attempts and login counts per key user. It is a Sink, so it
+// can be fed by any pipeline, and it is safe for concurrent use.
+type Dashboard struct {
+	m        *Monitor
+	sessions SessionLister
+
+	mu       sync.Mutex
+	feed     []SessionEvent
+	logins   map[string]int
+	failures int
+	filter   string
+	changed  chan struct{}
+}
+
+// NewDashboard returns an empty dashboard using the monitor's theme and
+// showing the sessions listed by sessions, usually the pipeline feeding it.
+func NewDashboard(m *Monitor, sessions SessionLister) *Dashboard {
+	return &Dashboard{
+		m:        m,
+		sessions: sessions,
+		logins:   make(map[string]int),
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// Consume implements Sink.
+func (d *Dashboard) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	return consume(ctx, events, func(event SessionEvent) error {
+		d.add(event)
+		return nil
+	})
+}
+
+// add updates the dashboard state with the event.
+func (d *Dashboard) add(event SessionEvent) {
+	d.mu.Lock()
+	d.feed = append(d.feed, event)
+	if len(d.feed) > dashboardFeedSize {
+		d.feed = d.feed[len(d.feed)-dashboardFeedSize:]
+	}
+	switch event.EventType {
+	case "login":
+		d.logins[event.KeyUser]++
+	case "failure":
+		d.failures++
+	}
+	d.mu.Unlock()
+	d.notify()
+}
+
+// notify signals a change without blocking if a signal is already pending.
+func (d *Dashboard) notify() {
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Changed returns a channel receiving a value whenever the dashboard changes.
+func (d *Dashboard) Changed() <-chan struct{} {
+	return d.changed
+}
+
+// Filter returns the current filter.
+func (d *Dashboard) Filter() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.filter
+}
+
+// SetFilter shows only the sessions and events whose username, key user or
+// source IP contain filter. An empty filter shows everything.
+func (d *Dashboard) SetFilter(filter string) {
+	d.mu.Lock()
+	d.filter = filter
+	d.mu.Unlock()
+	d.notify()
+}
+
+// matches reports whether any of the fields contains the filter.
+func matches(filter string, fields ...string) bool {
+	if filter == "" {
+		return true
+	}
+	for _, field := range fields {
+		if strings.Contains(field, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// Render draws the dashboard on w for a terminal of the given size.
+// prompt replaces the key help on the bottom line, e.g. while the filter is
+// being edited.
+func (d *Dashboard) Render(w io.Writer, width, height int, now time.Time, prompt string) {
+	sessions := d.sessions.Sessions()
+	d.mu.Lock()
+	filter := d.filter
+	feed := make([]SessionEvent, len(d.feed))
+	copy(feed, d.feed)
+	logins := make(map[string]int, len(d.logins))
+	for k, v := range d.logins {
+		logins[k] = v
+	}
+	failures := d.failures
+	d.mu.Unlock()
+
+	usernameColor := d.m.colorFunc("username")
+	keyUserColor := d.m.colorFunc("keyuser")
+	eventtypeColor := d.m.colorFunc("eventtype")
+	eventtimeColor := d.m.colorFunc("eventtime")
+	sourceipColor := d.m.colorFunc("sourceip")
+	portColor := d.m.colorFunc("port")
+	starttimeColor := d.m.colorFunc("starttime")
+	durationColor := d.m.colorFunc("duration")
+
+	lines := make([]string, 0, height)
+	add := func(line string) {
+		lines = append(lines, line)
+	}
+
+	open := make([]Session, 0)
+	for _, session := range sessions {
+		if session.EndTime.IsZero() && matches(filter, session.Username, session.KeyUser, session.SourceIP) {
+			open = append(open, session)
+		}
+	}
+	status := fmt.Sprintf("sshlm top - %s   open sessions: %d   failures: %d",
+		now.Format("2006-01-02 15:04:05"), len(open), failures)
+	if filter != "" {
+		status += "   filter: " + filter
+	}
+	add(status)
+	add("")
+
+	// The sections share the screen: sessions and key users get up to a
+	// third of it each, the event feed gets the rest.
+	section := (height - 9) / 3
+	if section < 1 {
+		section = 1
+	}
+
+	add(fmt.Sprintf("OPEN SESSIONS (%d)", len(open)))
+	add(row(width, column{usernameColor, "%-16s", "USER"},
+		column{keyUserColor, "%-20s", "KEY USER"},
+		column{sourceipColor, "%-16s", "SOURCE IP"},
+		column{portColor, "%-6s", "PORT"},
+		column{starttimeColor, "%-20s", "START TIME"},
+		column{durationColor, "%-8s", "DURATION"}))
+	for i, session := range open {
+		if i == section {
+			add(fmt.Sprintf("... %d more", len(open)-section))
+			break
+		}
+		add(row(width, column{usernameColor, "%-16s", session.Username},
+			column{keyUserColor, "%-20s", session.KeyUser},
+			column{sourceipColor, "%-16s", session.SourceIP},
+			column{portColor, "%-6s", session.Port},
+			column{starttimeColor, "%-20s", session.StartTime.Format("2006-01-02 15:04:05")},
+			column{durationColor, "%-8s", now.Sub(session.StartTime).Truncate(time.Second).String()}))
+	}
+	add("")
+
+	keyUsers := make([]string, 0, len(logins))
+	for keyUser := range logins {
+		if matches(filter, keyUser) {
+			keyUsers = append(keyUsers, keyUser)
+		}
+	}
+	sort.Slice(keyUsers, func(i, j int) bool {
+		if logins[keyUsers[i]] != logins[keyUsers[j]] {
+			return logins[keyUsers[i]] > logins[keyUsers[j]]
+		}
+		return keyUsers[i] < keyUsers[j]
+	})
+	add("LOGINS PER KEY USER")
+	for i, keyUser := range keyUsers {
+		if i == section {
+			add(fmt.Sprintf("... %d more", len(keyUsers)-section))
+			break
+		}
+		add(row(width, column{keyUserColor, "%-20s", keyUser},
+			column{fmt.Sprintf, "%6s", strconv.Itoa(logins[keyUser])}))
+	}
+	add("")
+
+	add("RECENT EVENTS")
+	recent := make([]SessionEvent, 0, len(feed))
+	for _, event := range feed {
+		if matches(filter, event.Username, event.KeyUser, event.SourceIP) {
+			recent = append(recent, event)
+		}
+	}
+	room := height - len(lines) - 1 // keep the last line for the prompt
+	if room < 0 {
+		room = 0
+	}
+	if len(recent) > room {
+		recent = recent[len(recent)-room:]
+	}
+	for _, event := range recent {
+		keyUser := event.KeyUser
+		if event.EventType == "failure" {
+			keyUser = event.AuthMethod
+		}
+		add(row(width, column{eventtimeColor, "%-20s", event.EventTime.Format("2006-01-02 15:04:05")},
+			column{eventtypeColor, "%-8s", event.EventType},
+			column{usernameColor, "%-16s", event.Username},
+			column{keyUserColor, "%-20s", keyUser},
+			column{sourceipColor, "%-16s", event.SourceIP},
+			column{portColor, "%-6s", event.Port}))
+	}
+
+	for len(lines) < height-1 {
+		add("")
+	}
+	if prompt == "" {
+		prompt = "q: quit   /: filter by user or IP   esc: clear filter"
+	}
+	add(prompt)
+
+	fmt.Fprint(w, "\033[H\033[2J")
+	for i, line := range lines {
+		if i == height {
+			break
+		}
+		if i > 0 {
+			fmt.Fprint(w, "\n")
+		}
+		fmt.Fprint(w, truncateLine(line, width))
+	}
+}
+
+// column is a field of a dashboard row: its value, the format padding it and
+// the function coloring it.
+type column struct {
+	color  func(format string, a ...interface{}) string
+	format string
+	value  string
+}
+
+// row joins the columns with spaces and cuts the row at width before the
+// columns are colored, since escape codes have no width.
+func row(width int, columns ...column) string {
+	parts := make([]string, 0, len(columns))
+	used := 0
+	for i, c := range columns {
+		text := fmt.Sprintf(c.format, c.value)
+		if i > 0 {
+			used++ // the separator
+		}
+		if width > 0 {
+			if used >= width {
+				break
+			}
+			if used+len(text) > width {
+				text = text[:width-used]
+			}
+		}
+		used += len(text)
+		parts = append(parts, c.color("%s", text))
+	}
+	return strings.Join(parts, " ")
+}
+
+// truncateLine cuts plain lines longer than width so the screen doesn't
+// scroll. Colored lines are left alone: row already cut them to width.
+func truncateLine(line string, width int) string {
+	if width <= 0 || len(line) <= width || strings.Contains(line, "\033[") {
+		return line
+	}
+	return line[:width]
+}
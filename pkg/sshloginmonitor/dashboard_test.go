@@ -0,0 +1,92 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboard(t *testing.T) {
+	m := newTestMonitor(t)
+	log := testLog + "Apr 27 10:22:01 deep-rh sshd[1337500]: Failed password for admin from 10.0.0.7 port 50000 ssh2\n"
+	pipeline := NewPipeline([]Source{NewReaderSource(m, strings.NewReader(log))}, nil)
+	d := NewDashboard(m, pipeline)
+	pipeline.Sinks = []Sink{d}
+	err := pipeline.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		filter  string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:   "no filter",
+			filter: "",
+			want:   []string{"open sessions: 1   failures: 1", "OPEN SESSIONS (1)", "bob@fedora", "alice@fedora", "password", "10.0.0.7"},
+		},
+		{
+			name:    "filter by IP",
+			filter:  "10.0.0",
+			want:    []string{"filter: 10.0.0", "OPEN SESSIONS (0)", "failure"},
+			notWant: []string{"alice@fedora", "bob@fedora"},
+		},
+		{
+			name:    "filter by key user",
+			filter:  "alice",
+			want:    []string{"alice@fedora", "logout"},
+			notWant: []string{"bob@fedora", "10.0.0.7"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d.SetFilter(tt.filter)
+			var buf bytes.Buffer
+			d.Render(&buf, 120, 40, time.Now(), "")
+			got := buf.String()
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("Render() doesn't contain %q:\n%s", want, got)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(got, notWant) {
+					t.Errorf("Render() contains %q:\n%s", notWant, got)
+				}
+			}
+			if lines := strings.Count(got, "\n") + 1; lines != 40 {
+				t.Errorf("Render() drew %d lines, want 40", lines)
+			}
+		})
+	}
+}
+
+func TestRow(t *testing.T) {
+	red := func(format string, a ...interface{}) string {
+		return "\033[31m" + fmt.Sprintf(format, a...) + "\033[0m"
+	}
+	columns := []column{{red, "%-6s", "root"}, {fmt.Sprintf, "%s", "10.0.0.7"}}
+	tests := []struct {
+		name  string
+		width int
+		want  string
+	}{
+		{name: "fits", width: 80, want: "\033[31mroot  \033[0m 10.0.0.7"},
+		{name: "cut in the second column", width: 10, want: "\033[31mroot  \033[0m 10."},
+		{name: "cut in the first column", width: 3, want: "\033[31mroo\033[0m"},
+		{name: "no width", width: 0, want: "\033[31mroot  \033[0m 10.0.0.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := row(tt.width, columns...); got != tt.want {
+				t.Errorf("row() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
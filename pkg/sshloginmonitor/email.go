@@ -0,0 +1,433 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Email configures the email notifications, from the email section of the
+// configuration, e.g.
+//
+//	email:
+//	  host: smtp.example.com
+//	  port: 587
+//	  username: sshlm
+//	  password: s3cr3t
+//	  from: sshlm@example.com
+//	  to: [ops@example.com]
+//	  interval: 15m
+//	  daily_digest: "08:00"
+type Email struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"` // 587 if zero
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// TLS is "starttls" (the default), which fails if the server doesn't
+	// offer STARTTLS, or "none" for local relays
+	TLS string `json:"tls"`
+	// When selects the events to mail, see ParseExpr; only alerts by default
+	When string `json:"when"`
+	// Interval batches the selected events into one mail per interval;
+	// they are mailed one by one if empty
+	Interval string `json:"interval"`
+	// DailyDigest is the local time of day, e.g. "08:00", at which a digest
+	// of the sessions of the last 24 hours is mailed; no digest if empty
+	DailyDigest string `json:"daily_digest"`
+	// Subject, Body, DigestSubject and DigestBody are Go templates applied
+	// to an EmailData; they replace the default ones
+	Subject       string `json:"subject"`
+	Body          string `json:"body"`
+	DigestSubject string `json:"digest_subject"`
+	DigestBody    string `json:"digest_body"`
+}
+
+// EmailData is the data of the email templates.
+type EmailData struct {
+	Host     string         // host name of the monitor
+	Events   []SessionEvent // the notified events, or all the events of a digest
+	Sessions []Session      // the sessions of a digest
+	Since    time.Time      // start of the digest period
+	Until    time.Time      // end of the digest period
+}
+
+// Failures returns the failed login attempts among the events.
+func (d EmailData) Failures() []SessionEvent {
+	failures := make([]SessionEvent, 0)
+	for _, event := range d.Events {
+		if event.EventType == "failure" {
+			failures = append(failures, event)
+		}
+	}
+	return failures
+}
+
+// Default email templates. The message function describes an event in one line.
+const (
+	defaultEmailSubject = `[sshlm {{.Host}}] {{if eq (len .Events) 1}}{{message (index .Events 0)}}{{else}}{{len .Events}} events{{end}}`
+	defaultEmailBody    = `{{range .Events}}{{.EventTime.Format "2006-01-02 15:04:05"}} {{message .}}
+{{end}}`
+	defaultDigestSubject = `[sshlm {{.Host}}] {{len .Sessions}} ssh sessions since {{.Since.Format "2006-01-02 15:04"}}`
+	defaultDigestBody    = `Sessions from {{.Since.Format "2006-01-02 15:04"}} to {{.Until.Format "2006-01-02 15:04"}}:
+{{range .Sessions}}
+{{.StartTime.Format "2006-01-02 15:04:05"}} {{.Username}} {{.KeyUser}} {{.SourceIP}}:{{.Port}} {{duration .StartTime .EndTime}}{{end}}
+{{with .Failures}}
+Failed attempts:
+{{range .}}
+{{.EventTime.Format "2006-01-02 15:04:05"}} {{message .}}{{end}}
+{{end}}`
+)
+
+// emailMaxPending is the number of events kept while mails can't be sent.
+const emailMaxPending = 1000
+
+// EmailSink mails the selected events, one by one or batched per interval,
+// and a daily digest of the events stored in the database and the sessions
+// listed by Sessions. Mails are sent in the background, so a slow mail server
+// doesn't hold up the pipeline; those that can't be sent are retried at the
+// next interval, or after a minute.
+type EmailSink struct {
+	TLSConfig *tls.Config // for STARTTLS; verifies the server name if nil
+	// Sessions lists the sessions of the digest, usually the pipeline feeding the sink
+	Sessions SessionLister
+
+	cfg           Email
+	when          Expr
+	interval      time.Duration
+	digestAt      int // minutes since midnight; -1 for no digest
+	subject, body *template.Template
+	digestSubject *template.Template
+	digestBody    *template.Template
+	host          string
+	m             *Monitor
+
+	mu      sync.Mutex
+	pending []SessionEvent
+}
+
+// NewEmailSink returns a Sink mailing events as configured.
+//
+// Parameters:
+//   - m: the monitor whose database holds the events of the digest; its
+//     sessions come from the sink's Sessions
+//   - cfg: the email configuration
+//
+// Returns:
+//   - *EmailSink: the sink
+//   - error: an error if the configuration or a template is invalid
+func NewEmailSink(m *Monitor, cfg Email) (*EmailSink, error) {
+	if cfg.Host == "" || cfg.From == "" || len(cfg.To) == 0 {
+		return nil, errors.New("email: host, from and to are required")
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 587
+	}
+	switch cfg.TLS {
+	case "":
+		cfg.TLS = "starttls"
+	case "starttls", "none":
+	default:
+		return nil, fmt.Errorf("email: unknown tls %q", cfg.TLS)
+	}
+	s := &EmailSink{cfg: cfg, digestAt: -1, m: m}
+	when := cfg.When
+	if when == "" {
+		when = `type == "alert"`
+	}
+	var err error
+	s.when, err = ParseExpr(when)
+	if err != nil {
+		return nil, fmt.Errorf("email: when: %w", err)
+	}
+	if cfg.Interval != "" {
+		s.interval, err = ParseAge(cfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("email: interval: %w", err)
+		}
+	}
+	if cfg.DailyDigest != "" {
+		t, err := time.Parse("15:04", cfg.DailyDigest)
+		if err != nil {
+			return nil, fmt.Errorf("email: invalid daily_digest %q, expected e.g. 08:00", cfg.DailyDigest)
+		}
+		s.digestAt = t.Hour()*60 + t.Minute()
+	}
+	templates := []struct {
+		t    **template.Template
+		text string
+		def  string
+	}{
+		{&s.subject, cfg.Subject, defaultEmailSubject},
+		{&s.body, cfg.Body, defaultEmailBody},
+		{&s.digestSubject, cfg.DigestSubject, defaultDigestSubject},
+		{&s.digestBody, cfg.DigestBody, defaultDigestBody},
+	}
+	for _, t := range templates {
+		text := t.text
+		if text == "" {
+			text = t.def
+		}
+		*t.t, err = template.New("email").Funcs(m.templateFuncs()).
+			Funcs(template.FuncMap{"message": eventMessage}).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("email: %w", err)
+		}
+	}
+	s.host, err = os.Hostname()
+	if err != nil {
+		s.host = "localhost"
+	}
+	return s, nil
+}
+
+// Consume implements Sink. The pending events are mailed before it returns.
+func (s *EmailSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	wake := make(chan struct{}, 1)
+	sendCtx, stop := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.run(sendCtx, wake)
+	}()
+	err := consume(ctx, events, func(event SessionEvent) error {
+		if s.add(event) && s.interval == 0 {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+		return nil
+	})
+	stop()
+	wg.Wait()
+	s.flush()
+	return err
+}
+
+// run mails the pending events when wake is signaled or at every interval,
+// and the daily digest, until ctx is cancelled.
+func (s *EmailSink) run(ctx context.Context, wake <-chan struct{}) {
+	retry := s.interval
+	if retry == 0 {
+		retry = time.Minute
+	}
+	ticker := time.NewTicker(retry)
+	defer ticker.Stop()
+	var digest <-chan time.Time
+	var timer *time.Timer
+	if s.digestAt >= 0 {
+		timer = time.NewTimer(time.Until(s.nextDigest(time.Now())))
+		defer timer.Stop()
+		digest = timer.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+			s.flush()
+		case <-ticker.C:
+			s.flush()
+		case now := <-digest:
+			s.sendDigest(now)
+			timer.Reset(time.Until(s.nextDigest(time.Now())))
+		}
+	}
+}
+
+// add queues the event if it is selected and reports whether it was.
+func (s *EmailSink) add(event SessionEvent) bool {
+	if !s.when.Eval(event) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue([]SessionEvent{event})
+	return true
+}
+
+// queue appends the events to the pending ones, dropping the oldest beyond
+// emailMaxPending. s.mu must be held.
+func (s *EmailSink) queue(events []SessionEvent) {
+	s.pending = append(s.pending, events...)
+	if len(s.pending) > emailMaxPending {
+		log.Printf("email: too many unsent events, dropping the oldest")
+		s.pending = s.pending[len(s.pending)-emailMaxPending:]
+	}
+}
+
+// flush mails the pending events, and queues them again if the mail can't be sent.
+func (s *EmailSink) flush() {
+	s.mu.Lock()
+	events := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(events) == 0 {
+		return
+	}
+	data := EmailData{Host: s.host, Events: events}
+	err := s.send(s.subject, s.body, data)
+	if err != nil {
+		log.Printf("email: %d events not sent yet: %s", len(events), err)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		events = append(events, s.pending...)
+		s.pending = nil
+		s.queue(events)
+	}
+}
+
+// nextDigest returns the next time the daily digest is due after now.
+func (s *EmailSink) nextDigest(now time.Time) time.Time {
+	now = now.Local()
+	next := time.Date(now.Year(), now.Month(), now.Day(), s.digestAt/60, s.digestAt%60, 0, 0, time.Local)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// sendDigest mails the events stored and the sessions open in the 24 hours before until.
+func (s *EmailSink) sendDigest(until time.Time) {
+	since := until.Add(-24 * time.Hour)
+	end := until
+	stored, err := s.m.GetEvents(since)
+	if err != nil {
+		log.Printf("email: digest: %s", err)
+		return
+	}
+	events := make([]SessionEvent, 0, len(stored))
+	for _, event := range stored {
+		if !event.EventTime.After(end) {
+			events = append(events, event)
+		}
+	}
+	sessions := make([]Session, 0)
+	if s.Sessions != nil {
+		sessions = SessionsBetween(s.Sessions.Sessions(), since, end)
+	}
+	data := EmailData{Host: s.host, Events: events, Sessions: sessions, Since: since, Until: end}
+	err = s.send(s.digestSubject, s.digestBody, data)
+	if err != nil {
+		log.Printf("email: digest not sent: %s", err)
+	}
+}
+
+// send renders the templates and mails the message.
+func (s *EmailSink) send(subjectTmpl, bodyTmpl *template.Template, data EmailData) error {
+	var subject, body bytes.Buffer
+	err := subjectTmpl.Execute(&subject, data)
+	if err != nil {
+		return err
+	}
+	err = bodyTmpl.Execute(&body, data)
+	if err != nil {
+		return err
+	}
+	msg, err := s.message(strings.TrimSpace(subject.String()), body.Bytes(), time.Now())
+	if err != nil {
+		return err
+	}
+	return s.sendMail(msg)
+}
+
+// message builds the mail with its headers, encoding the body as quoted-printable.
+func (s *EmailSink) message(subject string, body []byte, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		buf.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", s.cfg.From)
+	header("To", strings.Join(s.cfg.To, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	_, err := qp.Write(bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n")))
+	if err != nil {
+		return nil, err
+	}
+	err = qp.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendMail delivers the message over SMTP, with STARTTLS and authentication
+// as configured.
+func (s *EmailSink) sendMail(msg []byte) error {
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	c, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if s.cfg.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s doesn't support STARTTLS", addr)
+		}
+		config := s.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: s.cfg.Host}
+		}
+		err = c.StartTLS(config)
+		if err != nil {
+			return err
+		}
+	}
+	if s.cfg.Username != "" {
+		err = c.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(s.cfg.From)
+	if err != nil {
+		return err
+	}
+	for _, to := range s.cfg.To {
+		err = c.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,285 @@
+package sshloginmonitor
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a minimal SMTP server recording the mails it receives.
+type fakeSMTP struct {
+	listener net.Listener
+	tls      *tls.Config // offers STARTTLS if set
+	mu       sync.Mutex
+	mails    []fakeMail
+}
+
+type fakeMail struct {
+	auth    string // decoded AUTH PLAIN credentials
+	tls     bool
+	from    string
+	to      []string
+	headers textproto.MIMEHeader
+	body    string
+}
+
+// newFakeSMTP starts a fake SMTP server; with tlsConfig it offers STARTTLS.
+func newFakeSMTP(t *testing.T, tlsConfig *tls.Config) *fakeSMTP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{listener: listener, tls: tlsConfig}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// port returns the port the server listens on.
+func (s *fakeSMTP) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake ESMTP")
+	var mail fakeMail
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			if s.tls != nil && !mail.tls {
+				text.PrintfLine("250-fake\r\n250-STARTTLS\r\n250 AUTH PLAIN")
+			} else {
+				text.PrintfLine("250-fake\r\n250 AUTH PLAIN")
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 go ahead")
+			tlsConn := tls.Server(conn, s.tls)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+			mail.tls = true
+		case "AUTH":
+			_, creds, _ := strings.Cut(arg, " ")
+			decoded, _ := base64.StdEncoding.DecodeString(creds)
+			mail.auth = string(decoded)
+			text.PrintfLine("235 ok")
+		case "MAIL":
+			mail.from = strings.TrimSuffix(strings.TrimPrefix(arg, "FROM:<"), ">")
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			mail.to = append(mail.to, strings.TrimSuffix(strings.TrimPrefix(arg, "TO:<"), ">"))
+			text.PrintfLine("250 ok")
+		case "DATA":
+			text.PrintfLine("354 go ahead")
+			r := textproto.NewReader(bufio.NewReader(text.DotReader()))
+			mail.headers, _ = r.ReadMIMEHeader()
+			body, _ := io.ReadAll(quotedprintable.NewReader(r.R))
+			mail.body = strings.ReplaceAll(string(body), "\r\n", "\n")
+			s.mu.Lock()
+			s.mails = append(s.mails, mail)
+			s.mu.Unlock()
+			mail = fakeMail{tls: mail.tls}
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 ok")
+		}
+	}
+}
+
+// received returns the mails received so far.
+func (s *fakeSMTP) received() []fakeMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMail(nil), s.mails...)
+}
+
+func TestEmailSink(t *testing.T) {
+	m := newTestMonitor(t)
+	// Borrow the test certificate of httptest for STARTTLS
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+	server := newFakeSMTP(t, &tls.Config{Certificates: ts.TLS.Certificates})
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	sink, err := NewEmailSink(m, Email{
+		Host: "127.0.0.1", Port: server.port(), Username: "sshlm", Password: "s3cr3t",
+		From: "sshlm@example.com", To: []string{"ops@example.com", "sec@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.TLSConfig = &tls.Config{RootCAs: roots, ServerName: "example.com"}
+	sink.host = "bastion"
+
+	at := time.Date(2023, 4, 27, 10, 21, 19, 0, time.UTC)
+	alert := SessionEvent{EventType: "alert", EventTime: at, Username: "root", SourceIP: "10.0.0.1", Port: "22",
+		Alert: &Alert{Rule: "root-login", Severity: SeverityCritical, Message: "login of root (unknown key) from 10.0.0.1"}}
+	events := make(chan SessionEvent, 2)
+	events <- SessionEvent{EventType: "login", EventTime: at, Username: "root"}
+	events <- alert
+	close(events)
+	err = sink.Consume(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mails := server.received()
+	if len(mails) != 1 {
+		t.Fatalf("got %d mails, want 1", len(mails))
+	}
+	mail := mails[0]
+	if !mail.tls {
+		t.Error("mail sent without STARTTLS")
+	}
+	if mail.auth != "\x00sshlm\x00s3cr3t" {
+		t.Errorf("auth = %q", mail.auth)
+	}
+	if mail.from != "sshlm@example.com" || strings.Join(mail.to, ",") != "ops@example.com,sec@example.com" {
+		t.Errorf("envelope = %s -> %v", mail.from, mail.to)
+	}
+	wantSubject := "[sshlm bastion] [critical] root-login: login of root (unknown key) from 10.0.0.1"
+	if got := mail.headers.Get("Subject"); got != wantSubject {
+		t.Errorf("subject = %q, want %q", got, wantSubject)
+	}
+	wantBody := "2023-04-27 10:21:19 [critical] root-login: login of root (unknown key) from 10.0.0.1\n"
+	if mail.body != wantBody {
+		t.Errorf("body = %q, want %q", mail.body, wantBody)
+	}
+}
+
+func TestEmailSinkRequiresSTARTTLS(t *testing.T) {
+	m := newTestMonitor(t)
+	server := newFakeSMTP(t, nil)
+	sink, err := NewEmailSink(m, Email{Host: "127.0.0.1", Port: server.port(), From: "a@example.com", To: []string{"b@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.add(SessionEvent{EventType: "alert", Alert: &Alert{Rule: "r"}})
+	sink.flush()
+	if len(server.received()) != 0 {
+		t.Error("mail sent without STARTTLS")
+	}
+	if len(sink.pending) != 1 {
+		t.Errorf("the unsent event must be kept for a retry")
+	}
+}
+
+func TestEmailBatchAndDigest(t *testing.T) {
+	m := newTestMonitor(t)
+	server := newFakeSMTP(t, nil)
+	sink, err := NewEmailSink(m, Email{
+		Host: "127.0.0.1", Port: server.port(), TLS: "none", From: "a@example.com", To: []string{"b@example.com"},
+		When: `type == "failure"`, Interval: "10m", DailyDigest: "08:00",
+		Subject: "{{len .Events}} failures",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.host = "bastion"
+
+	// Batched: nothing is sent until the interval elapses
+	now := time.Now()
+	events := []SessionEvent{
+		{EventType: "login", EventTime: now.Add(-2 * time.Hour), Username: "root", KeyUser: "alice", SourceIP: "10.0.0.1", Port: "4000"},
+		{EventType: "failure", EventTime: now.Add(-90 * time.Minute), Username: "admin", AuthMethod: "password", SourceIP: "10.0.0.9", Port: "4001"},
+		{EventType: "logout", EventTime: now.Add(-time.Hour), Username: "root", SourceIP: "10.0.0.1", Port: "4000"},
+		{EventType: "failure", EventTime: now.Add(-30 * time.Hour), Username: "old"},
+	}
+	correlator := NewCorrelator()
+	sink.Sessions = correlator
+	for _, event := range events {
+		event = correlator.Process(event)
+		sink.add(event)
+		_, err := m.StoreEvent(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(server.received()); n != 0 {
+		t.Fatalf("got %d mails before the interval, want 0", n)
+	}
+	sink.flush()
+	mails := server.received()
+	if len(mails) != 1 || mails[0].headers.Get("Subject") != "2 failures" {
+		t.Fatalf("batch mails = %+v", mails)
+	}
+
+	sink.sendDigest(now)
+	mails = server.received()
+	if len(mails) != 2 {
+		t.Fatalf("got %d mails, want 2", len(mails))
+	}
+	digest := mails[1]
+	if got := digest.headers.Get("Subject"); !strings.HasPrefix(got, "[sshlm bastion] 1 ssh sessions since ") {
+		t.Errorf("digest subject = %q", got)
+	}
+	for _, want := range []string{"root alice 10.0.0.1:4000 1h0m0s", "Failed attempts:", "failed password login for admin"} {
+		if !strings.Contains(digest.body, want) {
+			t.Errorf("digest body doesn't contain %q:\n%s", want, digest.body)
+		}
+	}
+	if strings.Contains(digest.body, "old") {
+		t.Errorf("digest contains events older than a day:\n%s", digest.body)
+	}
+}
+
+func TestNewEmailSink(t *testing.T) {
+	m := newTestMonitor(t)
+	valid := Email{Host: "smtp.example.com", From: "a@example.com", To: []string{"b@example.com"}}
+	tests := []struct {
+		name    string
+		change  func(*Email)
+		wantErr bool
+	}{
+		{name: "valid", change: func(e *Email) {}},
+		{name: "no recipient", change: func(e *Email) { e.To = nil }, wantErr: true},
+		{name: "bad tls", change: func(e *Email) { e.TLS = "ssl" }, wantErr: true},
+		{name: "bad interval", change: func(e *Email) { e.Interval = "often" }, wantErr: true},
+		{name: "bad digest", change: func(e *Email) { e.DailyDigest = "8am" }, wantErr: true},
+		{name: "bad template", change: func(e *Email) { e.Body = "{{.Nope" }, wantErr: true},
+		{name: "bad condition", change: func(e *Email) { e.When = "type ==" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.change(&cfg)
+			_, err := NewEmailSink(m, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewEmailSink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
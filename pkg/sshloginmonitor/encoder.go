@@ -0,0 +1,507 @@
+package sshloginmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encoder encodes events and sessions as single-line records of a log
+// format, without the trailing newline.
+type Encoder interface {
+	EncodeEvent(event SessionEvent) ([]byte, error)
+	EncodeSession(session Session) ([]byte, error)
+}
+
+// EncoderFormats lists the formats of NewEncoder.
+var EncoderFormats = []string{"json", "cef", "leef", "ecs"}
+
+// productVersion is the product version in the CEF and LEEF headers.
+const productVersion = "1.0"
+
+// NewEncoder returns the encoder for a format:
+//   - json: the JSON of the events and sessions, as in the database
+//   - cef: ArcSight Common Event Format
+//   - leef: IBM QRadar Log Event Extended Format 2.0
+//   - ecs: Elastic Common Schema JSON documents
+//
+// Parameters:
+//   - format: the format name, one of EncoderFormats
+//
+// Returns:
+//   - Encoder: the encoder, naming this host as the device
+//   - error: an error if the format is unknown
+func NewEncoder(format string) (Encoder, error) {
+	host, _ := os.Hostname()
+	switch format {
+	case "json":
+		return jsonEncoder{}, nil
+	case "cef":
+		return &CEFEncoder{Host: host}, nil
+	case "leef":
+		return &LEEFEncoder{Host: host}, nil
+	case "ecs":
+		return &ECSEncoder{Host: host}, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q", format)
+}
+
+// EncodeEvents writes the events to w with the encoder, one per line.
+func EncodeEvents(w io.Writer, enc Encoder, events []SessionEvent) error {
+	for _, event := range events {
+		data, err := enc.EncodeEvent(event)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncodeSessions writes the sessions to w with the encoder, one per line.
+func EncodeSessions(w io.Writer, enc Encoder, sessions []Session) error {
+	for _, session := range sessions {
+		data, err := enc.EncodeSession(session)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeEvent returns the encoded event, or its JSON if enc is nil.
+func encodeEvent(enc Encoder, event SessionEvent) ([]byte, error) {
+	if enc == nil {
+		return json.Marshal(event)
+	}
+	return enc.EncodeEvent(event)
+}
+
+// jsonEncoder encodes events and sessions as JSON.
+type jsonEncoder struct{}
+
+// EncodeEvent implements Encoder.
+func (jsonEncoder) EncodeEvent(event SessionEvent) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+// EncodeSession implements Encoder.
+func (jsonEncoder) EncodeSession(session Session) ([]byte, error) {
+	return json.Marshal(session)
+}
+
+// eventOutcome returns the outcome of the authentication of the event:
+// success, failure, or "" for alerts.
+func eventOutcome(event SessionEvent) string {
+	switch event.EventType {
+	case "login", "logout":
+		return "success"
+	case "failure":
+		return "failure"
+	}
+	return ""
+}
+
+// eventName returns a short name of the event type.
+func eventName(event SessionEvent) string {
+	switch event.EventType {
+	case "login":
+		return "SSH login"
+	case "logout":
+		return "SSH logout"
+	case "failure":
+		return "SSH login failure"
+	case "alert":
+		if event.Alert != nil {
+			return event.Alert.Message
+		}
+	}
+	return "SSH " + event.EventType
+}
+
+// eventSeverity returns the severity of the event from 0 to 10, as used by
+// CEF and LEEF.
+func eventSeverity(event SessionEvent) int {
+	switch event.EventType {
+	case "login":
+		return 3
+	case "logout":
+		return 1
+	case "failure":
+		return 5
+	case "alert":
+		if event.Alert != nil {
+			switch event.Alert.Severity {
+			case SeverityInfo:
+				return 3
+			case SeverityCritical:
+				return 9
+			}
+		}
+		return 6
+	}
+	return 0
+}
+
+// eventID returns the ID of the kind of event: the event type, or
+// alert:RULE for alerts.
+func eventID(event SessionEvent) string {
+	if event.Alert != nil {
+		return "alert:" + event.Alert.Rule
+	}
+	return event.EventType
+}
+
+// CEFEncoder encodes events and sessions in the ArcSight Common Event
+// Format, e.g.
+//
+//	CEF:0|sshlm|ssh-login-monitor|1.0|login|SSH login|3|rt=1682583679000 dvchost=bastion app=ssh duser=root suser=alice@fedora src=192.168.1.24 spt=49090 outcome=success
+//
+// The key email, team, fingerprint, authentication method and alert rule are
+// in the custom strings cs1 to cs5, labeled keyEmail, keyTeam, fingerprint,
+// authMethod and rule.
+type CEFEncoder struct {
+	Host string
+}
+
+// EncodeEvent implements Encoder.
+func (e *CEFEncoder) EncodeEvent(event SessionEvent) ([]byte, error) {
+	ext := [][2]string{
+		{"rt", cefTime(event.EventTime)},
+		{"dvchost", e.Host},
+		{"app", "ssh"},
+		{"duser", event.Username},
+		{"suser", event.KeyUser},
+		{"src", event.SourceIP},
+		{"spt", event.Port},
+		{"outcome", eventOutcome(event)},
+	}
+	rule := ""
+	if event.Alert != nil {
+		rule = event.Alert.Rule
+	}
+	ext = cefCustomStrings(ext, event.KeyEmail, event.KeyTeam, event.Fingerprint, event.AuthMethod, rule)
+	return cefRecord(eventID(event), eventName(event), eventSeverity(event), ext), nil
+}
+
+// EncodeSession implements Encoder. The duration in seconds is in cn1,
+// labeled durationSeconds, for closed sessions.
+func (e *CEFEncoder) EncodeSession(session Session) ([]byte, error) {
+	ext := [][2]string{
+		{"start", cefTime(session.StartTime)},
+		{"end", cefTime(session.EndTime)},
+		{"dvchost", e.Host},
+		{"app", "ssh"},
+		{"duser", session.Username},
+		{"suser", session.KeyUser},
+		{"src", session.SourceIP},
+		{"spt", session.Port},
+	}
+	ext = cefCustomStrings(ext, session.KeyEmail, session.KeyTeam)
+	if !session.EndTime.IsZero() {
+		ext = append(ext, [2]string{"cn1Label", "durationSeconds"},
+			[2]string{"cn1", strconv.FormatInt(int64(session.EndTime.Sub(session.StartTime)/time.Second), 10)})
+	}
+	return cefRecord("session", "SSH session", 1, ext), nil
+}
+
+// cefLabels are the labels of the CEF custom strings cs1 to cs5.
+var cefLabels = []string{"keyEmail", "keyTeam", "fingerprint", "authMethod", "rule"}
+
+// cefCustomStrings appends the non-empty values to the extensions as the
+// custom strings labeled with cefLabels.
+func cefCustomStrings(ext [][2]string, values ...string) [][2]string {
+	for i, value := range values {
+		if value != "" {
+			n := strconv.Itoa(i + 1)
+			ext = append(ext, [2]string{"cs" + n + "Label", cefLabels[i]}, [2]string{"cs" + n, value})
+		}
+	}
+	return ext
+}
+
+// cefTime returns the CEF time of an event time in milliseconds since the
+// epoch, or "" for the zero time.
+func cefTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// cefRecord returns a CEF record; extensions with empty values are left out.
+func cefRecord(id, name string, severity int, ext [][2]string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|sshlm|ssh-login-monitor|%s|%s|%s|%d|", productVersion,
+		cefHeaderEscaper.Replace(id), cefHeaderEscaper.Replace(name), severity)
+	sep := ""
+	for _, field := range ext {
+		if field[1] == "" {
+			continue
+		}
+		b.WriteString(sep + field[0] + "=" + cefExtensionEscaper.Replace(field[1]))
+		sep = " "
+	}
+	return []byte(b.String())
+}
+
+// LEEFEncoder encodes events and sessions in the IBM QRadar Log Event
+// Extended Format 2.0, with tab separated attributes, e.g.
+//
+//	LEEF:2.0|sshlm|ssh-login-monitor|1.0|login|x09|devTime=2023-04-27T10:21:19.000+02:00	devTimeFormat=yyyy-MM-dd'T'HH:mm:ss.SSSXXX	cat=login	sev=3	identHostName=bastion	usrName=root	keyUser=alice@fedora	src=192.168.1.24	srcPort=49090	outcome=success
+type LEEFEncoder struct {
+	Host string
+}
+
+// EncodeEvent implements Encoder.
+func (e *LEEFEncoder) EncodeEvent(event SessionEvent) ([]byte, error) {
+	attrs := append(leefDevTime(event.EventTime),
+		[2]string{"cat", event.EventType},
+		[2]string{"sev", strconv.Itoa(eventSeverity(event))},
+	)
+	attrs = append(attrs, [][2]string{
+		{"identHostName", e.Host},
+		{"usrName", event.Username},
+		{"keyUser", event.KeyUser},
+		{"keyEmail", event.KeyEmail},
+		{"keyTeam", event.KeyTeam},
+		{"src", event.SourceIP},
+		{"srcPort", event.Port},
+		{"fingerprint", event.Fingerprint},
+		{"authMethod", event.AuthMethod},
+		{"outcome", eventOutcome(event)},
+	}...)
+	if event.Alert != nil {
+		attrs = append(attrs, [2]string{"rule", event.Alert.Rule}, [2]string{"msg", event.Alert.Message})
+	}
+	return leefRecord(eventID(event), attrs), nil
+}
+
+// EncodeSession implements Encoder.
+func (e *LEEFEncoder) EncodeSession(session Session) ([]byte, error) {
+	attrs := append(leefDevTime(session.StartTime), [][2]string{
+		{"cat", "session"},
+		{"sev", "1"},
+		{"identHostName", e.Host},
+		{"usrName", session.Username},
+		{"keyUser", session.KeyUser},
+		{"keyEmail", session.KeyEmail},
+		{"keyTeam", session.KeyTeam},
+		{"src", session.SourceIP},
+		{"srcPort", session.Port},
+		{"startTime", leefTime(session.StartTime)},
+		{"endTime", leefTime(session.EndTime)},
+	}...)
+	if !session.EndTime.IsZero() {
+		attrs = append(attrs, [2]string{"durationSeconds",
+			strconv.FormatInt(int64(session.EndTime.Sub(session.StartTime)/time.Second), 10)})
+	}
+	return leefRecord("session", attrs), nil
+}
+
+// leefDevTime returns the devTime and devTimeFormat attributes of an event
+// time, or none for the zero time.
+func leefDevTime(t time.Time) [][2]string {
+	if t.IsZero() {
+		return nil
+	}
+	return [][2]string{{"devTime", leefTime(t)}, {"devTimeFormat", "yyyy-MM-dd'T'HH:mm:ss.SSSXXX"}}
+}
+
+// leefTime returns the LEEF time of an event time, or "" for the zero time.
+func leefTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+var (
+	leefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	leefValueEscaper  = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+)
+
+// leefRecord returns a LEEF record; attributes with empty values are left
+// out.
+func leefRecord(id string, attrs [][2]string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:2.0|sshlm|ssh-login-monitor|%s|%s|x09|", productVersion, leefHeaderEscaper.Replace(id))
+	sep := ""
+	for _, attr := range attrs {
+		if attr[1] == "" {
+			continue
+		}
+		b.WriteString(sep + attr[0] + "=" + leefValueEscaper.Replace(attr[1]))
+		sep = "\t"
+	}
+	return []byte(b.String())
+}
+
+// ecsVersion is the version of the Elastic Common Schema of ECSEncoder.
+const ecsVersion = "8.11.0"
+
+// ECSEncoder encodes events and sessions as Elastic Common Schema JSON
+// documents. The account is user.name; the key owner, which ECS has no field
+// for, is in sshlm.key.user with the other sshlm fields, and with the account
+// in related.user.
+type ECSEncoder struct {
+	Host string
+}
+
+// ecsDocument is the part of ECS written by ECSEncoder.
+type ecsDocument struct {
+	Timestamp string `json:"@timestamp"`
+	Message   string `json:"message"`
+	ECS       struct {
+		Version string `json:"version"`
+	} `json:"ecs"`
+	Event struct {
+		Kind     string   `json:"kind"`
+		Category []string `json:"category"`
+		Type     []string `json:"type"`
+		Action   string   `json:"action"`
+		Outcome  string   `json:"outcome,omitempty"`
+		Severity int      `json:"severity,omitempty"`
+		Dataset  string   `json:"dataset"`
+		Start    string   `json:"start,omitempty"`
+		End      string   `json:"end,omitempty"`
+		Duration int64    `json:"duration,omitempty"`
+	} `json:"event"`
+	Host struct {
+		Hostname string `json:"hostname,omitempty"`
+	} `json:"host"`
+	Process struct {
+		Name string `json:"name"`
+	} `json:"process"`
+	User struct {
+		Name string `json:"name,omitempty"`
+	} `json:"user"`
+	Source *ecsSource `json:"source,omitempty"`
+	Rule   *struct {
+		Name string `json:"name"`
+	} `json:"rule,omitempty"`
+	Related struct {
+		User []string `json:"user,omitempty"`
+		IP   []string `json:"ip,omitempty"`
+	} `json:"related"`
+	Sshlm ecsSshlm `json:"sshlm"`
+}
+
+type ecsSource struct {
+	IP   string `json:"ip,omitempty"`
+	Port int    `json:"port,omitempty"`
+}
+
+type ecsSshlm struct {
+	Key struct {
+		User        string `json:"user,omitempty"`
+		Email       string `json:"email,omitempty"`
+		Team        string `json:"team,omitempty"`
+		Fingerprint string `json:"fingerprint,omitempty"`
+	} `json:"key"`
+	AuthMethod    string `json:"auth_method,omitempty"`
+	AlertSeverity string `json:"alert_severity,omitempty"`
+}
+
+// newECSDocument returns a document with the fields shared by events and
+// sessions.
+func (e *ECSEncoder) newECSDocument(username, keyUser, keyEmail, keyTeam, sourceIP, port string) *ecsDocument {
+	doc := &ecsDocument{}
+	doc.ECS.Version = ecsVersion
+	doc.Host.Hostname = e.Host
+	doc.Process.Name = "sshd"
+	doc.User.Name = username
+	if sourceIP != "" {
+		doc.Source = &ecsSource{IP: sourceIP}
+		doc.Source.Port, _ = strconv.Atoi(port)
+		doc.Related.IP = []string{sourceIP}
+	}
+	for _, user := range []string{username, keyUser} {
+		if user != "" && user != UnknownOwner {
+			doc.Related.User = append(doc.Related.User, user)
+		}
+	}
+	doc.Sshlm.Key.User = keyUser
+	doc.Sshlm.Key.Email = keyEmail
+	doc.Sshlm.Key.Team = keyTeam
+	return doc
+}
+
+// EncodeEvent implements Encoder.
+func (e *ECSEncoder) EncodeEvent(event SessionEvent) ([]byte, error) {
+	doc := e.newECSDocument(event.Username, event.KeyUser, event.KeyEmail, event.KeyTeam, event.SourceIP, event.Port)
+	doc.Timestamp = ecsTime(event.EventTime)
+	doc.Message = eventMessage(event)
+	doc.Event.Kind = "event"
+	doc.Event.Category = []string{"authentication", "session"}
+	doc.Event.Action = "ssh-" + event.EventType
+	doc.Event.Outcome = eventOutcome(event)
+	doc.Event.Dataset = "sshlm.events"
+	switch event.EventType {
+	case "login":
+		doc.Event.Type = []string{"start"}
+	case "logout":
+		doc.Event.Category = []string{"session"}
+		doc.Event.Type = []string{"end"}
+	case "failure":
+		doc.Event.Category = []string{"authentication"}
+		doc.Event.Type = []string{"start"}
+	default:
+		doc.Event.Type = []string{"info"}
+	}
+	if event.Alert != nil {
+		doc.Event.Kind = "alert"
+		doc.Event.Category = []string{"intrusion_detection"}
+		doc.Event.Severity = eventSeverity(event)
+		doc.Message = event.Alert.Message
+		doc.Rule = &struct {
+			Name string `json:"name"`
+		}{event.Alert.Rule}
+		doc.Sshlm.AlertSeverity = event.Alert.Severity
+	}
+	doc.Sshlm.Key.Fingerprint = event.Fingerprint
+	doc.Sshlm.AuthMethod = event.AuthMethod
+	return json.Marshal(doc)
+}
+
+// EncodeSession implements Encoder.
+func (e *ECSEncoder) EncodeSession(session Session) ([]byte, error) {
+	doc := e.newECSDocument(session.Username, session.KeyUser, session.KeyEmail, session.KeyTeam, session.SourceIP, session.Port)
+	doc.Timestamp = ecsTime(session.StartTime)
+	doc.Message = fmt.Sprintf("session of %s by %s from %s port %s", session.Username, session.KeyUser, session.SourceIP, session.Port)
+	doc.Event.Kind = "event"
+	doc.Event.Category = []string{"session"}
+	doc.Event.Type = []string{"info"}
+	doc.Event.Action = "ssh-session"
+	doc.Event.Dataset = "sshlm.sessions"
+	doc.Event.Start = ecsTime(session.StartTime)
+	doc.Event.End = ecsTime(session.EndTime)
+	if !session.EndTime.IsZero() {
+		doc.Event.Duration = int64(session.EndTime.Sub(session.StartTime))
+	}
+	return json.Marshal(doc)
+}
+
+// ecsTime returns the ECS time of an event time, or "" for the zero time.
+func ecsTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02T15:04:05.000Z07:00")
+}
@@ -0,0 +1,238 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	encoderTime  = time.Date(2023, 4, 27, 10, 21, 19, 0, time.FixedZone("CEST", 2*60*60))
+	encoderLogin = SessionEvent{EventType: "login", EventTime: encoderTime, Username: "root", KeyUser: "alice@fedora",
+		KeyEmail: "alice@example.com", SourceIP: "192.168.1.24", Port: "49090", Fingerprint: "SHA256:abc="}
+	encoderFailure = SessionEvent{EventType: "failure", EventTime: encoderTime, Username: "bob|x", SourceIP: "10.0.0.9",
+		Port: "4000", AuthMethod: "password"}
+	encoderAlert = SessionEvent{EventType: "alert", EventTime: encoderTime, Username: "root", SourceIP: "10.0.0.1", Port: "22",
+		Alert: &Alert{Rule: "root-login", Severity: SeverityCritical, Message: "login of root=admin"}}
+	encoderSession = Session{Username: "root", SourceIP: "192.168.1.24", Port: "49090", KeyUser: "alice@fedora",
+		StartTime: encoderTime, EndTime: encoderTime.Add(90 * time.Minute)}
+)
+
+func TestCEFEncoder(t *testing.T) {
+	enc := &CEFEncoder{Host: "bastion"}
+	tests := []struct {
+		name  string
+		event SessionEvent
+		want  string
+	}{
+		{
+			name:  "login",
+			event: encoderLogin,
+			want:  `CEF:0|sshlm|ssh-login-monitor|1.0|login|SSH login|3|rt=1682583679000 dvchost=bastion app=ssh duser=root suser=alice@fedora src=192.168.1.24 spt=49090 outcome=success cs1Label=keyEmail cs1=alice@example.com cs3Label=fingerprint cs3=SHA256:abc\=`,
+		},
+		{
+			name:  "failure",
+			event: encoderFailure,
+			want:  `CEF:0|sshlm|ssh-login-monitor|1.0|failure|SSH login failure|5|rt=1682583679000 dvchost=bastion app=ssh duser=bob|x src=10.0.0.9 spt=4000 outcome=failure cs4Label=authMethod cs4=password`,
+		},
+		{
+			name:  "alert",
+			event: encoderAlert,
+			want:  `CEF:0|sshlm|ssh-login-monitor|1.0|alert:root-login|login of root=admin|9|rt=1682583679000 dvchost=bastion app=ssh duser=root src=10.0.0.1 spt=22 cs5Label=rule cs5=root-login`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := enc.EncodeEvent(tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("EncodeEvent() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	got, err := enc.EncodeSession(encoderSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `CEF:0|sshlm|ssh-login-monitor|1.0|session|SSH session|1|start=1682583679000 end=1682589079000 dvchost=bastion app=ssh duser=root suser=alice@fedora src=192.168.1.24 spt=49090 cn1Label=durationSeconds cn1=5400`
+	if string(got) != want {
+		t.Errorf("EncodeSession() = %s, want %s", got, want)
+	}
+}
+
+func TestCEFHeaderEscaping(t *testing.T) {
+	got := string(cefRecord(`a|b\c`, "x\ny", 1, nil))
+	want := `CEF:0|sshlm|ssh-login-monitor|1.0|a\|b\\c|x y|1|`
+	if got != want {
+		t.Errorf("cefRecord() = %s, want %s", got, want)
+	}
+}
+
+func TestLEEFEncoder(t *testing.T) {
+	enc := &LEEFEncoder{Host: "bastion"}
+	const header = "LEEF:2.0|sshlm|ssh-login-monitor|1.0|"
+	const devTime = "devTime=2023-04-27T10:21:19.000+02:00\tdevTimeFormat=yyyy-MM-dd'T'HH:mm:ss.SSSXXX\t"
+	tests := []struct {
+		name  string
+		event SessionEvent
+		want  string
+	}{
+		{
+			name:  "login",
+			event: encoderLogin,
+			want: header + "login|x09|" + devTime + "cat=login\tsev=3\tidentHostName=bastion\tusrName=root\tkeyUser=alice@fedora\t" +
+				"keyEmail=alice@example.com\tsrc=192.168.1.24\tsrcPort=49090\tfingerprint=SHA256:abc=\toutcome=success",
+		},
+		{
+			name:  "alert",
+			event: encoderAlert,
+			want: header + "alert:root-login|x09|" + devTime + "cat=alert\tsev=9\tidentHostName=bastion\tusrName=root\t" +
+				"src=10.0.0.1\tsrcPort=22\trule=root-login\tmsg=login of root=admin",
+		},
+		{
+			name:  "no time",
+			event: SessionEvent{EventType: "logout", Username: "a\tb"},
+			want:  header + "logout|x09|cat=logout\tsev=1\tidentHostName=bastion\tusrName=a b\toutcome=success",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := enc.EncodeEvent(tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("EncodeEvent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	got, err := enc.EncodeSession(Session{Username: "root", StartTime: encoderTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := header + "session|x09|" + devTime + "cat=session\tsev=1\tidentHostName=bastion\tusrName=root\t" +
+		"startTime=2023-04-27T10:21:19.000+02:00"
+	if string(got) != want {
+		t.Errorf("EncodeSession() = %q, want %q", got, want)
+	}
+}
+
+func TestECSEncoder(t *testing.T) {
+	enc := &ECSEncoder{Host: "bastion"}
+	tests := []struct {
+		name string
+		data func() ([]byte, error)
+		want string
+	}{
+		{
+			name: "login",
+			data: func() ([]byte, error) { return enc.EncodeEvent(encoderLogin) },
+			want: `{"@timestamp":"2023-04-27T10:21:19.000+02:00","message":"login of root by alice@fedora from 192.168.1.24 port 49090",
+				"ecs":{"version":"8.11.0"},
+				"event":{"kind":"event","category":["authentication","session"],"type":["start"],"action":"ssh-login","outcome":"success","dataset":"sshlm.events"},
+				"host":{"hostname":"bastion"},"process":{"name":"sshd"},"user":{"name":"root"},
+				"source":{"ip":"192.168.1.24","port":49090},
+				"related":{"user":["root","alice@fedora"],"ip":["192.168.1.24"]},
+				"sshlm":{"key":{"user":"alice@fedora","email":"alice@example.com","fingerprint":"SHA256:abc="}}}`,
+		},
+		{
+			name: "failure",
+			data: func() ([]byte, error) {
+				return enc.EncodeEvent(SessionEvent{EventType: "failure", EventTime: encoderTime, Username: "bob",
+					SourceIP: "10.0.0.9", Port: "4000", KeyUser: UnknownOwner, AuthMethod: "password"})
+			},
+			want: `{"@timestamp":"2023-04-27T10:21:19.000+02:00","message":"failed password login for bob from 10.0.0.9 port 4000",
+				"ecs":{"version":"8.11.0"},
+				"event":{"kind":"event","category":["authentication"],"type":["start"],"action":"ssh-failure","outcome":"failure","dataset":"sshlm.events"},
+				"host":{"hostname":"bastion"},"process":{"name":"sshd"},"user":{"name":"bob"},
+				"source":{"ip":"10.0.0.9","port":4000},
+				"related":{"user":["bob"],"ip":["10.0.0.9"]},
+				"sshlm":{"key":{"user":"unknown owner"},"auth_method":"password"}}`,
+		},
+		{
+			name: "alert",
+			data: func() ([]byte, error) { return enc.EncodeEvent(encoderAlert) },
+			want: `{"@timestamp":"2023-04-27T10:21:19.000+02:00","message":"login of root=admin",
+				"ecs":{"version":"8.11.0"},
+				"event":{"kind":"alert","category":["intrusion_detection"],"type":["info"],"action":"ssh-alert","severity":9,"dataset":"sshlm.events"},
+				"host":{"hostname":"bastion"},"process":{"name":"sshd"},"user":{"name":"root"},
+				"source":{"ip":"10.0.0.1","port":22},"rule":{"name":"root-login"},
+				"related":{"user":["root"],"ip":["10.0.0.1"]},
+				"sshlm":{"key":{},"alert_severity":"critical"}}`,
+		},
+		{
+			name: "session",
+			data: func() ([]byte, error) { return enc.EncodeSession(encoderSession) },
+			want: `{"@timestamp":"2023-04-27T10:21:19.000+02:00","message":"session of root by alice@fedora from 192.168.1.24 port 49090",
+				"ecs":{"version":"8.11.0"},
+				"event":{"kind":"event","category":["session"],"type":["info"],"action":"ssh-session","dataset":"sshlm.sessions",
+					"start":"2023-04-27T10:21:19.000+02:00","end":"2023-04-27T11:51:19.000+02:00","duration":5400000000000},
+				"host":{"hostname":"bastion"},"process":{"name":"sshd"},"user":{"name":"root"},
+				"source":{"ip":"192.168.1.24","port":49090},
+				"related":{"user":["root","alice@fedora"],"ip":["192.168.1.24"]},
+				"sshlm":{"key":{"user":"alice@fedora"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.data()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.ContainsRune(got, '\n') {
+				t.Errorf("document has several lines: %s", got)
+			}
+			var gotDoc, wantDoc any
+			if err := json.Unmarshal(got, &gotDoc); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantDoc); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotDoc, wantDoc) {
+				t.Errorf("document = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewEncoder(t *testing.T) {
+	for _, format := range EncoderFormats {
+		if _, err := NewEncoder(format); err != nil {
+			t.Errorf("NewEncoder(%q): %s", format, err)
+		}
+	}
+	if _, err := NewEncoder("xml"); err == nil {
+		t.Error("NewEncoder(\"xml\") succeeded")
+	}
+}
+
+func TestFileSinkEncoder(t *testing.T) {
+	path := t.TempDir() + "/events.cef"
+	events := make(chan SessionEvent, 2)
+	events <- encoderLogin
+	events <- encoderFailure
+	close(events)
+	err := (&FileSink{Path: path, Encoder: &CEFEncoder{Host: "bastion"}}).Consume(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "CEF:0|sshlm|ssh-login-monitor|1.0|login|") ||
+		!strings.HasPrefix(lines[1], "CEF:0|sshlm|ssh-login-monitor|1.0|failure|") {
+		t.Errorf("file = %q, want 2 CEF records", data)
+	}
+}
@@ -0,0 +1,164 @@
+package sshloginmonitor
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// eventsBucket returns the name of the bucket storing events by sequence number.
+func eventsBucket(bucket string) []byte {
+	return []byte(bucket + "/events")
+}
+
+// eventsIndexBucket returns the name of the bucket mapping event identities to
+// sequence numbers, which keeps re-parsed logs from storing events twice.
+func eventsIndexBucket(bucket string) []byte {
+	return []byte(bucket + "/events-index")
+}
+
+// itob encodes a sequence number as a sortable bolt key.
+func itob(n uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, n)
+	return key
+}
+
+// StoreEvent saves the event in the database unless the same event is already
+// there, and returns its sequence number.
+//
+// Parameters:
+//   - event: the event to store
+//
+// Returns:
+//   - uint64: the sequence number of the stored event
+//   - error: an error if the database can't be updated
+func (m *Monitor) StoreEvent(event SessionEvent) (uint64, error) {
+	seq, _, err := m.storeEvent(event)
+	return seq, err
+}
+
+// eventIdentity returns the key identifying the log line an event was parsed
+// from: its time, host, sshd process ID, port and type, and the rule for alerts.
+// The rest of the event is derived and may change between parses, e.g. the key
+// user when the owner registry is updated.
+func eventIdentity(event SessionEvent) []byte {
+	identity := strings.Join([]string{
+		event.EventTime.UTC().Format(time.RFC3339Nano),
+		event.Host,
+		event.PID,
+		event.Port,
+		event.EventType,
+	}, "\x00")
+	if event.Alert != nil {
+		identity += "\x00" + event.Alert.Rule
+	}
+	digest := sha256.Sum256([]byte(identity))
+	return digest[:]
+}
+
+// storeEvent is StoreEvent, also reporting whether the event is new.
+func (m *Monitor) storeEvent(event SessionEvent) (uint64, bool, error) {
+	bucket := m.opts.Bucket
+	event.ID = 0 // the ID is the key
+	data, err := json.Marshal(event)
+	if err != nil {
+		return 0, false, err
+	}
+	identity := eventIdentity(event)
+
+	var seq uint64
+	stored := false
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		index, err := tx.CreateBucketIfNotExists(eventsIndexBucket(bucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		if v := index.Get(identity); v != nil {
+			seq = binary.BigEndian.Uint64(v)
+			return nil
+		}
+		events, err := tx.CreateBucketIfNotExists(eventsBucket(bucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		seq, err = events.NextSequence()
+		if err != nil {
+			return err
+		}
+		err = events.Put(itob(seq), data)
+		if err != nil {
+			return err
+		}
+		stored = true
+		return index.Put(identity, itob(seq))
+	})
+	return seq, stored && err == nil, err
+}
+
+// GetEvents returns the stored events that happened at or after since, in the
+// order they were stored, with their IDs. A zero since returns all events.
+func (m *Monitor) GetEvents(since time.Time) ([]SessionEvent, error) {
+	events := make([]SessionEvent, 0)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket(m.opts.Bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			event, err := decodeEvent(k, v)
+			if err != nil {
+				return err
+			}
+			if !event.EventTime.Before(since) {
+				events = append(events, event)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// GetEventsAfter returns the events stored after the event with the given ID,
+// in the order they were stored, with their IDs.
+func (m *Monitor) GetEventsAfter(id uint64) ([]SessionEvent, error) {
+	events := make([]SessionEvent, 0)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket(m.opts.Bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(itob(id + 1)); k != nil; k, v = c.Next() {
+			event, err := decodeEvent(k, v)
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// decodeEvent decodes a stored event and sets its ID from the key.
+func decodeEvent(k, v []byte) (SessionEvent, error) {
+	var event SessionEvent
+	err := json.Unmarshal(v, &event)
+	if err != nil {
+		return SessionEvent{}, err
+	}
+	event.ID = binary.BigEndian.Uint64(k)
+	return event, nil
+}
@@ -0,0 +1,46 @@
+package sshloginmonitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStoreEvent(t *testing.T) {
+	m := newTestMonitor(t)
+	at := time.Date(2023, 4, 27, 10, 21, 19, 0, time.Local)
+	login := SessionEvent{EventType: "login", EventTime: at, Username: "root", SourceIP: "192.168.1.24", Port: "49090",
+		KeyUser: "alice@fedora", Host: "deep-rh", PID: "1337250"}
+	alert := login
+	alert.EventType = "alert"
+	alert.Alert = &Alert{Rule: "root-login"}
+
+	tests := []struct {
+		name   string
+		change func(e *SessionEvent)
+		want   bool
+	}{
+		{name: "new event", want: true},
+		{name: "same line", want: false},
+		{name: "same line with another key user", change: func(e *SessionEvent) { e.KeyUser = "bob@fedora" }, want: false},
+		{name: "another process", change: func(e *SessionEvent) { e.PID = "1337251" }, want: true},
+		{name: "another host", change: func(e *SessionEvent) { e.Host = "bastion" }, want: true},
+		{name: "alert for the line", change: func(e *SessionEvent) { *e = alert }, want: true},
+		{name: "same alert", change: func(e *SessionEvent) { *e = alert }, want: false},
+		{name: "another rule", change: func(e *SessionEvent) { *e = alert; e.Alert = &Alert{Rule: "other"} }, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := login
+			if tt.change != nil {
+				tt.change(&event)
+			}
+			_, stored, err := m.storeEvent(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored != tt.want {
+				t.Errorf("storeEvent() stored = %v, want %v", stored, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package sshloginmonitor
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a condition on a SessionEvent, parsed from a rule such as
+//
+//	type == "login" && username == "root" && !(key_team == "ops" || key_user =~ "^svc-")
+//
+// Comparisons are between an event field and a double-quoted string:
+// == and != compare strings, =~ and !~ match regular expressions.
+// They combine with &&, || and !, and group with parentheses.
+type Expr interface {
+	Eval(event SessionEvent) bool
+}
+
+// exprFields maps the field names usable in expressions to event fields.
+// key_user is empty for keys without a known owner; rule and severity are
+// empty except for alerts.
+var exprFields = map[string]func(SessionEvent) string{
+	"type":     func(e SessionEvent) string { return e.EventType },
+	"username": func(e SessionEvent) string { return e.Username },
+	"account":  func(e SessionEvent) string { return e.Username },
+	"key_user": func(e SessionEvent) string {
+		if e.KeyUser == UnknownOwner {
+			return ""
+		}
+		return e.KeyUser
+	},
+	"key_email":   func(e SessionEvent) string { return e.KeyEmail },
+	"key_team":    func(e SessionEvent) string { return e.KeyTeam },
+	"source_ip":   func(e SessionEvent) string { return e.SourceIP },
+	"port":        func(e SessionEvent) string { return e.Port },
+	"fingerprint": func(e SessionEvent) string { return e.Fingerprint },
+	"auth_method": func(e SessionEvent) string { return e.AuthMethod },
+	"rule": func(e SessionEvent) string {
+		if e.Alert == nil {
+			return ""
+		}
+		return e.Alert.Rule
+	},
+	"severity": func(e SessionEvent) string {
+		if e.Alert == nil {
+			return ""
+		}
+		return e.Alert.Severity
+	},
+}
+
+type trueExpr struct{}
+
+func (trueExpr) Eval(SessionEvent) bool { return true }
+
+type andExpr struct{ left, right Expr }
+
+func (e andExpr) Eval(event SessionEvent) bool { return e.left.Eval(event) && e.right.Eval(event) }
+
+type orExpr struct{ left, right Expr }
+
+func (e orExpr) Eval(event SessionEvent) bool { return e.left.Eval(event) || e.right.Eval(event) }
+
+type notExpr struct{ expr Expr }
+
+func (e notExpr) Eval(event SessionEvent) bool { return !e.expr.Eval(event) }
+
+type compareExpr struct {
+	field func(SessionEvent) string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (e compareExpr) Eval(event SessionEvent) bool {
+	v := e.field(event)
+	switch e.op {
+	case "==":
+		return v == e.value
+	case "!=":
+		return v != e.value
+	case "=~":
+		return e.re.MatchString(v)
+	default: // "!~"
+		return !e.re.MatchString(v)
+	}
+}
+
+// ParseExpr parses a rule condition. An empty condition matches every event.
+func ParseExpr(s string) (Expr, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return trueExpr{}, nil
+	}
+	p := &exprParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+// tokenize splits the expression into identifiers, quoted strings,
+// operators and parentheses.
+func tokenize(s string) ([]string, error) {
+	tokens := make([]string, 0)
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		case strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||") ||
+			strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") ||
+			strings.HasPrefix(s[i:], "=~") || strings.HasPrefix(s[i:], "!~"):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case c == '!':
+			tokens = append(tokens, "!")
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+// exprParser is a recursive descent parser for the grammar
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | "(" or ")" | compare
+//	compare = field ( "==" | "!=" | "=~" | "!~" ) string
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+// next returns the next token and advances, or "" at the end.
+func (p *exprParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+// peek returns the next token without advancing, or "" at the end.
+func (p *exprParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) or() (Expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) and() (Expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) unary() (Expr, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	case "(":
+		p.next()
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return expr, nil
+	}
+	return p.compare()
+}
+
+func (p *exprParser) compare() (Expr, error) {
+	name := p.next()
+	field, ok := exprFields[name]
+	if !ok {
+		if name == "" {
+			return nil, fmt.Errorf("unexpected end of expression")
+		}
+		return nil, fmt.Errorf("unknown field %q", name)
+	}
+	op := p.next()
+	if op != "==" && op != "!=" && op != "=~" && op != "!~" {
+		return nil, fmt.Errorf("expected a comparison after %s, got %q", name, op)
+	}
+	literal := p.next()
+	if !strings.HasPrefix(literal, `"`) {
+		return nil, fmt.Errorf("expected a string after %s %s, got %q", name, op, literal)
+	}
+	value, err := strconv.Unquote(literal)
+	if err != nil {
+		return nil, fmt.Errorf("invalid string %s: %w", literal, err)
+	}
+	expr := compareExpr{field: field, op: op, value: value}
+	if op == "=~" || op == "!~" {
+		expr.re, err = regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expr, nil
+}
@@ -0,0 +1,50 @@
+package sshloginmonitor
+
+import "testing"
+
+func TestParseExpr(t *testing.T) {
+	event := SessionEvent{
+		EventType: "login",
+		Username:  "root",
+		SourceIP:  "10.0.0.5",
+		KeyUser:   UnknownOwner,
+		KeyTeam:   "ops",
+	}
+	tests := []struct {
+		expr    string
+		want    bool
+		wantErr bool
+	}{
+		{expr: "", want: true},
+		{expr: `type == "login"`, want: true},
+		{expr: `type != "login"`, want: false},
+		{expr: `key_user == "" && username == "root"`, want: true},
+		{expr: `account == "admin" || key_team == "ops"`, want: true},
+		{expr: `!(username == "root")`, want: false},
+		{expr: `source_ip =~ "^10\\."`, want: true},
+		{expr: `source_ip !~ "^10\\."`, want: false},
+		{expr: `type == "login" && (username == "admin" || username == "root") && !(key_team == "dev")`, want: true},
+		{expr: `type == "failure" || username == "admin" && key_team == "ops"`, want: false},
+		{expr: `host == "a"`, wantErr: true},
+		{expr: `username = "root"`, wantErr: true},
+		{expr: `username == root`, wantErr: true},
+		{expr: `username == "root`, wantErr: true},
+		{expr: `(username == "root"`, wantErr: true},
+		{expr: `username == "root" &&`, wantErr: true},
+		{expr: `username =~ "("`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			expr, err := ParseExpr(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseExpr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := expr.Eval(event); got != tt.want {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package sshloginmonitor
+
+import (
+	"regexp"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/ssh"
+)
+
+// reMD5Fingerprint matches a legacy MD5 fingerprint, with or without the "MD5:" prefix.
+var reMD5Fingerprint = regexp.MustCompile(`^(?:MD5:)?([0-9a-f]{2}(?::[0-9a-f]{2}){15})$`)
+
+// md5Bucket returns the name of the bucket mapping MD5 fingerprints to SHA256 ones.
+func md5Bucket(bucket string) []byte {
+	return []byte(bucket + "/md5")
+}
+
+// fingerprints returns the SHA256 fingerprint without the "SHA256:" prefix,
+// which is how keys are stored in the database, and the legacy MD5 fingerprint
+// in the "3b:2c:..." form used by old sshd versions.
+func fingerprints(key ssh.PublicKey) (string, string) {
+	return strings.TrimPrefix(ssh.FingerprintSHA256(key), "SHA256:"), ssh.FingerprintLegacyMD5(key)
+}
+
+// putMD5Fingerprint indexes the key under its MD5 fingerprint as well.
+// It must be called inside a read-write transaction.
+func putMD5Fingerprint(tx *bolt.Tx, bucket string, user User) error {
+	if user.FingerprintMD5 == "" {
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists(md5Bucket(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(user.FingerprintMD5), []byte(user.Fingerprint))
+}
+
+// canonicalFingerprint returns the SHA256 fingerprint, without the prefix, for
+// a fingerprint in any of the formats sshd logs: "SHA256:...", "MD5:3b:2c:...",
+// "3b:2c:..." or a bare SHA256 base64 string. MD5 fingerprints of keys that were
+// never added to the database are returned unchanged with the "MD5:" prefix.
+func canonicalFingerprint(tx *bolt.Tx, bucket string, fp string) string {
+	match := reMD5Fingerprint.FindStringSubmatch(fp)
+	if match == nil {
+		return strings.TrimPrefix(fp, "SHA256:")
+	}
+	if b := tx.Bucket(md5Bucket(bucket)); b != nil {
+		if sha := b.Get([]byte(match[1])); sha != nil {
+			return string(sha)
+		}
+	}
+	return "MD5:" + match[1]
+}
+
+// CanonicalFingerprint returns the SHA256 fingerprint under which the key with
+// the given SHA256 or MD5 fingerprint is stored.
+func (m *Monitor) CanonicalFingerprint(fp string) (string, error) {
+	var canonical string
+	err := m.db.View(func(tx *bolt.Tx) error {
+		canonical = canonicalFingerprint(tx, m.opts.Bucket, fp)
+		return nil
+	})
+	return canonical, err
+}
@@ -0,0 +1,76 @@
+package sshloginmonitor
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestLegacyFingerprints(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := NewMonitor(db, Options{Bucket: "LoginMonitor", UpdateKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make([]User, 0)
+	err = getAuthKeys(strings.NewReader(`ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG8Obx1FsUu1jlYDtzfEDHYSDjG82xE7ysxZVzhgpGC5 alice@fedora`), &users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.addUsersToDB(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookups := []struct {
+		name string
+		fp   string
+		want string
+	}{
+		{name: "sha256 with prefix", fp: "SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8", want: "alice@fedora"},
+		{name: "sha256 without prefix", fp: "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8", want: "alice@fedora"},
+		{name: "md5 with prefix", fp: "MD5:79:ae:3c:8f:b4:57:4c:5a:47:64:3f:e3:d1:c9:bc:14", want: "alice@fedora"},
+		{name: "md5 without prefix", fp: "79:ae:3c:8f:b4:57:4c:5a:47:64:3f:e3:d1:c9:bc:14", want: "alice@fedora"},
+		{name: "unknown md5", fp: "00:ae:3c:8f:b4:57:4c:5a:47:64:3f:e3:d1:c9:bc:14", want: ""},
+	}
+	for _, tt := range lookups {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.GetUserByFingerprint(tt.fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("GetUserByFingerprint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	logs := []struct {
+		name string
+		line string
+	}{
+		{name: "legacy md5", line: "Apr 27 10:21:19 old-rh sshd[1250]: Accepted publickey for root from 192.168.1.24 port 49090 ssh2: RSA 79:ae:3c:8f:b4:57:4c:5a:47:64:3f:e3:d1:c9:bc:14"},
+		{name: "md5 with prefix", line: "Apr 27 10:21:19 old-rh sshd[1250]: Accepted publickey for root from 192.168.1.24 port 49090 ssh2: ED25519 MD5:79:ae:3c:8f:b4:57:4c:5a:47:64:3f:e3:d1:c9:bc:14"},
+		{name: "sha256", line: "Apr 27 10:21:19 deep-rh sshd[1337250]: Accepted publickey for root from 192.168.1.24 port 49090 ssh2: ED25519 SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8"},
+	}
+	for _, tt := range logs {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := m.LogToEvents(strings.NewReader(tt.line))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 1 {
+				t.Fatalf("LogToEvents() returned %d events, want 1", len(events))
+			}
+			if events[0].KeyUser != "alice@fedora" || events[0].Fingerprint != "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8" {
+				t.Errorf("LogToEvents() = %v, want alice@fedora with SHA256 fingerprint", events[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package sshloginmonitor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// GELF chunking limits: a chunk has a 12 bytes header, and a message has at
+// most 128 chunks.
+const (
+	gelfChunkHeader = 12
+	gelfMaxChunks   = 128
+)
+
+// GELFSink sends events to Graylog in the GELF 1.1 format, over UDP with
+// chunking of the messages larger than ChunkSize, or over TCP with null byte
+// delimited messages. The connection is re-established when it fails.
+//
+// The fields of the event are additional fields: _username, _key_user,
+// _source_ip, _port and so on, see eventFields; the level is the syslog
+// severity of the event, as in SyslogSink.
+type GELFSink struct {
+	Network   string // "udp" or "tcp"
+	Address   string // host:port
+	Hostname  string // os.Hostname() if empty
+	ChunkSize int    // maximum UDP datagram size, 1420 if zero
+	// Encoder encodes the full_message of the events, e.g. as CEF; none if
+	// nil
+	Encoder Encoder
+
+	conn *NetworkSink
+}
+
+// Consume implements Sink.
+func (s *GELFSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	if s.Hostname == "" {
+		s.Hostname, _ = os.Hostname()
+	}
+	s.conn = &NetworkSink{Network: s.Network, Address: s.Address}
+	defer func() {
+		if s.conn.conn != nil {
+			s.conn.conn.Close()
+		}
+	}()
+	return consume(ctx, events, func(event SessionEvent) error {
+		msg, err := s.message(event)
+		if err != nil {
+			return err
+		}
+		var packets [][]byte
+		if s.Network == "udp" {
+			packets, err = s.chunks(msg)
+			if err != nil {
+				log.Printf("gelf sink %s: event dropped: %s", s.Address, err)
+				return nil
+			}
+		} else {
+			packets = [][]byte{append(msg, 0)}
+		}
+		for _, packet := range packets {
+			// Try twice: the first write may fail on a connection the peer has closed
+			for attempt := 0; attempt < 2; attempt++ {
+				err = s.conn.write(ctx, packet)
+				if err == nil {
+					break
+				}
+			}
+			if err != nil {
+				log.Printf("gelf sink %s: event dropped: %s", s.Address, err)
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// message returns the GELF message of the event.
+func (s *GELFSink) message(event SessionEvent) ([]byte, error) {
+	msg := map[string]any{
+		"version":       "1.1",
+		"host":          s.Hostname,
+		"short_message": eventMessage(event),
+		"level":         syslogSeverity(event),
+	}
+	if !event.EventTime.IsZero() {
+		msg["timestamp"] = float64(event.EventTime.UnixMilli()) / 1000
+	}
+	if s.Encoder != nil {
+		full, err := s.Encoder.EncodeEvent(event)
+		if err != nil {
+			return nil, err
+		}
+		msg["full_message"] = string(full)
+	}
+	for _, field := range eventFields(event) {
+		if field[0] != "EVENT_TIME" {
+			msg["_"+strings.ToLower(field[0])] = field[1]
+		}
+	}
+	return json.Marshal(msg)
+}
+
+// chunks returns the UDP datagrams of a message: the message itself if it
+// fits in one, or GELF chunks.
+func (s *GELFSink) chunks(msg []byte) ([][]byte, error) {
+	size := s.ChunkSize
+	if size == 0 {
+		size = 1420
+	}
+	if len(msg) <= size {
+		return [][]byte{msg}, nil
+	}
+	payload := size - gelfChunkHeader
+	count := (len(msg) + payload - 1) / payload
+	if count > gelfMaxChunks {
+		return nil, fmt.Errorf("message of %d bytes needs %d chunks, more than %d", len(msg), count, gelfMaxChunks)
+	}
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * payload
+		if end > len(msg) {
+			end = len(msg)
+		}
+		chunk := append([]byte{0x1e, 0x0f}, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunks = append(chunks, append(chunk, msg[i*payload:end]...))
+	}
+	return chunks, nil
+}
@@ -0,0 +1,166 @@
+package sshloginmonitor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGELFMessage(t *testing.T) {
+	sink := &GELFSink{Hostname: "bastion", Encoder: &CEFEncoder{Host: "bastion"}}
+	at := time.Date(2023, 4, 27, 10, 21, 19, 500000000, time.UTC)
+	data, err := sink.message(SessionEvent{EventType: "login", EventTime: at, Username: "root", KeyUser: "alice@fedora",
+		SourceIP: "192.168.1.24", Port: "49090"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"version":       "1.1",
+		"host":          "bastion",
+		"short_message": "login of root by alice@fedora from 192.168.1.24 port 49090",
+		"level":         float64(syslogNotice),
+		"timestamp":     1682590879.5,
+		"_event_type":   "login",
+		"_username":     "root",
+		"_key_user":     "alice@fedora",
+		"_source_ip":    "192.168.1.24",
+		"_port":         "49090",
+	}
+	full, _ := got["full_message"].(string)
+	if !strings.HasPrefix(full, "CEF:0|") {
+		t.Errorf("full_message = %q, want CEF", full)
+	}
+	delete(got, "full_message")
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %v, want %v", name, got[name], value)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("message = %v, want %v", got, want)
+	}
+}
+
+func TestGELFSinkUDPChunks(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink := &GELFSink{Network: "udp", Address: conn.LocalAddr().String(), Hostname: "bastion", ChunkSize: 100}
+	long := strings.Repeat("x", 250)
+	events := make(chan SessionEvent, 2)
+	events <- SessionEvent{EventType: "alert", Alert: &Alert{Rule: "r", Severity: SeverityCritical, Message: long}}
+	close(events)
+	err = sink.Consume(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reassemble the chunks, which may arrive in any order
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var parts [][]byte
+	var id []byte
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk := append([]byte(nil), buf[:n]...)
+		if n > 100 || chunk[0] != 0x1e || chunk[1] != 0x0f {
+			t.Fatalf("datagram of %d bytes is not a chunk: %q", n, chunk)
+		}
+		if id == nil {
+			id = chunk[2:10]
+			parts = make([][]byte, chunk[11])
+		} else if !bytes.Equal(id, chunk[2:10]) {
+			t.Fatal("chunks with different message IDs")
+		}
+		parts[chunk[10]] = chunk[12:]
+		received := 0
+		for _, part := range parts {
+			if part != nil {
+				received++
+			}
+		}
+		if received == len(parts) {
+			break
+		}
+	}
+	var msg map[string]any
+	if err := json.Unmarshal(bytes.Join(parts, nil), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["_alert_message"] != long || msg["level"] != float64(syslogCrit) {
+		t.Errorf("message = %v", msg)
+	}
+}
+
+func TestGELFChunksTooMany(t *testing.T) {
+	sink := &GELFSink{ChunkSize: 20}
+	_, err := sink.chunks(make([]byte, 8*gelfMaxChunks+1))
+	if err == nil {
+		t.Error("chunks() succeeded with more than 128 chunks")
+	}
+}
+
+func TestGELFSinkTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var msgs []string
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := r.ReadString(0)
+			if err != nil {
+				break
+			}
+			msgs = append(msgs, strings.TrimSuffix(msg, "\x00"))
+		}
+		received <- msgs
+	}()
+
+	sink := &GELFSink{Network: "tcp", Address: listener.Addr().String(), Hostname: "bastion"}
+	events := make(chan SessionEvent, 2)
+	events <- SessionEvent{EventType: "login", Username: "alice"}
+	events <- SessionEvent{EventType: "logout", Username: "bob"}
+	close(events)
+	err = sink.Consume(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := <-received
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2: %q", len(msgs), msgs)
+	}
+	for i, user := range []string{"alice", "bob"} {
+		var msg map[string]any
+		if err := json.Unmarshal([]byte(msgs[i]), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg["_username"] != user || msg["version"] != "1.1" {
+			t.Errorf("message %d = %v, want _username %s", i, msg, user)
+		}
+	}
+}
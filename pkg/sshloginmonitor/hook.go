@@ -0,0 +1,196 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hook is a command run on events, from the hooks section of the
+// configuration, e.g.
+//
+//	hooks:
+//	  - command: /usr/local/bin/page-oncall
+//	    args: [--team, ops]
+//	    on: [alert]
+//	    when: 'severity == "critical"'
+//	    timeout: 30s
+//
+// The command gets the event as JSON on stdin and in SSHLM_* environment
+// variables, see eventFields.
+type Hook struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	// On lists the event types running the command: login, logout, failure
+	// or alert; all of them if empty
+	On []string `json:"on"`
+	// When further selects the events, see ParseExpr
+	When    string `json:"when"`
+	Timeout string `json:"timeout"` // 10s if empty
+	// MaxConcurrent is the number of commands of the hook running at the
+	// same time; further events wait. 4 if zero
+	MaxConcurrent int `json:"max_concurrent"`
+}
+
+// compiledHook is a Hook ready to run.
+type compiledHook struct {
+	Hook
+	on      map[string]bool
+	when    Expr
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+// HookSink runs commands on events.
+type HookSink struct {
+	hooks []*compiledHook
+}
+
+// NewHookSink returns a Sink running the hooks.
+//
+// Parameters:
+//   - hooks: the hooks, usually from the hooks section of the configuration
+//
+// Returns:
+//   - *HookSink: the sink
+//   - error: an error if a hook has no command or an invalid setting
+func NewHookSink(hooks []Hook) (*HookSink, error) {
+	s := &HookSink{}
+	for _, hook := range hooks {
+		if hook.Command == "" {
+			return nil, errors.New("hook: command is required")
+		}
+		c := &compiledHook{Hook: hook, on: make(map[string]bool), timeout: 10 * time.Second}
+		for _, eventType := range hook.On {
+			switch eventType {
+			case "login", "logout", "failure", "alert":
+				c.on[eventType] = true
+			default:
+				return nil, fmt.Errorf("hook %s: unknown event type %q", hook.Command, eventType)
+			}
+		}
+		var err error
+		c.when, err = ParseExpr(hook.When)
+		if err != nil {
+			return nil, fmt.Errorf("hook %s: when: %w", hook.Command, err)
+		}
+		if hook.Timeout != "" {
+			c.timeout, err = ParseAge(hook.Timeout)
+			if err != nil || c.timeout <= 0 {
+				return nil, fmt.Errorf("hook %s: invalid timeout %q", hook.Command, hook.Timeout)
+			}
+		}
+		n := hook.MaxConcurrent
+		if n <= 0 {
+			n = 4
+		}
+		c.slots = make(chan struct{}, n)
+		s.hooks = append(s.hooks, c)
+	}
+	return s, nil
+}
+
+// Consume implements Sink. It waits for the running commands before returning.
+func (s *HookSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	var running sync.WaitGroup
+	defer running.Wait()
+	return consume(ctx, events, func(event SessionEvent) error {
+		for _, hook := range s.hooks {
+			if len(hook.on) > 0 && !hook.on[event.EventType] || !hook.when.Eval(event) {
+				continue
+			}
+			select {
+			case hook.slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil
+			}
+			running.Add(1)
+			go func(hook *compiledHook) {
+				defer running.Done()
+				defer func() { <-hook.slots }()
+				hook.run(event)
+			}(hook)
+		}
+		return nil
+	})
+}
+
+// run runs the command for the event and logs how it ended. The command is
+// killed when the timeout expires, even if the monitor is stopping.
+func (h *compiledHook) run(event SessionEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("hook %s: %s", h.Command, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Command, h.Args...)
+	cmd.Stdin = bytes.NewReader(append(data, '\n'))
+	cmd.Env = os.Environ()
+	for _, field := range eventFields(event) {
+		cmd.Env = append(cmd.Env, "SSHLM_"+field[0]+"="+field[1])
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.WaitDelay = time.Second // don't wait for children keeping the output open
+
+	start := time.Now()
+	err = cmd.Run()
+	elapsed := time.Since(start).Round(time.Millisecond)
+	out := strings.TrimSpace(output.String())
+	if len(out) > 512 {
+		out = out[:512] + "..."
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		log.Printf("hook %s on %s: killed after %s timeout: %s", h.Command, event.EventType, h.timeout, out)
+	case errors.As(err, &exitErr):
+		log.Printf("hook %s on %s: exit code %d after %s: %s", h.Command, event.EventType, exitErr.ExitCode(), elapsed, out)
+	case err != nil:
+		log.Printf("hook %s on %s: %s", h.Command, event.EventType, err)
+	default:
+		log.Printf("hook %s on %s: exit code 0 after %s", h.Command, event.EventType, elapsed)
+	}
+}
+
+// eventFields returns the names and values describing the event outside
+// the program: hook environment variables and journal fields, both without
+// their SSHLM_ prefix. Empty fields are left out.
+func eventFields(event SessionEvent) [][2]string {
+	fields := [][2]string{
+		{"EVENT_TYPE", event.EventType},
+		{"EVENT_TIME", event.EventTime.Format(time.RFC3339)},
+		{"USERNAME", event.Username},
+		{"SOURCE_IP", event.SourceIP},
+		{"PORT", event.Port},
+		{"KEY_USER", event.KeyUser},
+		{"KEY_EMAIL", event.KeyEmail},
+		{"KEY_TEAM", event.KeyTeam},
+		{"FINGERPRINT", event.Fingerprint},
+		{"AUTH_METHOD", event.AuthMethod},
+	}
+	if event.Alert != nil {
+		fields = append(fields,
+			[2]string{"ALERT_RULE", event.Alert.Rule},
+			[2]string{"ALERT_SEVERITY", event.Alert.Severity},
+			[2]string{"ALERT_MESSAGE", event.Alert.Message})
+	}
+	kept := fields[:0]
+	for _, field := range fields {
+		if field[1] != "" {
+			kept = append(kept, field)
+		}
+	}
+	return kept
+}
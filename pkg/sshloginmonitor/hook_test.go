@@ -0,0 +1,148 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runHooks sends the events through a HookSink with the hooks and returns
+// what the sink logged.
+func runHooks(t *testing.T, hooks []Hook, events ...SessionEvent) string {
+	t.Helper()
+	sink, err := NewHookSink(hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	ch := make(chan SessionEvent, len(events))
+	for _, event := range events {
+		ch <- event
+	}
+	close(ch)
+	err = sink.Consume(context.Background(), ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logged.String()
+}
+
+func TestHookSink(t *testing.T) {
+	dir := t.TempDir()
+	script := `cat > "` + dir + `/$SSHLM_EVENT_TYPE.json"; env | grep ^SSHLM_ | sort > "` + dir + `/$SSHLM_EVENT_TYPE.env"`
+	at := time.Date(2023, 4, 27, 10, 21, 19, 0, time.UTC)
+	login := SessionEvent{EventType: "login", EventTime: at, Username: "root", SourceIP: "10.0.0.1", Port: "4000", KeyUser: "alice@fedora"}
+	alert := login
+	alert.EventType = "alert"
+	alert.Alert = &Alert{Rule: "root-login", Severity: SeverityCritical, Message: "root logged in"}
+	logout := login
+	logout.EventType = "logout"
+
+	logged := runHooks(t, []Hook{{Command: "sh", Args: []string{"-c", script}, On: []string{"login", "alert"}}}, login, logout, alert)
+	if strings.Count(logged, "exit code 0") != 2 {
+		t.Errorf("log = %s", logged)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "login.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got SessionEvent
+	err = json.Unmarshal(data, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != login {
+		t.Errorf("stdin event = %+v, want %+v", got, login)
+	}
+	env, err := os.ReadFile(filepath.Join(dir, "alert.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `SSHLM_ALERT_MESSAGE=root logged in
+SSHLM_ALERT_RULE=root-login
+SSHLM_ALERT_SEVERITY=critical
+SSHLM_EVENT_TIME=2023-04-27T10:21:19Z
+SSHLM_EVENT_TYPE=alert
+SSHLM_KEY_USER=alice@fedora
+SSHLM_PORT=4000
+SSHLM_SOURCE_IP=10.0.0.1
+SSHLM_USERNAME=root
+`
+	if string(env) != want {
+		t.Errorf("environment =\n%s\nwant\n%s", env, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "logout.json")); err == nil {
+		t.Error("hook ran on a logout")
+	}
+}
+
+func TestHookExit(t *testing.T) {
+	event := SessionEvent{EventType: "failure", Username: "admin"}
+	tests := []struct {
+		name string
+		hook Hook
+		want string
+	}{
+		{name: "exit code", hook: Hook{Command: "sh", Args: []string{"-c", "echo oops >&2; exit 3"}}, want: "exit code 3 after"},
+		{name: "timeout", hook: Hook{Command: "sleep", Args: []string{"10"}, Timeout: "100ms"}, want: "killed after 100ms timeout"},
+		{name: "not found", hook: Hook{Command: "/nonexistent/hook"}, want: "no such file"},
+		{name: "condition", hook: Hook{Command: "true", When: `username == "root"`}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			logged := runHooks(t, []Hook{tt.hook}, event)
+			if tt.want == "" && logged != "" || !strings.Contains(logged, tt.want) {
+				t.Errorf("log = %q, want %q", logged, tt.want)
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("hook took %s", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestHookConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	// mkdir fails if another run of the hook holds the lock
+	script := `mkdir "` + dir + `/lock" || touch "` + dir + `/overlap"; sleep 0.05; rmdir "` + dir + `/lock"`
+	events := make([]SessionEvent, 5)
+	for i := range events {
+		events[i] = SessionEvent{EventType: "login"}
+	}
+	runHooks(t, []Hook{{Command: "sh", Args: []string{"-c", script}, MaxConcurrent: 1}}, events...)
+	if _, err := os.Stat(filepath.Join(dir, "overlap")); err == nil {
+		t.Error("hook commands ran concurrently")
+	}
+}
+
+func TestNewHookSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		hook    Hook
+		wantErr bool
+	}{
+		{name: "valid", hook: Hook{Command: "true", On: []string{"alert"}, Timeout: "1m"}},
+		{name: "no command", hook: Hook{On: []string{"alert"}}, wantErr: true},
+		{name: "bad event type", hook: Hook{Command: "true", On: []string{"session"}}, wantErr: true},
+		{name: "bad timeout", hook: Hook{Command: "true", Timeout: "soon"}, wantErr: true},
+		{name: "bad condition", hook: Hook{Command: "true", When: "type"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHookSink([]Hook{tt.hook})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewHookSink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
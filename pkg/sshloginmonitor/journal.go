@@ -0,0 +1,115 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// JournalSocket is the socket of the native journal protocol.
+const JournalSocket = "/run/systemd/journal/socket"
+
+// journalMessageIDs are the MESSAGE_ID fields of the event types, for
+// journalctl MESSAGE_ID=... and message catalogs.
+var journalMessageIDs = map[string]string{
+	"login":   "8cbdc25db5c143c79269d449e638895c",
+	"logout":  "1158b225b5f547f5beb61ba0f4c4812f",
+	"failure": "44c2b3f61512491582b3df5919181b5b",
+	"alert":   "9203f75d0d1045f2943a5ae42f3759d8",
+}
+
+// JournalSink writes events to the systemd journal with the native
+// protocol, so they can be selected by field:
+//
+//	journalctl SSHLM_KEY_USER=alice@fedora
+//
+// Each entry has MESSAGE, the description of the event, MESSAGE_ID, which
+// identifies the event type, PRIORITY, the syslog severity of the event as
+// in SyslogSink, SYSLOG_IDENTIFIER=sshlm, and the fields of the event with
+// the SSHLM_ prefix: SSHLM_USERNAME, SSHLM_KEY_USER, SSHLM_SOURCE_IP... see
+// eventFields.
+type JournalSink struct {
+	Socket     string // JournalSocket if empty
+	Identifier string // SYSLOG_IDENTIFIER, "sshlm" if empty
+
+	conn net.Conn
+}
+
+// Consume implements Sink.
+func (s *JournalSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+	return consume(ctx, events, func(event SessionEvent) error {
+		entry := s.entry(event)
+		var err error
+		// Try twice: journald may have restarted since the last write
+		for attempt := 0; attempt < 2; attempt++ {
+			err = s.write(entry)
+			if err == nil {
+				return nil
+			}
+		}
+		log.Printf("journal sink: event dropped: %s", err)
+		return nil
+	})
+}
+
+// write sends an entry, connecting to the socket if needed.
+func (s *JournalSink) write(entry []byte) error {
+	if s.conn == nil {
+		socket := s.Socket
+		if socket == "" {
+			socket = JournalSocket
+		}
+		conn, err := net.Dial("unixgram", socket)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	_, err := s.conn.Write(entry)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// entry returns the journal entry of the event in the native protocol.
+func (s *JournalSink) entry(event SessionEvent) []byte {
+	identifier := s.Identifier
+	if identifier == "" {
+		identifier = "sshlm"
+	}
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", eventMessage(event))
+	if id, ok := journalMessageIDs[event.EventType]; ok {
+		journalField(&b, "MESSAGE_ID", id)
+	}
+	journalField(&b, "PRIORITY", strconv.Itoa(syslogSeverity(event)))
+	journalField(&b, "SYSLOG_FACILITY", strconv.Itoa(syslogAuthPriv))
+	journalField(&b, "SYSLOG_IDENTIFIER", identifier)
+	for _, field := range eventFields(event) {
+		journalField(&b, "SSHLM_"+field[0], field[1])
+	}
+	return b.Bytes()
+}
+
+// journalField writes a field in the native protocol: NAME=value, or the
+// name, the length and the value for values with newlines.
+func journalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	b.WriteString(name + "\n")
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
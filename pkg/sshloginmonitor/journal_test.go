@@ -0,0 +1,144 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// parseJournalEntry decodes an entry of the native journal protocol.
+func parseJournalEntry(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	fields := make(map[string]string)
+	for len(data) > 0 {
+		line := bytes.IndexByte(data, '\n')
+		if line < 0 {
+			t.Fatalf("unterminated field %q", data)
+		}
+		if eq := bytes.IndexByte(data[:line], '='); eq >= 0 {
+			fields[string(data[:eq])] = string(data[eq+1 : line])
+			data = data[line+1:]
+			continue
+		}
+		name := string(data[:line])
+		data = data[line+1:]
+		n := int(binary.LittleEndian.Uint64(data))
+		fields[name] = string(data[8 : 8+n])
+		if data[8+n] != '\n' {
+			t.Fatalf("field %s not terminated", name)
+		}
+		data = data[8+n+1:]
+	}
+	return fields
+}
+
+func TestJournalEntry(t *testing.T) {
+	at := time.Date(2023, 4, 27, 10, 21, 19, 0, time.UTC)
+	tests := []struct {
+		name  string
+		event SessionEvent
+		want  map[string]string
+	}{
+		{
+			name: "login",
+			event: SessionEvent{EventType: "login", EventTime: at, Username: "root", KeyUser: "alice@fedora",
+				SourceIP: "192.168.1.24", Port: "49090"},
+			want: map[string]string{
+				"MESSAGE":           "login of root by alice@fedora from 192.168.1.24 port 49090",
+				"MESSAGE_ID":        journalMessageIDs["login"],
+				"PRIORITY":          "5",
+				"SYSLOG_FACILITY":   "10",
+				"SYSLOG_IDENTIFIER": "sshlm",
+				"SSHLM_EVENT_TYPE":  "login",
+				"SSHLM_EVENT_TIME":  "2023-04-27T10:21:19Z",
+				"SSHLM_USERNAME":    "root",
+				"SSHLM_KEY_USER":    "alice@fedora",
+				"SSHLM_SOURCE_IP":   "192.168.1.24",
+				"SSHLM_PORT":        "49090",
+			},
+		},
+		{
+			name: "alert with newline",
+			event: SessionEvent{EventType: "alert", Username: "root",
+				Alert: &Alert{Rule: "root-login", Severity: SeverityCritical, Message: "login of root\nfrom nowhere"}},
+			want: map[string]string{
+				"MESSAGE":              "[critical] root-login: login of root\nfrom nowhere",
+				"MESSAGE_ID":           journalMessageIDs["alert"],
+				"PRIORITY":             "2",
+				"SYSLOG_FACILITY":      "10",
+				"SYSLOG_IDENTIFIER":    "sshlm",
+				"SSHLM_EVENT_TYPE":     "alert",
+				"SSHLM_EVENT_TIME":     "0001-01-01T00:00:00Z",
+				"SSHLM_USERNAME":       "root",
+				"SSHLM_ALERT_RULE":     "root-login",
+				"SSHLM_ALERT_SEVERITY": "critical",
+				"SSHLM_ALERT_MESSAGE":  "login of root\nfrom nowhere",
+			},
+		},
+	}
+	sink := &JournalSink{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseJournalEntry(t, sink.entry(tt.event))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entry = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJournalSink(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink := &JournalSink{Socket: socket, Identifier: "sshlm-test"}
+	events := make(chan SessionEvent, 2)
+	events <- SessionEvent{EventType: "login", Username: "root", KeyUser: "alice@fedora"}
+	events <- SessionEvent{EventType: "failure", Username: "bob", SourceIP: "10.0.0.9"}
+	close(events)
+	err = sink.Consume(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	for _, want := range []map[string]string{
+		{"SSHLM_USERNAME": "root", "SSHLM_KEY_USER": "alice@fedora", "PRIORITY": "5"},
+		{"SSHLM_USERNAME": "bob", "SSHLM_SOURCE_IP": "10.0.0.9", "PRIORITY": "4"},
+	} {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := parseJournalEntry(t, buf[:n])
+		if fields["SYSLOG_IDENTIFIER"] != "sshlm-test" {
+			t.Errorf("SYSLOG_IDENTIFIER = %q, want sshlm-test", fields["SYSLOG_IDENTIFIER"])
+		}
+		for name, value := range want {
+			if fields[name] != value {
+				t.Errorf("%s = %q, want %q", name, fields[name], value)
+			}
+		}
+	}
+}
+
+func TestJournalSinkNoSocket(t *testing.T) {
+	sink := &JournalSink{Socket: filepath.Join(t.TempDir(), "missing.sock")}
+	events := make(chan SessionEvent, 1)
+	events <- SessionEvent{EventType: "login"}
+	close(events)
+	// Events are dropped, the sink keeps running
+	if err := sink.Consume(context.Background(), events); err != nil {
+		t.Errorf("Consume() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,349 @@
+package sshloginmonitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/ssh"
+)
+
+// OfferedKey records a key that sshd asked about via AuthorizedKeysCommand.
+type OfferedKey struct {
+	Time        time.Time `json:"time"`
+	Account     string    `json:"account"`
+	Fingerprint string    `json:"fingerprint"`
+	KeyUser     string    `json:"key_user"`
+}
+
+// keysBucket returns the name of the bucket holding one nested bucket per
+// account, which maps fingerprints to authorized_keys lines.
+func keysBucket(bucket string) []byte {
+	return []byte(bucket + "/keys")
+}
+
+// offeredBucket returns the name of the bucket holding OfferedKey records.
+func offeredBucket(bucket string) []byte {
+	return []byte(bucket + "/offered")
+}
+
+// fileAccount returns the name of the account owning the file,
+// or an empty string if it can't be determined.
+func fileAccount(f *os.File) string {
+	fi, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(st.Uid), 10))
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+// setAccount sets the account for every user in the slice.
+func setAccount(users []User, account string) {
+	for i := range users {
+		users[i].Account = account
+	}
+}
+
+// putAccountKey stores the user's authorized_keys line under its account.
+// It must be called inside a read-write transaction.
+func putAccountKey(tx *bolt.Tx, bucket string, user User) error {
+	keys, err := tx.CreateBucketIfNotExists(keysBucket(bucket))
+	if err != nil {
+		return err
+	}
+	account, err := keys.CreateBucketIfNotExists([]byte(user.Account))
+	if err != nil {
+		return err
+	}
+	return account.Put([]byte(user.Fingerprint), []byte(user.Key))
+}
+
+// GetAccountKeys returns the authorized_keys lines stored for the account.
+//
+// Parameters:
+//   - account: the local account name, as passed by sshd in %u
+//
+// Returns:
+//   - []string: the authorized_keys lines, ordered by fingerprint
+//   - error: an error if the database can't be read
+func (m *Monitor) GetAccountKeys(account string) ([]string, error) {
+	keys := make([]string, 0)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket(m.opts.Bucket))
+		if b == nil {
+			return nil
+		}
+		a := b.Bucket([]byte(account))
+		if a == nil {
+			return nil
+		}
+		return a.ForEach(func(_, v []byte) error {
+			keys = append(keys, string(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// GetAllKeys returns every key in the key store, one User per account and key,
+// with the comment from the authorized_keys line as Username.
+func (m *Monitor) GetAllKeys() ([]User, error) {
+	users := make([]User, 0)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket(m.opts.Bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(account, _ []byte) error {
+			a := b.Bucket(account)
+			if a == nil {
+				return nil
+			}
+			return a.ForEach(func(fp, line []byte) error {
+				_, comment, _, _, err := ssh.ParseAuthorizedKey(line)
+				if err != nil {
+					return fmt.Errorf("account %s, fingerprint %s: %w", account, fp, err)
+				}
+				users = append(users, User{
+					Username:    comment,
+					Fingerprint: string(fp),
+					Key:         string(line),
+					Account:     string(account),
+				})
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// RecordOfferedKey saves the fingerprint sshd reported as offered for the account
+// at time t. Recording the same offer twice keeps one record.
+// The fingerprint may be in SHA256 (with or without the "SHA256:" prefix) or MD5 format.
+func (m *Monitor) RecordOfferedKey(t time.Time, account string, fingerprint string) error {
+	owner, err := m.GetOwnerByFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+	offered := OfferedKey{
+		Time:        t,
+		Account:     account,
+		Fingerprint: owner.Fingerprint,
+		KeyUser:     owner.Name,
+	}
+	data, err := json.Marshal(offered)
+	if err != nil {
+		return err
+	}
+	// Keys sort by time and identify the offer, so a replayed log line overwrites its record
+	key := []byte(t.UTC().Format(time.RFC3339) + " " + account + " " + owner.Fingerprint)
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(offeredBucket(m.opts.Bucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return b.Put(key, data)
+	})
+}
+
+// ExportKeys writes the keys of every account to the keys file as a JSON
+// object mapping accounts to authorized_keys lines, so authorized-keys-command
+// can serve them without opening the database, which the monitor keeps locked.
+// It does nothing if the KeysFile option is empty.
+func (m *Monitor) ExportKeys() error {
+	if m.opts.KeysFile == "" {
+		return nil
+	}
+	accounts := make(map[string][]string)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket(m.opts.Bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(account, _ []byte) error {
+			a := b.Bucket(account)
+			if a == nil {
+				return nil
+			}
+			keys := make([]string, 0)
+			err := a.ForEach(func(_, line []byte) error {
+				keys = append(keys, string(line))
+				return nil
+			})
+			accounts[string(account)] = keys
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Replace the file atomically: sshd may read it at any time
+	tmp, err := os.CreateTemp(filepath.Dir(m.opts.KeysFile), filepath.Base(m.opts.KeysFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644) // public keys only; sshd may run the command as another user
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.opts.KeysFile)
+}
+
+// offeredKeyMessage is the message AuthorizedKeysCommand logs for an offered
+// key and the monitor parses back from the log.
+const offeredKeyMessage = "offered key %s for %s"
+
+// OfferedKeyIdentifier is the syslog identifier of the offered keys logged
+// for AuthorizedKeysCommand. It differs from the one of the monitor's own
+// messages, so the monitor never reads back its own output.
+const OfferedKeyIdentifier = "sshlm-akc"
+
+// AuthorizedKeysCommand writes the keys exported for the account to w in
+// authorized_keys format, so sshd can use it as AuthorizedKeysCommand.
+// It reads the keys file written by ExportKeys instead of the database,
+// which a running monitor keeps locked.
+//
+// Parameters:
+//   - w: where the keys are written, usually os.Stdout
+//   - logger: if not nil, the offered fingerprint is logged there for the monitor to record
+//   - keysFile: the file written by ExportKeys
+//   - account: the local account name, as passed by sshd in %u
+//   - fingerprint: the offered key fingerprint, as passed by sshd in %f, or ""
+//
+// Returns:
+//   - error: an error if the keys file can't be read or the keys can't be written
+func AuthorizedKeysCommand(w io.Writer, logger *log.Logger, keysFile string, account string, fingerprint string) error {
+	if fingerprint != "" && logger != nil {
+		logger.Printf(offeredKeyMessage, fingerprint, account)
+	}
+	data, err := os.ReadFile(keysFile)
+	if err != nil {
+		return err
+	}
+	accounts := make(map[string][]string)
+	err = json.Unmarshal(data, &accounts)
+	if err != nil {
+		return fmt.Errorf("%s: %w", keysFile, err)
+	}
+	for _, key := range accounts[account] {
+		_, err = fmt.Fprintln(w, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddKey parses an authorized_keys line and stores it for the account.
+//
+// Parameters:
+//   - account: the local account the key grants access to
+//   - line: the authorized_keys line, including options
+//
+// Returns:
+//   - User: the stored key
+//   - error: an error if the line isn't a single valid key or the database can't be updated
+func (m *Monitor) AddKey(account string, line string) (User, error) {
+	if account == "" {
+		return User{}, errors.New("account is required")
+	}
+	users := make([]User, 0)
+	err := getAuthKeys(strings.NewReader(line), &users)
+	if err != nil {
+		return User{}, err
+	}
+	if len(users) != 1 {
+		return User{}, fmt.Errorf("expected one key, got %d", len(users))
+	}
+	user := users[0]
+	user.Account = account
+	err = m.addOneUserToDB(user, true)
+	if err != nil {
+		return User{}, err
+	}
+	return user, m.ExportKeys()
+}
+
+// DeleteKey removes the key from the account, or from every account if
+// account is empty. The key stays known, so past logins keep their key user.
+//
+// Parameters:
+//   - account: the local account, or "" for all accounts
+//   - fingerprint: the key fingerprint in SHA256 or MD5 format
+//
+// Returns:
+//   - int: the number of accounts the key was removed from
+//   - error: an error if the database can't be updated
+func (m *Monitor) DeleteKey(account string, fingerprint string) (int, error) {
+	deleted := 0
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket(m.opts.Bucket))
+		if b == nil {
+			return nil
+		}
+		fp := []byte(canonicalFingerprint(tx, m.opts.Bucket, fingerprint))
+		accounts := make([][]byte, 0)
+		if account != "" {
+			accounts = append(accounts, []byte(account))
+		} else {
+			err := b.ForEach(func(name, _ []byte) error {
+				accounts = append(accounts, append([]byte(nil), name...))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, name := range accounts {
+			a := b.Bucket(name)
+			if a == nil || a.Get(fp) == nil {
+				continue
+			}
+			err := a.Delete(fp)
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil || deleted == 0 {
+		return deleted, err
+	}
+	return deleted, m.ExportKeys()
+}
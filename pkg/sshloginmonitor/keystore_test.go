@@ -0,0 +1,104 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestAuthorizedKeysCommand(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	keysFile := filepath.Join(t.TempDir(), "test.db.keys")
+	m, err := NewMonitor(db, Options{Bucket: "LoginMonitor", UpdateKeys: true, Follow: true, KeysFile: keysFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG8Obx1FsUu1jlYDtzfEDHYSDjG82xE7ysxZVzhgpGC5 alice@fedora"
+	bob := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJgclT4eQ5RlYabZfkdjFV5wGrroXxmd5n2X7okmiaN8 bob@fedora"
+	users := []User{
+		{Username: "alice@fedora", Fingerprint: "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8", Key: alice, Account: "root"},
+		{Username: "bob@fedora", Fingerprint: "is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY", Key: bob, Account: "bob"},
+	}
+	err = m.addUsersToDB(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.ExportKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		account     string
+		fingerprint string
+		want        string
+		wantLog     string
+	}{
+		{
+			name:        "account with a key",
+			account:     "root",
+			fingerprint: "SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8",
+			want:        alice + "\n",
+			wantLog:     "offered key SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8 for root\n",
+		},
+		{
+			name:    "account without keys",
+			account: "nobody",
+			want:    "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out, logged bytes.Buffer
+			err := AuthorizedKeysCommand(&out, log.New(&logged, "", 0), keysFile, tt.account, tt.fingerprint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("AuthorizedKeysCommand() = %q, want %q", out.String(), tt.want)
+			}
+			if logged.String() != tt.wantLog {
+				t.Errorf("AuthorizedKeysCommand() logged %q, want %q", logged.String(), tt.wantLog)
+			}
+		})
+	}
+
+	// The monitor records the offer when it reads the logged line, once per line
+	// The same message from the monitor itself isn't an offer
+	line := "Apr 27 10:21:19 deep-rh sshlm-akc[1337251]: offered key SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8 for root\n" +
+		"Apr 27 10:21:20 deep-rh sshlm[1337000]: offered key SHA256:is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY for root\n"
+	for i := 0; i < 2; i++ {
+		_, err = m.scanEvents(context.Background(), strings.NewReader(line), make(chan SessionEvent))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var offered []OfferedKey
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(offeredBucket(m.opts.Bucket)).ForEach(func(_, v []byte) error {
+			var o OfferedKey
+			err := json.Unmarshal(v, &o)
+			offered = append(offered, o)
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offered) != 1 || offered[0].Account != "root" || offered[0].KeyUser != "alice@fedora" {
+		t.Errorf("offered keys = %v, want one record for root by alice@fedora", offered)
+	}
+}
@@ -0,0 +1,285 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lokiMaxPending is the maximum number of events waiting to be pushed to
+// Loki; the oldest ones are dropped beyond it.
+const lokiMaxPending = 10000
+
+// Loki configures the Grafana Loki sink, from the loki section of the
+// configuration, e.g.
+//
+//	loki:
+//	  url: http://loki:3100
+//	  labels: {env: prod}
+//	  tenant_id: ops
+//	  batch_size: 100
+//	  batch_wait: 1s
+type Loki struct {
+	// URL is the push API endpoint; /loki/api/v1/push is added to a URL
+	// without a path
+	URL string `json:"url"`
+	// Labels are added to the labels of every stream: job="sshlm", host,
+	// event_type, account and key_user
+	Labels   map[string]string `json:"labels"`
+	TenantID string            `json:"tenant_id"` // sent in X-Scope-OrgID
+	Username string            `json:"username"`  // basic authentication
+	Password string            `json:"password"`
+	// Format is the format of the log lines, see NewEncoder; json if empty
+	Format      string `json:"format"`
+	BatchSize   int    `json:"batch_size"`   // events per push, 100 if zero
+	BatchWait   string `json:"batch_wait"`   // maximum delay of a push, 1s if empty
+	MaxAttempts int    `json:"max_attempts"` // attempts to push a batch, 10 if zero
+}
+
+// LokiSink pushes events to Grafana Loki in batches. A batch that can't be
+// pushed is retried with exponential backoff until MaxAttempts is reached,
+// or Loki rejects it with a client error.
+type LokiSink struct {
+	Client     *http.Client
+	Backoff    time.Duration // delay before the first retry, doubled on each attempt; 1s by default
+	MaxBackoff time.Duration // 1m by default
+
+	cfg       Loki
+	url       string
+	host      string
+	enc       Encoder
+	batchSize int
+	batchWait time.Duration
+
+	pending  []SessionEvent
+	attempts int       // failed attempts to push the first batch of pending
+	retryAt  time.Time // time of the next attempt after a failure
+}
+
+// NewLokiSink returns a Sink pushing events to Loki.
+//
+// Parameters:
+//   - cfg: the Loki settings, usually from the loki section of the configuration
+//
+// Returns:
+//   - *LokiSink: the sink
+//   - error: an error if the URL, format or batch settings are invalid
+func NewLokiSink(cfg Loki) (*LokiSink, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("loki: invalid URL %q", cfg.URL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/loki/api/v1/push"
+	}
+	s := &LokiSink{
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+		cfg:        cfg,
+		url:        u.String(),
+		batchSize:  cfg.BatchSize,
+		batchWait:  time.Second,
+	}
+	s.host, _ = os.Hostname()
+	if cfg.Format != "" {
+		s.enc, err = NewEncoder(cfg.Format)
+		if err != nil {
+			return nil, fmt.Errorf("loki: %w", err)
+		}
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = 100
+	}
+	if cfg.BatchWait != "" {
+		s.batchWait, err = ParseAge(cfg.BatchWait)
+		if err != nil || s.batchWait <= 0 {
+			return nil, fmt.Errorf("loki: invalid batch_wait %q", cfg.BatchWait)
+		}
+	}
+	if s.cfg.MaxAttempts <= 0 {
+		s.cfg.MaxAttempts = 10
+	}
+	return s, nil
+}
+
+// Consume implements Sink. The pending events are pushed one last time
+// before it returns.
+func (s *LokiSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	ticker := time.NewTicker(s.batchWait)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.flush(time.Now(), true)
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				s.flush(time.Now(), true)
+				return nil
+			}
+			s.pending = append(s.pending, event)
+			if len(s.pending) > lokiMaxPending {
+				log.Printf("loki: too many unsent events, dropping the oldest")
+				s.pending = s.pending[len(s.pending)-lokiMaxPending:]
+			}
+			if len(s.pending) >= s.batchSize {
+				s.flush(time.Now(), false)
+			}
+		case now := <-ticker.C:
+			s.flush(now, false)
+		}
+	}
+}
+
+// flush pushes the pending events in batches, unless a failed push is
+// waiting for its retry; final ignores the wait.
+func (s *LokiSink) flush(now time.Time, final bool) {
+	if !final && now.Before(s.retryAt) {
+		return
+	}
+	for len(s.pending) > 0 {
+		n := s.batchSize
+		if n > len(s.pending) {
+			n = len(s.pending)
+		}
+		err := s.push(s.pending[:n])
+		if err == nil {
+			s.pending = s.pending[n:]
+			s.attempts = 0
+			s.retryAt = time.Time{}
+			continue
+		}
+		s.attempts++
+		var status *httpStatusError
+		switch {
+		case errors.As(err, &status) && status.permanent():
+			log.Printf("loki: %d events dropped: %s", n, err)
+		case s.attempts >= s.cfg.MaxAttempts:
+			log.Printf("loki: %d events dropped after %d attempts: %s", n, s.attempts, err)
+		default:
+			log.Printf("loki: attempt %d to push %d events failed, retrying: %s", s.attempts, n, err)
+			s.retryAt = now.Add(retryBackoff(s.attempts, s.Backoff, s.MaxBackoff))
+			return
+		}
+		s.pending = s.pending[n:]
+		s.attempts = 0
+		s.retryAt = time.Time{}
+	}
+	s.pending = nil
+}
+
+// lokiStream is a stream of the push API.
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// push sends one batch of events.
+func (s *LokiSink) push(events []SessionEvent) error {
+	body, err := s.body(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sshlm")
+	if s.cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.cfg.TenantID)
+	}
+	if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &httpStatusError{status: resp.StatusCode, body: string(bytes.TrimSpace(text))}
+}
+
+// body returns the push request of the events, grouped in streams by
+// labels.
+func (s *LokiSink) body(events []SessionEvent) ([]byte, error) {
+	streams := make(map[string]*lokiStream)
+	var order []string
+	for _, event := range events {
+		labels := s.labels(event)
+		key := lokiStreamKey(labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: labels}
+			streams[key] = stream
+			order = append(order, key)
+		}
+		line, err := encodeEvent(s.enc, event)
+		if err != nil {
+			return nil, err
+		}
+		t := time.Now()
+		if !event.EventTime.IsZero() {
+			t = event.EventTime
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(t.UnixNano(), 10), string(line)})
+	}
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, key := range order {
+		push.Streams = append(push.Streams, streams[key])
+	}
+	return json.Marshal(push)
+}
+
+// labels returns the stream labels of the event; empty ones are left out.
+func (s *LokiSink) labels(event SessionEvent) map[string]string {
+	labels := make(map[string]string)
+	for name, value := range s.cfg.Labels {
+		labels[name] = value
+	}
+	for name, value := range map[string]string{
+		"job":        "sshlm",
+		"host":       s.host,
+		"event_type": event.EventType,
+		"account":    event.Username,
+		"key_user":   event.KeyUser,
+	} {
+		if value != "" {
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// lokiStreamKey returns a string identifying a label set.
+func lokiStreamKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(strconv.Quote(name) + "=" + strconv.Quote(labels[name]) + ",")
+	}
+	return b.String()
+}
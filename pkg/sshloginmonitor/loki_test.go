@@ -0,0 +1,171 @@
+package sshloginmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLoki is a stand-in for the Loki push API.
+type fakeLoki struct {
+	mu       sync.Mutex
+	pushes   [][]lokiStream
+	requests []*http.Request
+	statuses []int // statuses of the next responses, then 204
+}
+
+func (f *fakeLoki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+	if len(f.statuses) > 0 {
+		status := f.statuses[0]
+		f.statuses = f.statuses[1:]
+		http.Error(w, "failed", status)
+		return
+	}
+	var push struct {
+		Streams []lokiStream `json:"streams"`
+	}
+	body, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &push); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.pushes = append(f.pushes, push.Streams)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeLoki) received() [][]lokiStream {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]lokiStream(nil), f.pushes...)
+}
+
+func TestLokiSink(t *testing.T) {
+	loki := &fakeLoki{}
+	server := httptest.NewServer(loki)
+	defer server.Close()
+
+	sink, err := NewLokiSink(Loki{URL: server.URL, Labels: map[string]string{"env": "prod"}, TenantID: "ops",
+		Username: "sshlm", Password: "s3cr3t", BatchSize: 2, BatchWait: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.host = "bastion"
+
+	at := time.Date(2023, 4, 27, 10, 21, 19, 0, time.UTC)
+	events := make(chan SessionEvent, 3)
+	events <- SessionEvent{EventType: "login", EventTime: at, Username: "root", KeyUser: "alice@fedora"}
+	events <- SessionEvent{EventType: "login", EventTime: at.Add(time.Second), Username: "root", KeyUser: "bob@fedora"}
+	events <- SessionEvent{EventType: "logout", EventTime: at.Add(time.Minute), Username: "root", KeyUser: "alice@fedora"}
+	close(events)
+	err = sink.Consume(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushes := loki.received()
+	if len(pushes) != 2 {
+		t.Fatalf("got %d pushes, want 2 batches", len(pushes))
+	}
+	if len(pushes[0]) != 2 || len(pushes[1]) != 1 {
+		t.Fatalf("pushes = %v, want 2 streams then 1", pushes)
+	}
+	wantLabels := map[string]string{"job": "sshlm", "env": "prod", "host": "bastion", "event_type": "login",
+		"account": "root", "key_user": "alice@fedora"}
+	if !reflect.DeepEqual(pushes[0][0].Stream, wantLabels) {
+		t.Errorf("labels = %v, want %v", pushes[0][0].Stream, wantLabels)
+	}
+	value := pushes[0][0].Values
+	if len(value) != 1 || value[0][0] != "1682590879000000000" {
+		t.Errorf("values = %v, want the login at 1682590879000000000", value)
+	}
+	var event SessionEvent
+	if err := json.Unmarshal([]byte(value[0][1]), &event); err != nil || event.KeyUser != "alice@fedora" {
+		t.Errorf("line = %s, want the JSON event", value[0][1])
+	}
+	if pushes[1][0].Stream["event_type"] != "logout" {
+		t.Errorf("second push = %v, want the logout", pushes[1])
+	}
+
+	req := loki.requests[0]
+	user, password, _ := req.BasicAuth()
+	if req.URL.Path != "/loki/api/v1/push" || req.Header.Get("X-Scope-OrgID") != "ops" || user != "sshlm" || password != "s3cr3t" {
+		t.Errorf("request = %s %v", req.URL.Path, req.Header)
+	}
+}
+
+func TestLokiRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		wantPushes int
+	}{
+		{"server errors", []int{http.StatusInternalServerError, http.StatusTooManyRequests}, 1},
+		{"too many failures", []int{500, 500, 500}, 0},
+		{"client error", []int{http.StatusBadRequest}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loki := &fakeLoki{statuses: tt.statuses}
+			server := httptest.NewServer(loki)
+			defer server.Close()
+			sink, err := NewLokiSink(Loki{URL: server.URL, MaxAttempts: 3, Format: "cef"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.Backoff = time.Minute
+
+			now := time.Now()
+			sink.pending = []SessionEvent{{EventType: "failure", Username: "root"}}
+			for i := 0; i < 3; i++ {
+				sink.flush(now, false)
+				// A retry waits for the backoff
+				sink.flush(now.Add(time.Second), false)
+				now = now.Add(time.Hour)
+			}
+			if got := len(loki.received()); got != tt.wantPushes {
+				t.Errorf("got %d pushes, want %d", got, tt.wantPushes)
+			}
+			if len(sink.pending) != 0 {
+				t.Errorf("%d events still pending", len(sink.pending))
+			}
+			if len(loki.requests) != len(tt.statuses)+tt.wantPushes {
+				t.Errorf("got %d requests, want %d", len(loki.requests), len(tt.statuses)+tt.wantPushes)
+			}
+		})
+	}
+}
+
+func TestNewLokiSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Loki
+		wantURL string
+		wantErr bool
+	}{
+		{"host only", Loki{URL: "http://loki:3100"}, "http://loki:3100/loki/api/v1/push", false},
+		{"full URL", Loki{URL: "https://logs.example.com/api/prom/push"}, "https://logs.example.com/api/prom/push", false},
+		{"invalid URL", Loki{URL: "loki:3100"}, "", true},
+		{"invalid format", Loki{URL: "http://loki:3100", Format: "xml"}, "", true},
+		{"invalid batch wait", Loki{URL: "http://loki:3100", BatchWait: "soon"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := NewLokiSink(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewLokiSink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && sink.url != tt.wantURL {
+				t.Errorf("url = %s, want %s", sink.url, tt.wantURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package sshloginmonitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds of the session duration histogram, in seconds.
+var durationBuckets = []float64{10, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600}
+
+// openSession is a login waiting for its logout.
+type openSession struct {
+	start   time.Time
+	account string
+	keyUser string
+}
+
+// MetricsSink counts events and serves them on /metrics in the Prometheus
+// text exposition format, with the parse errors of the monitor's sources.
+// It is safe for concurrent use.
+type MetricsSink struct {
+	m           *Monitor
+	mu          sync.Mutex
+	logins      map[[3]string]uint64 // account, key user, auth method
+	logouts     map[[2]string]uint64 // account, key user
+	failures    map[[2]string]uint64 // account, auth method
+	alerts      map[[2]string]uint64 // rule, severity
+	open        map[string]openSession
+	buckets     []uint64
+	durationSum float64
+	durations   uint64
+	events      uint64
+	lastEvent   time.Time
+	lag         time.Duration
+}
+
+// NewMetricsSink returns a MetricsSink with all counters at zero.
+func NewMetricsSink(m *Monitor) *MetricsSink {
+	return &MetricsSink{
+		m:        m,
+		logins:   make(map[[3]string]uint64),
+		logouts:  make(map[[2]string]uint64),
+		failures: make(map[[2]string]uint64),
+		alerts:   make(map[[2]string]uint64),
+		open:     make(map[string]openSession),
+		buckets:  make([]uint64, len(durationBuckets)),
+	}
+}
+
+// Consume implements Sink.
+func (s *MetricsSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	return consume(ctx, events, func(event SessionEvent) error {
+		s.add(event, time.Now())
+		return nil
+	})
+}
+
+// add counts the event processed at now. Alerts are counted on their own:
+// they weren't parsed from the log and carry the time of the event that fired them.
+func (s *MetricsSink) add(event SessionEvent, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if event.Alert != nil {
+		s.alerts[[2]string{event.Alert.Rule, event.Alert.Severity}]++
+		return
+	}
+	s.events++
+	if event.EventTime.After(s.lastEvent) {
+		s.lastEvent = event.EventTime
+	}
+	s.lag = now.Sub(event.EventTime)
+
+	key := event.SourceIP + ":" + event.Port
+	switch event.EventType {
+	case "login":
+		method := event.AuthMethod
+		if method == "" {
+			method = "publickey" // only public key logins are parsed
+		}
+		s.logins[[3]string{event.Username, event.KeyUser, method}]++
+		s.open[key] = openSession{start: event.EventTime, account: event.Username, keyUser: event.KeyUser}
+	case "logout":
+		s.logouts[[2]string{event.Username, event.KeyUser}]++
+		if session, ok := s.open[key]; ok {
+			delete(s.open, key)
+			d := event.EventTime.Sub(session.start).Seconds()
+			s.durations++
+			s.durationSum += d
+			for i, le := range durationBuckets {
+				if d <= le {
+					s.buckets[i]++
+				}
+			}
+		}
+	case "failure":
+		s.failures[[2]string{event.Username, event.AuthMethod}]++
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *MetricsSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.WriteMetrics(w)
+}
+
+// WriteMetrics writes all metrics to w in the Prometheus text exposition format.
+func (s *MetricsSink) WriteMetrics(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	header(w, "sshlm_logins_total", "counter", "Successful ssh logins.")
+	for _, k := range sortedKeys3(s.logins) {
+		sample(w, "sshlm_logins_total", labels("account", k[0], "key_user", k[1], "auth_method", k[2]), float64(s.logins[k]))
+	}
+	header(w, "sshlm_logouts_total", "counter", "Ssh logouts.")
+	for _, k := range sortedKeys2(s.logouts) {
+		sample(w, "sshlm_logouts_total", labels("account", k[0], "key_user", k[1]), float64(s.logouts[k]))
+	}
+	header(w, "sshlm_failures_total", "counter", "Failed ssh login attempts.")
+	for _, k := range sortedKeys2(s.failures) {
+		sample(w, "sshlm_failures_total", labels("account", k[0], "auth_method", k[1]), float64(s.failures[k]))
+	}
+	header(w, "sshlm_alerts_total", "counter", "Alerts fired by the rules.")
+	for _, k := range sortedKeys2(s.alerts) {
+		sample(w, "sshlm_alerts_total", labels("rule", k[0], "severity", k[1]), float64(s.alerts[k]))
+	}
+
+	open := make(map[[2]string]uint64)
+	for _, session := range s.open {
+		open[[2]string{session.account, session.keyUser}]++
+	}
+	header(w, "sshlm_open_sessions", "gauge", "Ssh sessions currently open.")
+	for _, k := range sortedKeys2(open) {
+		sample(w, "sshlm_open_sessions", labels("account", k[0], "key_user", k[1]), float64(open[k]))
+	}
+
+	header(w, "sshlm_session_duration_seconds", "histogram", "Duration of ended ssh sessions.")
+	for i, le := range durationBuckets {
+		sample(w, "sshlm_session_duration_seconds_bucket", labels("le", strconv.FormatFloat(le, 'f', -1, 64)), float64(s.buckets[i]))
+	}
+	sample(w, "sshlm_session_duration_seconds_bucket", labels("le", "+Inf"), float64(s.durations))
+	sample(w, "sshlm_session_duration_seconds_sum", "", s.durationSum)
+	sample(w, "sshlm_session_duration_seconds_count", "", float64(s.durations))
+
+	header(w, "sshlm_events_parsed_total", "counter", "Events parsed from the log.")
+	sample(w, "sshlm_events_parsed_total", "", float64(s.events))
+	header(w, "sshlm_parse_errors_total", "counter", "Log lines that looked like ssh events but couldn't be parsed.")
+	sample(w, "sshlm_parse_errors_total", "", float64(s.m.ParseErrors()))
+	header(w, "sshlm_last_event_timestamp_seconds", "gauge", "Time of the last event, as logged.")
+	if !s.lastEvent.IsZero() {
+		sample(w, "sshlm_last_event_timestamp_seconds", "", float64(s.lastEvent.Unix()))
+	}
+	header(w, "sshlm_event_lag_seconds", "gauge", "Delay between the time the last event was logged and the time it was processed.")
+	sample(w, "sshlm_event_lag_seconds", "", s.lag.Seconds())
+}
+
+// header writes the HELP and TYPE lines of a metric.
+func header(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample line.
+func sample(w io.Writer, name, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// labels formats name/value pairs as a Prometheus label set.
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sortedKeys2 returns the keys of m in order, so the output is stable.
+func sortedKeys2(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.Join(keys[i][:], "\x00") < strings.Join(keys[j][:], "\x00")
+	})
+	return keys
+}
+
+// sortedKeys3 returns the keys of m in order, so the output is stable.
+func sortedKeys3(m map[[3]string]uint64) [][3]string {
+	keys := make([][3]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.Join(keys[i][:], "\x00") < strings.Join(keys[j][:], "\x00")
+	})
+	return keys
+}
@@ -0,0 +1,70 @@
+package sshloginmonitor
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsSink(t *testing.T) {
+	m := newTestMonitor(t)
+	metrics := NewMetricsSink(m)
+	log := testLog + `Apr 27 10:22:01 deep-rh sshd[1337500]: Failed password for admin from 10.0.0.7 port 50000 ssh2
+Apr 27 10:22:02 deep-rh sshd[1337500]: Failed password for admin from 10.0.0.7 port 50001 ssh2
+`
+	err := NewPipeline([]Source{NewReaderSource(m, strings.NewReader(log))}, []Sink{metrics}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Alerts don't count as parsed events
+	metrics.add(SessionEvent{EventType: "alert", EventTime: time.Unix(0, 0), Alert: &Alert{Rule: "root-login", Severity: "warning"}}, time.Now())
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(body)
+	for _, want := range []string{
+		"# TYPE sshlm_logins_total counter\n",
+		`sshlm_logins_total{account="root",key_user="alice@fedora",auth_method="publickey"} 1` + "\n",
+		`sshlm_logins_total{account="root",key_user="bob@fedora",auth_method="publickey"} 1` + "\n",
+		`sshlm_logouts_total{account="root",key_user="alice@fedora"} 1` + "\n",
+		`sshlm_failures_total{account="admin",auth_method="password"} 2` + "\n",
+		`sshlm_open_sessions{account="root",key_user="bob@fedora"} 1` + "\n",
+		`sshlm_session_duration_seconds_bucket{le="10"} 1` + "\n",
+		`sshlm_session_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"sshlm_session_duration_seconds_sum 3\n",
+		"sshlm_session_duration_seconds_count 1\n",
+		`sshlm_alerts_total{rule="root-login",severity="warning"} 1` + "\n",
+		"sshlm_events_parsed_total 5\n",
+		"# TYPE sshlm_last_event_timestamp_seconds gauge\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `sshlm_open_sessions{account="root",key_user="alice@fedora"}`) {
+		t.Errorf("alice's session is still open:\n%s", got)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	got := labels("key_user", `a"b\c`+"\n", "account", "root")
+	want := `{key_user="a\"b\\c\n",account="root"}`
+	if got != want {
+		t.Errorf("labels() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+package sshloginmonitor
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"text/template"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Theme maps output elements (username, keyuser, eventtype, eventtime,
+// sourceip, starttime, endtime, duration, port) to color names.
+type Theme map[string]string
+
+// Options configures a Monitor.
+type Options struct {
+	Bucket     string // database bucket name
+	UpdateKeys bool   // overwrite key users of fingerprints already in the database
+	Follow     bool   // keep reading the journal when there are no new entries
+	Color      bool   // color the output using Theme
+	Theme      Theme
+	// KeysFile is where ExportKeys writes the keys for authorized-keys-command.
+	KeysFile string
+	// EventTemplate is a text/template printing each event of the "log"
+	// output instead of the default columns.
+	EventTemplate string
+	// SessionTemplate is a text/template printing each session of the "sum"
+	// output instead of the default columns.
+	SessionTemplate string
+}
+
+// Monitor attributes ssh login events to key owners using the fingerprints database.
+type Monitor struct {
+	// parseErrors counts the log lines that looked like ssh events but couldn't be parsed
+	parseErrors atomic.Uint64
+
+	db          *bolt.DB
+	opts        Options
+	eventTmpl   *template.Template
+	sessionTmpl *template.Template
+}
+
+// ParseErrors returns the number of log lines that looked like ssh events
+// but couldn't be parsed.
+func (m *Monitor) ParseErrors() uint64 {
+	return m.parseErrors.Load()
+}
+
+// NewMonitor returns a Monitor using the given database,
+// creating the bucket if it doesn't exist.
+//
+// Parameters:
+//   - db: an open database
+//   - opts: monitor options; Bucket is required
+//
+// Returns:
+//   - *Monitor: the monitor
+//   - error: an error if the bucket can't be created or a template is invalid
+func NewMonitor(db *bolt.DB, opts Options) (*Monitor, error) {
+	if opts.Bucket == "" {
+		return nil, errors.New("bucket name is required")
+	}
+	m := &Monitor{db: db, opts: opts}
+	if opts.EventTemplate != "" {
+		tmpl, err := m.parseTemplate(opts.EventTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("parse event template: %w", err)
+		}
+		m.eventTmpl = tmpl
+	}
+	if opts.SessionTemplate != "" {
+		tmpl, err := m.parseTemplate(opts.SessionTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("parse session template: %w", err)
+		}
+		m.sessionTmpl = tmpl
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(opts.Bucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,39 @@
+package sshloginmonitor
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestNewMonitor(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = NewMonitor(db, Options{})
+	if err == nil {
+		t.Error("NewMonitor() without bucket: expected an error")
+	}
+
+	m, err := NewMonitor(db, Options{Bucket: "LoginMonitor", UpdateKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.addUsersToDB([]User{{Username: "alice@fedora", Fingerprint: "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := m.LogToEvents(strings.NewReader(
+		`Apr 27 10:21:19 deep-rh sshd[1337250]: Accepted publickey for root from 192.168.1.24 port 49090 ssh2: ED25519 SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].KeyUser != "alice@fedora" {
+		t.Errorf("LogToEvents() = %v, want one login by alice@fedora", events)
+	}
+}
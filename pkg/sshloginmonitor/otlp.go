@@ -0,0 +1,527 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// otlpMaxPending is the maximum number of events waiting to be exported;
+// the oldest ones are dropped beyond it.
+const otlpMaxPending = 10000
+
+// OTLP protocols.
+const (
+	OTLPHTTP = "http/protobuf"
+	OTLPGRPC = "grpc"
+)
+
+// OTLP configures the OpenTelemetry exporter, from the otlp section of the
+// configuration, e.g.
+//
+//	otlp:
+//	  endpoint: http://collector:4318
+//	  headers: {authorization: Bearer s3cr3t}
+//	  sessions: true
+type OTLP struct {
+	// Endpoint is the base URL of the collector: /v1/logs and /v1/traces are
+	// added for OTLP/HTTP, the service methods for OTLP/gRPC.
+	// http://localhost:4318 if empty for OTLP/HTTP
+	Endpoint string `json:"endpoint"`
+	// Protocol is OTLPHTTP (the default) or OTLPGRPC; OTLP/gRPC uses
+	// HTTP/2 without TLS (h2c) for http endpoints
+	Protocol string            `json:"protocol"`
+	Headers  map[string]string `json:"headers"`
+	// Sessions exports the sessions as spans from login to logout
+	Sessions bool `json:"sessions"`
+	// ServiceName is the service.name resource attribute, "sshlm" if empty
+	ServiceName        string            `json:"service_name"`
+	ResourceAttributes map[string]string `json:"resource_attributes"`
+	BatchSize          int               `json:"batch_size"`   // events per export, 100 if zero
+	BatchWait          string            `json:"batch_wait"`   // maximum delay of an export, 1s if empty
+	MaxAttempts        int               `json:"max_attempts"` // attempts to export a batch, 10 if zero
+}
+
+// OTLPSink exports events as OpenTelemetry log records, and optionally
+// sessions as spans, over OTLP/HTTP or OTLP/gRPC with protobuf payloads.
+// The log records have the semantic convention attributes user.name (the
+// account), client.address and client.port, and sshlm.* attributes for the
+// other event fields. The login and logout records of an exported session
+// carry its trace and span IDs, derived from the start, source IP and port
+// of the session; the span is exported with the logout, so sessions still
+// open when the sink stops aren't exported.
+//
+// Events are exported in batches, retried with exponential backoff until
+// MaxAttempts is reached, or the collector rejects them for good.
+type OTLPSink struct {
+	Client     *http.Client
+	Backoff    time.Duration // delay before the first retry, doubled on each attempt; 1s by default
+	MaxBackoff time.Duration // 1m by default
+	// Sessions finds the sessions that logouts end, usually the pipeline
+	// feeding the sink; sessions are only exported if it is set
+	Sessions SessionLister
+
+	cfg       OTLP
+	logsURL   string
+	tracesURL string
+	resource  protoMessage
+	batchSize int
+	batchWait time.Duration
+
+	pending  []*otlpRecord
+	attempts int       // failed attempts to export the first batch of pending
+	retryAt  time.Time // time of the next attempt after a failure
+}
+
+// otlpRecord is an event to export, with the trace context of its session
+// if sessions are exported.
+type otlpRecord struct {
+	event   SessionEvent
+	traceID []byte
+	spanID  []byte
+	session *Session // the session a logout ends
+}
+
+// NewOTLPSink returns a Sink exporting events to an OpenTelemetry collector.
+//
+// Parameters:
+//   - cfg: the exporter settings, usually from the otlp section of the configuration
+//
+// Returns:
+//   - *OTLPSink: the sink
+//   - error: an error if the endpoint, protocol or batch settings are invalid
+func NewOTLPSink(cfg OTLP) (*OTLPSink, error) {
+	if cfg.Protocol == "" {
+		cfg.Protocol = OTLPHTTP
+	}
+	if cfg.Endpoint == "" && cfg.Protocol == OTLPHTTP {
+		cfg.Endpoint = "http://localhost:4318"
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("otlp: invalid endpoint %q", cfg.Endpoint)
+	}
+	base := strings.TrimSuffix(u.String(), "/")
+	s := &OTLPSink{
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+		cfg:        cfg,
+		batchSize:  cfg.BatchSize,
+		batchWait:  time.Second,
+	}
+	switch cfg.Protocol {
+	case OTLPHTTP:
+		s.logsURL, s.tracesURL = base+"/v1/logs", base+"/v1/traces"
+	case OTLPGRPC:
+		s.logsURL = base + "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+		s.tracesURL = base + "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+		if u.Scheme == "https" {
+			s.Client.Transport = &http.Transport{ForceAttemptHTTP2: true, TLSClientConfig: &tls.Config{}}
+		} else {
+			// h2c: HTTP/2 over a plain connection, as collectors accept by default
+			s.Client.Transport = &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				},
+			}
+		}
+	default:
+		return nil, fmt.Errorf("otlp: unknown protocol %q", cfg.Protocol)
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = 100
+	}
+	if cfg.BatchWait != "" {
+		s.batchWait, err = ParseAge(cfg.BatchWait)
+		if err != nil || s.batchWait <= 0 {
+			return nil, fmt.Errorf("otlp: invalid batch_wait %q", cfg.BatchWait)
+		}
+	}
+	if s.cfg.MaxAttempts <= 0 {
+		s.cfg.MaxAttempts = 10
+	}
+	if s.cfg.ServiceName == "" {
+		s.cfg.ServiceName = "sshlm"
+	}
+	host, _ := os.Hostname()
+	s.resource.attribute(1, "service.name", s.cfg.ServiceName)
+	s.resource.attribute(1, "host.name", host)
+	names := make([]string, 0, len(cfg.ResourceAttributes))
+	for name := range cfg.ResourceAttributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.resource.attribute(1, name, cfg.ResourceAttributes[name])
+	}
+	return s, nil
+}
+
+// Consume implements Sink. The pending events are exported one last time
+// before it returns.
+func (s *OTLPSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	ticker := time.NewTicker(s.batchWait)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.flush(time.Now(), true)
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				s.flush(time.Now(), true)
+				return nil
+			}
+			s.add(event)
+			if len(s.pending) >= s.batchSize {
+				s.flush(time.Now(), false)
+			}
+		case now := <-ticker.C:
+			s.flush(now, false)
+		}
+	}
+}
+
+// add queues the event, with the trace context of its session if sessions
+// are exported.
+func (s *OTLPSink) add(event SessionEvent) {
+	record := &otlpRecord{event: event}
+	if s.cfg.Sessions && s.Sessions != nil {
+		switch event.EventType {
+		case "login":
+			record.traceID, record.spanID = otlpSessionIDs(event.EventTime, event.SourceIP, event.Port)
+		case "logout":
+			if session, ok := endedSession(s.Sessions.Sessions(), event); ok {
+				record.traceID, record.spanID = otlpSessionIDs(session.StartTime, session.SourceIP, session.Port)
+				record.session = &session
+			}
+		}
+	}
+	s.pending = append(s.pending, record)
+	if len(s.pending) > otlpMaxPending {
+		log.Printf("otlp: too many unsent events, dropping the oldest")
+		s.pending = s.pending[len(s.pending)-otlpMaxPending:]
+	}
+}
+
+// flush exports the pending events in batches, unless a failed export is
+// waiting for its retry; final ignores the wait.
+func (s *OTLPSink) flush(now time.Time, final bool) {
+	if !final && now.Before(s.retryAt) {
+		return
+	}
+	for len(s.pending) > 0 {
+		n := s.batchSize
+		if n > len(s.pending) {
+			n = len(s.pending)
+		}
+		err := s.export(s.pending[:n])
+		if err == nil {
+			s.pending = s.pending[n:]
+			s.attempts = 0
+			s.retryAt = time.Time{}
+			continue
+		}
+		s.attempts++
+		var status *httpStatusError
+		var grpcErr *grpcError
+		switch {
+		case errors.As(err, &status) && status.permanent(), errors.As(err, &grpcErr) && grpcErr.permanent():
+			log.Printf("otlp: %d events dropped: %s", n, err)
+		case s.attempts >= s.cfg.MaxAttempts:
+			log.Printf("otlp: %d events dropped after %d attempts: %s", n, s.attempts, err)
+		default:
+			log.Printf("otlp: attempt %d to export %d events failed, retrying: %s", s.attempts, n, err)
+			s.retryAt = now.Add(retryBackoff(s.attempts, s.Backoff, s.MaxBackoff))
+			return
+		}
+		s.pending = s.pending[n:]
+		s.attempts = 0
+		s.retryAt = time.Time{}
+	}
+	s.pending = nil
+}
+
+// otlpSessionIDs returns the trace and span IDs of the session started at
+// start from the source IP and port. They are derived from the session, so
+// its login and logout records agree without tracking the open sessions.
+func otlpSessionIDs(start time.Time, sourceIP, port string) ([]byte, []byte) {
+	sum := sha256.Sum256([]byte(start.UTC().Format(time.RFC3339Nano) + " " + sourceIP + " " + port))
+	return sum[:16], sum[16:24]
+}
+
+// endedSession returns the session the logout event ends.
+func endedSession(sessions []Session, logout SessionEvent) (Session, bool) {
+	for _, session := range sessions {
+		if session.SourceIP == logout.SourceIP && session.Port == logout.Port && session.EndTime.Equal(logout.EventTime) {
+			return session, true
+		}
+	}
+	return Session{}, false
+}
+
+// export sends the log records of a batch, and the spans of the sessions
+// it ends.
+func (s *OTLPSink) export(records []*otlpRecord) error {
+	observed := uint64(time.Now().UnixNano())
+	var logs, spans protoMessage
+	for _, record := range records {
+		logs.message(2, s.logRecord(record, observed))
+		if record.session != nil {
+			spans.message(2, s.span(record))
+		}
+	}
+	err := s.post(s.logsURL, s.request(logs))
+	if err != nil || len(spans) == 0 {
+		return err
+	}
+	return s.post(s.tracesURL, s.request(spans))
+}
+
+// request returns an ExportLogsServiceRequest or ExportTraceServiceRequest
+// of scope records: both are a resource and the records of one scope.
+func (s *OTLPSink) request(records protoMessage) protoMessage {
+	var scope protoMessage
+	scope.string(1, "sshlm")
+	var scoped protoMessage
+	scoped.message(1, scope)
+	scoped = append(scoped, records...)
+	var resource protoMessage
+	resource.message(1, s.resource)
+	resource.message(2, scoped)
+	var req protoMessage
+	req.message(1, resource)
+	return req
+}
+
+// logRecord returns the LogRecord of an event.
+func (s *OTLPSink) logRecord(record *otlpRecord, observed uint64) protoMessage {
+	event := record.event
+	number, text := otlpSeverity(event)
+	var body protoMessage
+	body.string(1, eventMessage(event))
+	var m protoMessage
+	m.fixed64(1, otlpTime(event.EventTime))
+	m.varint(2, uint64(number))
+	m.string(3, text)
+	m.message(5, body)
+	otlpAttributes(&m, 6, event)
+	if record.traceID != nil {
+		m.bytes(9, record.traceID)
+		m.bytes(10, record.spanID)
+	}
+	m.fixed64(11, observed)
+	return m
+}
+
+// span returns the Span of the session a logout record ends.
+func (s *OTLPSink) span(logout *otlpRecord) protoMessage {
+	session := logout.session
+	var m protoMessage
+	m.bytes(1, logout.traceID)
+	m.bytes(2, logout.spanID)
+	m.string(5, "ssh session")
+	m.varint(6, 2) // SPAN_KIND_SERVER
+	m.fixed64(7, otlpTime(session.StartTime))
+	m.fixed64(8, otlpTime(session.EndTime))
+	otlpAttributes(&m, 9, SessionEvent{EventType: "login", Username: session.Username, SourceIP: session.SourceIP,
+		Port: session.Port, KeyUser: session.KeyUser, KeyEmail: session.KeyEmail, KeyTeam: session.KeyTeam})
+	return m
+}
+
+// otlpAttributes adds the attributes of the event to m as the field.
+func otlpAttributes(m *protoMessage, field int, event SessionEvent) {
+	m.attribute(field, "user.name", event.Username)
+	m.attribute(field, "client.address", event.SourceIP)
+	if port, err := strconv.Atoi(event.Port); err == nil {
+		m.attribute(field, "client.port", int64(port))
+	}
+	m.attribute(field, "sshlm.event_type", event.EventType)
+	m.attribute(field, "sshlm.key_user", event.KeyUser)
+	m.attribute(field, "sshlm.key_email", event.KeyEmail)
+	m.attribute(field, "sshlm.key_team", event.KeyTeam)
+	m.attribute(field, "sshlm.fingerprint", event.Fingerprint)
+	m.attribute(field, "sshlm.auth_method", event.AuthMethod)
+	if event.Alert != nil {
+		m.attribute(field, "sshlm.alert.rule", event.Alert.Rule)
+		m.attribute(field, "sshlm.alert.severity", event.Alert.Severity)
+	}
+}
+
+// otlpSeverity returns the severity number and text of the event.
+func otlpSeverity(event SessionEvent) (int, string) {
+	switch syslogSeverity(event) {
+	case syslogCrit:
+		return 17, "ERROR"
+	case syslogWarning:
+		return 13, "WARN"
+	}
+	return 9, "INFO"
+}
+
+// otlpTime returns the OTLP time of an event time, or 0 for the zero time.
+func otlpTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+// post sends an export request, as a gRPC message for OTLP/gRPC.
+func (s *OTLPSink) post(endpoint string, msg protoMessage) error {
+	body := []byte(msg)
+	contentType := "application/x-protobuf"
+	grpc := s.cfg.Protocol == OTLPGRPC
+	if grpc {
+		contentType = "application/grpc"
+		body = binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+		body = append(body, msg...)
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "sshlm")
+	if grpc {
+		req.Header.Set("TE", "trailers")
+	}
+	for name, value := range s.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var text []byte
+		if resp.Header.Get("Content-Type") != "application/x-protobuf" {
+			text, _ = io.ReadAll(io.LimitReader(resp.Body, 512))
+		}
+		return &httpStatusError{status: resp.StatusCode, body: string(bytes.TrimSpace(text))}
+	}
+	// Read the body to the end to get the trailers
+	io.Copy(io.Discard, resp.Body)
+	if !grpc {
+		return nil
+	}
+	if resp.ProtoMajor != 2 {
+		return fmt.Errorf("%s doesn't speak HTTP/2", endpoint)
+	}
+	// The status is in the trailers, or in the headers of a response
+	// without body
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("invalid gRPC status %q", status)
+	}
+	if code != 0 {
+		message, _ = url.PathUnescape(message)
+		return &grpcError{code: code, message: message}
+	}
+	return nil
+}
+
+// grpcError is a gRPC call ending with an error status.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("gRPC status %d: %s", e.code, e.message)
+}
+
+// permanent reports whether retrying can't help, following the OTLP
+// specification: all statuses but CANCELLED, DEADLINE_EXCEEDED,
+// RESOURCE_EXHAUSTED, ABORTED, OUT_OF_RANGE, UNAVAILABLE and DATA_LOSS.
+func (e *grpcError) permanent() bool {
+	switch e.code {
+	case 1, 4, 8, 10, 11, 14, 15:
+		return false
+	}
+	return true
+}
+
+// protoMessage is a protocol buffers message being encoded. Fields with
+// the default value are left out, as in proto3.
+type protoMessage []byte
+
+func (m *protoMessage) tag(field, wireType int) {
+	*m = binary.AppendUvarint(*m, uint64(field<<3|wireType))
+}
+
+func (m *protoMessage) varint(field int, v uint64) {
+	if v != 0 {
+		m.tag(field, 0)
+		*m = binary.AppendUvarint(*m, v)
+	}
+}
+
+func (m *protoMessage) fixed64(field int, v uint64) {
+	if v != 0 {
+		m.tag(field, 1)
+		*m = binary.LittleEndian.AppendUint64(*m, v)
+	}
+}
+
+func (m *protoMessage) bytes(field int, v []byte) {
+	m.tag(field, 2)
+	*m = binary.AppendUvarint(*m, uint64(len(v)))
+	*m = append(*m, v...)
+}
+
+func (m *protoMessage) string(field int, v string) {
+	if v != "" {
+		m.bytes(field, []byte(v))
+	}
+}
+
+func (m *protoMessage) message(field int, v protoMessage) {
+	m.bytes(field, v)
+}
+
+// attribute adds a KeyValue with a string or int64 AnyValue as the field;
+// empty strings are left out.
+func (m *protoMessage) attribute(field int, key string, value any) {
+	var v protoMessage
+	switch value := value.(type) {
+	case string:
+		if value == "" {
+			return
+		}
+		v.string(1, value)
+	case int64:
+		v.tag(3, 0)
+		v = binary.AppendUvarint(v, uint64(value))
+	}
+	var kv protoMessage
+	kv.string(1, key)
+	kv.message(2, v)
+	m.message(field, kv)
+}
@@ -0,0 +1,330 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// protoFields decodes a protocol buffers message into its fields: uint64
+// for varint and fixed64 fields, []byte for length-delimited ones.
+func protoFields(t *testing.T, data []byte) map[int][]any {
+	t.Helper()
+	fields := make(map[int][]any)
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("invalid tag in %x", data)
+		}
+		data = data[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatalf("invalid varint in %x", data)
+			}
+			fields[field] = append(fields[field], v)
+			data = data[n:]
+		case 1:
+			fields[field] = append(fields[field], binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				t.Fatalf("invalid length in %x", data)
+			}
+			fields[field] = append(fields[field], data[n:n+int(length)])
+			data = data[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+// protoAttributes decodes KeyValue fields into strings.
+func protoAttributes(t *testing.T, values []any) map[string]string {
+	attrs := make(map[string]string)
+	for _, value := range values {
+		kv := protoFields(t, value.([]byte))
+		anyValue := protoFields(t, kv[2][0].([]byte))
+		key := string(kv[1][0].([]byte))
+		switch {
+		case anyValue[1] != nil:
+			attrs[key] = string(anyValue[1][0].([]byte))
+		case anyValue[3] != nil:
+			attrs[key] = strconv.FormatUint(anyValue[3][0].(uint64), 10)
+		}
+	}
+	return attrs
+}
+
+// otlpRecords returns the resource attributes and the records of an export
+// request: log records or spans.
+func otlpRecords(t *testing.T, req []byte) (map[string]string, [][]byte) {
+	resource := protoFields(t, protoFields(t, req)[1][0].([]byte))
+	attrs := protoAttributes(t, protoFields(t, resource[1][0].([]byte))[1])
+	scoped := protoFields(t, resource[2][0].([]byte))
+	if scope := protoFields(t, scoped[1][0].([]byte)); string(scope[1][0].([]byte)) != "sshlm" {
+		t.Errorf("scope = %v, want sshlm", scope)
+	}
+	var records [][]byte
+	for _, record := range scoped[2] {
+		records = append(records, record.([]byte))
+	}
+	return attrs, records
+}
+
+// fakeCollector is a stand-in for an OTLP collector over HTTP or gRPC.
+type fakeCollector struct {
+	mu       sync.Mutex
+	requests map[string][][]byte
+	grpc     bool
+	statuses []int // HTTP or gRPC statuses of the next responses, then OK
+}
+
+func (f *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	status := 0
+	if len(f.statuses) > 0 {
+		status = f.statuses[0]
+		f.statuses = f.statuses[1:]
+	}
+	if !f.grpc {
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if status != 0 {
+			http.Error(w, "failed", status)
+			return
+		}
+		f.requests[r.URL.Path] = append(f.requests[r.URL.Path], body)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		return
+	}
+	if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" || len(body) < 5 ||
+		body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		http.Error(w, "invalid gRPC request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	if status == 0 {
+		f.requests[r.URL.Path] = append(f.requests[r.URL.Path], body[5:])
+		w.Write([]byte{0, 0, 0, 0, 0})
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(status))
+	w.Header().Set("Grpc-Message", "status%20"+strconv.Itoa(status))
+}
+
+func (f *fakeCollector) received(path string) [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path]
+}
+
+func TestOTLPSink(t *testing.T) {
+	at := time.Date(2023, 4, 27, 10, 21, 19, 0, time.UTC)
+	events := []SessionEvent{
+		{EventType: "login", EventTime: at, Username: "root", KeyUser: "alice@fedora", SourceIP: "192.168.1.24", Port: "49090"},
+		{EventType: "failure", EventTime: at.Add(time.Second), Username: "bob", SourceIP: "10.0.0.9", Port: "4000", AuthMethod: "password"},
+		{EventType: "logout", EventTime: at.Add(time.Hour), Username: "root", KeyUser: "alice@fedora", SourceIP: "192.168.1.24", Port: "49090"},
+	}
+	tests := []struct {
+		name      string
+		protocol  string
+		tls       bool
+		logsPath  string
+		spansPath string
+	}{
+		{"http", OTLPHTTP, true, "/v1/logs", "/v1/traces"},
+		{"grpc", OTLPGRPC, true, "/opentelemetry.proto.collector.logs.v1.LogsService/Export",
+			"/opentelemetry.proto.collector.trace.v1.TraceService/Export"},
+		{"grpc without TLS", OTLPGRPC, false, "/opentelemetry.proto.collector.logs.v1.LogsService/Export",
+			"/opentelemetry.proto.collector.trace.v1.TraceService/Export"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &fakeCollector{requests: make(map[string][][]byte), grpc: tt.protocol == OTLPGRPC}
+			var server *httptest.Server
+			if tt.tls {
+				server = httptest.NewUnstartedServer(collector)
+				server.EnableHTTP2 = true
+				server.StartTLS()
+			} else {
+				server = httptest.NewServer(h2c.NewHandler(collector, &http2.Server{}))
+			}
+			defer server.Close()
+
+			sink, err := NewOTLPSink(OTLP{Endpoint: server.URL, Protocol: tt.protocol, Sessions: true,
+				ResourceAttributes: map[string]string{"deployment.environment": "prod"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tls {
+				sink.Client = server.Client()
+			}
+			// The pipeline correlates the events before the sink gets them
+			correlator := NewCorrelator()
+			sink.Sessions = correlator
+			in := make(chan SessionEvent, len(events))
+			for _, event := range events {
+				in <- correlator.Process(event)
+			}
+			close(in)
+			err = sink.Consume(context.Background(), in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			logs := collector.received(tt.logsPath)
+			if len(logs) != 1 {
+				t.Fatalf("got %d logs exports, want 1", len(logs))
+			}
+			resource, records := otlpRecords(t, logs[0])
+			if resource["service.name"] != "sshlm" || resource["deployment.environment"] != "prod" || resource["host.name"] == "" {
+				t.Errorf("resource = %v", resource)
+			}
+			if len(records) != 3 {
+				t.Fatalf("got %d log records, want 3", len(records))
+			}
+			login := protoFields(t, records[0])
+			wantAttrs := map[string]string{"user.name": "root", "client.address": "192.168.1.24", "client.port": "49090",
+				"sshlm.event_type": "login", "sshlm.key_user": "alice@fedora"}
+			if got := protoAttributes(t, login[6]); fmt.Sprint(got) != fmt.Sprint(wantAttrs) {
+				t.Errorf("login attributes = %v, want %v", got, wantAttrs)
+			}
+			if login[1][0].(uint64) != uint64(at.UnixNano()) || login[2][0].(uint64) != 9 || string(login[3][0].([]byte)) != "INFO" {
+				t.Errorf("login time and severity = %v %v %s", login[1], login[2], login[3])
+			}
+			if body := protoFields(t, login[5][0].([]byte)); string(body[1][0].([]byte)) != eventMessage(events[0]) {
+				t.Errorf("login body = %s", body[1][0])
+			}
+			failure := protoFields(t, records[1])
+			if failure[2][0].(uint64) != 13 || failure[9] != nil {
+				t.Errorf("failure = %v, want WARN without trace", failure)
+			}
+			logout := protoFields(t, records[2])
+			traceID, spanID := login[9][0].([]byte), login[10][0].([]byte)
+			if len(traceID) != 16 || len(spanID) != 8 || !bytes.Equal(logout[9][0].([]byte), traceID) ||
+				!bytes.Equal(logout[10][0].([]byte), spanID) {
+				t.Errorf("trace context of login %x/%x and logout %v/%v differ", traceID, spanID, logout[9], logout[10])
+			}
+
+			traces := collector.received(tt.spansPath)
+			if len(traces) != 1 {
+				t.Fatalf("got %d traces exports, want 1", len(traces))
+			}
+			_, spans := otlpRecords(t, traces[0])
+			if len(spans) != 1 {
+				t.Fatalf("got %d spans, want 1", len(spans))
+			}
+			span := protoFields(t, spans[0])
+			if !bytes.Equal(span[1][0].([]byte), traceID) || !bytes.Equal(span[2][0].([]byte), spanID) ||
+				span[7][0].(uint64) != uint64(at.UnixNano()) || span[8][0].(uint64) != uint64(at.Add(time.Hour).UnixNano()) {
+				t.Errorf("span = %v", span)
+			}
+			if got := protoAttributes(t, span[9]); fmt.Sprint(got) != fmt.Sprint(wantAttrs) {
+				t.Errorf("span attributes = %v, want %v", got, wantAttrs)
+			}
+		})
+	}
+}
+
+func TestOTLPRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		grpc       bool
+		statuses   []int
+		wantExport bool
+	}{
+		{"http unavailable", false, []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, true},
+		{"http bad request", false, []int{http.StatusBadRequest}, false},
+		{"grpc unavailable", true, []int{14, 8}, true},
+		{"grpc invalid argument", true, []int{3}, false},
+		{"too many failures", true, []int{14, 14, 14}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := &fakeCollector{requests: make(map[string][][]byte), grpc: tt.grpc, statuses: tt.statuses}
+			server := httptest.NewUnstartedServer(collector)
+			server.EnableHTTP2 = true
+			server.StartTLS()
+			defer server.Close()
+			protocol := OTLPHTTP
+			if tt.grpc {
+				protocol = OTLPGRPC
+			}
+			sink, err := NewOTLPSink(OTLP{Endpoint: server.URL, Protocol: protocol, MaxAttempts: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.Client = server.Client()
+			sink.Backoff = time.Minute
+
+			now := time.Now()
+			sink.add(SessionEvent{EventType: "failure", Username: "root"})
+			for i := 0; i < 3; i++ {
+				sink.flush(now, false)
+				// A retry waits for the backoff
+				sink.flush(now.Add(time.Second), false)
+				now = now.Add(time.Hour)
+			}
+			exported := 0
+			for _, requests := range collector.requests {
+				exported += len(requests)
+			}
+			if (exported > 0) != tt.wantExport {
+				t.Errorf("got %d exports, want export %v", exported, tt.wantExport)
+			}
+			if len(sink.pending) != 0 {
+				t.Errorf("%d events still pending", len(sink.pending))
+			}
+		})
+	}
+}
+
+func TestNewOTLPSink(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      OTLP
+		wantLogs string
+		wantErr  bool
+	}{
+		{"default", OTLP{}, "http://localhost:4318/v1/logs", false},
+		{"http", OTLP{Endpoint: "https://otel.example.com/otlp/"}, "https://otel.example.com/otlp/v1/logs", false},
+		{"grpc", OTLP{Endpoint: "https://otel.example.com:4317", Protocol: OTLPGRPC},
+			"https://otel.example.com:4317/opentelemetry.proto.collector.logs.v1.LogsService/Export", false},
+		{"grpc without TLS", OTLP{Endpoint: "http://localhost:4317", Protocol: OTLPGRPC},
+			"http://localhost:4317/opentelemetry.proto.collector.logs.v1.LogsService/Export", false},
+		{"grpc without endpoint", OTLP{Protocol: OTLPGRPC}, "", true},
+		{"unknown protocol", OTLP{Protocol: "http/json"}, "", true},
+		{"invalid batch wait", OTLP{BatchWait: "soon"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := NewOTLPSink(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewOTLPSink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && sink.logsURL != tt.wantLogs {
+				t.Errorf("logs URL = %s, want %s", sink.logsURL, tt.wantLogs)
+			}
+		})
+	}
+}
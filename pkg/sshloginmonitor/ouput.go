@@ -1,10 +1,16 @@
 package sshloginmonitor
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/fatih/color"
-	"github.com/pavelanni/ssh-login-monitor/pkg/config"
 )
 
 var colorMap = map[string]color.Attribute{
@@ -18,6 +24,16 @@ var colorMap = map[string]color.Attribute{
 	"yellow":  color.FgYellow,
 }
 
+// colorFunc returns a Sprintf-like function coloring its output with the
+// theme color of the element, or not coloring it if the Color option is off.
+func (m *Monitor) colorFunc(element string) func(format string, a ...interface{}) string {
+	c := color.New(colorMap[m.opts.Theme[element]])
+	if !m.opts.Color {
+		c.DisableColor()
+	}
+	return c.SprintfFunc()
+}
+
 // PrintSummary takes a slice of Session objects and prints a summary of each session.
 // For each session, the function prints the username, source IP, start time, end time,
 // and duration of the session in the format "username\tsourceIP\tstartTime\tendTime\tduration".
@@ -28,17 +44,23 @@ var colorMap = map[string]color.Attribute{
 //
 // Returns:
 //   - None
-func PrintSummary(sessions []Session, colorFlag bool) {
-	if !colorFlag {
-		color.NoColor = true
-	}
-	usernameColor := color.New(colorMap[config.K.String("theme.username")]).SprintfFunc()
-	keyUserColor := color.New(colorMap[config.K.String("theme.keyuser")]).SprintfFunc()
-	sourceipColor := color.New(colorMap[config.K.String("theme.sourceip")]).SprintfFunc()
-	starttimeColor := color.New(colorMap[config.K.String("theme.starttime")]).SprintfFunc()
-	endtimeColor := color.New(colorMap[config.K.String("theme.endtime")]).SprintfFunc()
-	durationColor := color.New(colorMap[config.K.String("theme.duration")]).SprintfFunc()
+func (m *Monitor) PrintSummary(sessions []Session) {
+	usernameColor := m.colorFunc("username")
+	keyUserColor := m.colorFunc("keyuser")
+	sourceipColor := m.colorFunc("sourceip")
+	starttimeColor := m.colorFunc("starttime")
+	endtimeColor := m.colorFunc("endtime")
+	durationColor := m.colorFunc("duration")
 
+	if m.sessionTmpl != nil {
+		for _, session := range sessions {
+			err := executeTemplate(os.Stdout, m.sessionTmpl, session)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
 	fmt.Println(usernameColor("%-20s", "USER"),
 		keyUserColor("%-20s", "KEY USER"),
 		sourceipColor("%-16s", "SOURCE IP"),
@@ -62,24 +84,186 @@ func PrintSummary(sessions []Session, colorFlag bool) {
 //
 // Returns:
 //   - None
-func PrintLog(events []SessionEvent, colorFlag bool) {
+func (m *Monitor) PrintLog(events []SessionEvent) {
 	for _, event := range events {
-		PrintEvent(event, colorFlag)
+		m.PrintEvent(event)
 	}
 }
 
-func PrintEvent(event SessionEvent, colorFlag bool) {
-	if !colorFlag {
-		color.NoColor = true
+// PrintEvent prints one event in the "log" output format, or with the
+// output template if there is one.
+func (m *Monitor) PrintEvent(event SessionEvent) {
+	if m.eventTmpl != nil {
+		err := executeTemplate(os.Stdout, m.eventTmpl, event)
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	usernameColor := m.colorFunc("username")
+	keyUserColor := m.colorFunc("keyuser")
+	eventtypeColor := m.colorFunc("eventtype")
+	eventtimeColor := m.colorFunc("eventtime")
+	sourceipColor := m.colorFunc("sourceip")
+	portColor := m.colorFunc("port")
+	if event.Alert != nil {
+		fmt.Println(usernameColor("%-20s", event.Username),
+			keyUserColor("%-20s", event.KeyUser),
+			eventtypeColor("%-8s", event.EventType),
+			sourceipColor("%-16s", event.SourceIP),
+			portColor("%-6s", event.Port),
+			eventtimeColor("%-20s", event.EventTime.Format("2006-01-02 15:04:05")),
+			strings.ToUpper(event.Alert.Severity), event.Alert.Rule+":", event.Alert.Message)
+		return
 	}
-	usernameColor := color.New(colorMap[config.K.String("theme.username")]).SprintfFunc()
-	keyUserColor := color.New(colorMap[config.K.String("theme.keyuser")]).SprintfFunc()
-	eventtypeColor := color.New(colorMap[config.K.String("theme.eventtype")]).SprintfFunc()
-	eventtimeColor := color.New(colorMap[config.K.String("theme.eventtime")]).SprintfFunc()
-	sourceipColor := color.New(colorMap[config.K.String("theme.sourceip")]).SprintfFunc()
 	fmt.Println(usernameColor("%-20s", event.Username),
 		keyUserColor("%-20s", event.KeyUser),
 		eventtypeColor("%-8s", event.EventType),
 		sourceipColor("%-16s", event.SourceIP),
+		portColor("%-6s", event.Port),
 		eventtimeColor("%-20s", event.EventTime.Format("2006-01-02 15:04:05")))
 }
+
+// PrintAudit prints the key audit findings as a table, or as JSON if jsonFlag is set.
+//
+// Parameters:
+//   - findings ([]Finding): findings returned by AuditKeys
+//   - jsonFlag (bool): print JSON instead of a table
+//
+// Returns:
+//   - error: an error if the findings can't be encoded
+func PrintAudit(findings []Finding, jsonFlag bool) error {
+	if jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(findings)
+	}
+	fmt.Printf("%-8s %-15s %-44s %-20s %s\n", "SEVERITY", "CHECK", "FINGERPRINT", "ACCOUNTS", "MESSAGE")
+	for _, f := range findings {
+		fmt.Printf("%-8s %-15s %-44s %-20s %s\n", f.Severity, f.Check, f.Fingerprint,
+			strings.Join(f.Accounts, ","), f.Message)
+	}
+	return nil
+}
+
+// PrintStale prints the stale keys as a table, or as JSON if jsonFlag is set.
+//
+// Parameters:
+//   - keys ([]StaleKey): keys returned by StaleKeys
+//   - jsonFlag (bool): print JSON instead of a table
+//
+// Returns:
+//   - error: an error if the keys can't be encoded
+func PrintStale(keys []StaleKey, jsonFlag bool) error {
+	if jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(keys)
+	}
+	fmt.Printf("%-44s %-20s %-20s %-20s %s\n", "FINGERPRINT", "KEY USER", "ACCOUNTS", "LAST USED", "REASONS")
+	for _, k := range keys {
+		lastUsed := "never"
+		if k.LastUsed != nil {
+			lastUsed = k.LastUsed.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-44s %-20s %-20s %-20s %s\n", k.Fingerprint, k.KeyUser,
+			strings.Join(k.Accounts, ","), lastUsed, strings.Join(k.Reasons, "; "))
+	}
+	return nil
+}
+
+// eventMessage describes the event in one line, for notifications.
+func eventMessage(event SessionEvent) string {
+	switch event.EventType {
+	case "alert":
+		if event.Alert != nil {
+			return fmt.Sprintf("[%s] %s: %s", event.Alert.Severity, event.Alert.Rule, event.Alert.Message)
+		}
+	case "failure":
+		return fmt.Sprintf("failed %s login for %s from %s port %s", event.AuthMethod, event.Username, event.SourceIP, event.Port)
+	}
+	return fmt.Sprintf("%s of %s by %s from %s port %s", event.EventType, event.Username, event.KeyUser, event.SourceIP, event.Port)
+}
+
+// csvHeader is the header row of the CSV event output.
+var csvHeader = []string{"event_time", "event_type", "username", "key_user", "source_ip", "port", "fingerprint"}
+
+// csvRecord returns the CSV row for the event.
+func csvRecord(event SessionEvent) []string {
+	return []string{
+		event.EventTime.Format(time.RFC3339),
+		event.EventType,
+		event.Username,
+		event.KeyUser,
+		event.SourceIP,
+		event.Port,
+		event.Fingerprint,
+	}
+}
+
+// PrintJSON prints the events to w as a JSON array.
+func PrintJSON(w io.Writer, events []SessionEvent) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(events)
+}
+
+// PrintCSV prints the events to w in CSV format with a header row.
+func PrintCSV(w io.Writer, events []SessionEvent) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(csvHeader)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		err = cw.Write(csvRecord(event))
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// printLiveSummary clears the terminal and prints the open sessions with
+// their duration so far.
+func (m *Monitor) printLiveSummary(w io.Writer, sessions []Session, now time.Time) {
+	usernameColor := m.colorFunc("username")
+	keyUserColor := m.colorFunc("keyuser")
+	sourceipColor := m.colorFunc("sourceip")
+	portColor := m.colorFunc("port")
+	starttimeColor := m.colorFunc("starttime")
+	durationColor := m.colorFunc("duration")
+
+	fmt.Fprint(w, "\033[H\033[2J") // move the cursor home and clear the screen
+	fmt.Fprintf(w, "Open sessions at %s\n\n", now.Format("2006-01-02 15:04:05"))
+	if m.sessionTmpl != nil {
+		for _, session := range sessions {
+			if !session.EndTime.IsZero() {
+				continue
+			}
+			err := executeTemplate(w, m.sessionTmpl, session)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
+	fmt.Fprintln(w, usernameColor("%-20s", "USER"),
+		keyUserColor("%-20s", "KEY USER"),
+		sourceipColor("%-16s", "SOURCE IP"),
+		portColor("%-6s", "PORT"),
+		starttimeColor("%-20s", "START TIME"),
+		durationColor("%-8s", "DURATION"))
+	for _, session := range sessions {
+		if !session.EndTime.IsZero() {
+			continue
+		}
+		fmt.Fprintln(w, usernameColor("%-20s", session.Username),
+			keyUserColor("%-20s", session.KeyUser),
+			sourceipColor("%-16s", session.SourceIP),
+			portColor("%-6s", session.Port),
+			starttimeColor("%-20s", session.StartTime.Format("2006-01-02 15:04:05")),
+			durationColor("%-8s", now.Sub(session.StartTime).Truncate(time.Second).String()))
+	}
+}
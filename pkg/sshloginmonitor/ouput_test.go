@@ -0,0 +1,64 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputSink(t *testing.T) {
+	m := newTestMonitor(t)
+	tests := []struct {
+		name   string
+		format string
+		want   []string
+	}{
+		{
+			name:   "json",
+			format: "json",
+			want:   []string{`"event_type":"login"`, `"key_user":"alice@fedora"`, `"event_type":"logout"`},
+		},
+		{
+			name:   "csv",
+			format: "csv",
+			want: []string{
+				"event_time,event_type,username,key_user,source_ip,port,fingerprint\n",
+				",login,root,alice@fedora,192.168.1.24,49090,",
+				",logout,root,alice@fedora,192.168.1.24,49090,",
+			},
+		},
+		{
+			name:   "live summary",
+			format: "sum",
+			want:   []string{"Open sessions at", "bob@fedora", "41254"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			pipeline := NewPipeline([]Source{NewReaderSource(m, strings.NewReader(testLog))}, nil)
+			sink, err := NewOutputSink(m, tt.format, &buf, pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pipeline.Sinks = []Sink{sink}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err = pipeline.Run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := buf.String()
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("output %q doesn't contain %q", got, want)
+				}
+			}
+		})
+	}
+	if _, err := NewOutputSink(m, "xml", nil, nil); err == nil {
+		t.Error("NewOutputSink() accepted an unknown format")
+	}
+}
@@ -0,0 +1,188 @@
+package sshloginmonitor
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+)
+
+// UnknownOwner is reported as the key user when neither the owner registry
+// nor the key comment tell who owns a key.
+const UnknownOwner = "unknown owner"
+
+// Owner is a person a key belongs to, as listed in the owner registry.
+type Owner struct {
+	Name        string `json:"name" yaml:"name"`
+	Fingerprint string `json:"fingerprint" yaml:"fingerprint"`
+	Email       string `json:"email,omitempty" yaml:"email"`
+	Team        string `json:"team,omitempty" yaml:"team"`
+}
+
+// ownersBucket returns the name of the bucket mapping fingerprints to Owner records.
+func ownersBucket(bucket string) []byte {
+	return []byte(bucket + "/owners")
+}
+
+// getOwners reads the owner registry in CSV format: one owner per line as
+// "name,fingerprint[,email[,team]]", the same layout as test/users.csv.
+// Lines starting with # are ignored.
+func getOwners(reader io.Reader) ([]Owner, error) {
+	r := csv.NewReader(reader)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	owners := make([]Owner, 0)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			line, _ := r.FieldPos(0)
+			return nil, fmt.Errorf("line %d: expected name and fingerprint", line)
+		}
+		owner := Owner{
+			Name:        record[0],
+			Fingerprint: record[1],
+		}
+		if len(record) > 2 {
+			owner.Email = record[2]
+		}
+		if len(record) > 3 {
+			owner.Team = record[3]
+		}
+		owners = append(owners, owner)
+	}
+	return owners, nil
+}
+
+// getOwnersYAML reads the owner registry in YAML format: a list of owners
+// with name, fingerprint, email and team fields.
+func getOwnersYAML(reader io.Reader) ([]Owner, error) {
+	owners := make([]Owner, 0)
+	err := yaml.NewDecoder(reader).Decode(&owners)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	for _, owner := range owners {
+		if owner.Name == "" || owner.Fingerprint == "" {
+			return nil, fmt.Errorf("owner %q: name and fingerprint are required", owner.Name+owner.Fingerprint)
+		}
+	}
+	return owners, nil
+}
+
+// UpdateOwnersDB loads the owner registry from a CSV or YAML file (by extension)
+// and stores it in the database, replacing the previous registry.
+// MD5 fingerprints in the registry are resolved through the keys already in the database.
+//
+// Parameters:
+//   - ownersFile: path to the registry file
+//
+// Returns:
+//   - error: an error if the file can't be read or parsed, or the database can't be updated
+func (m *Monitor) UpdateOwnersDB(ownersFile string) error {
+	bucket := m.opts.Bucket
+	f, err := os.Open(ownersFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var owners []Owner
+	switch strings.ToLower(filepath.Ext(ownersFile)) {
+	case ".yaml", ".yml":
+		owners, err = getOwnersYAML(f)
+	default:
+		owners, err = getOwners(f)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", ownersFile, err)
+	}
+
+	log.Printf("loading %d key owners from file: %s", len(owners), ownersFile)
+	return m.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(ownersBucket(bucket))
+		if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		b, err := tx.CreateBucket(ownersBucket(bucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		for _, owner := range owners {
+			owner.Fingerprint = canonicalFingerprint(tx, bucket, owner.Fingerprint)
+			data, err := json.Marshal(owner)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(owner.Fingerprint), data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// registeredOwner returns the owner of the key with the given SHA256
+// fingerprint in the owner registry, and whether the registry lists the key.
+func (m *Monitor) registeredOwner(fp string) (Owner, bool, error) {
+	var owner Owner
+	registered := false
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ownersBucket(m.opts.Bucket))
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(fp))
+		if data == nil {
+			return nil
+		}
+		registered = true
+		return json.Unmarshal(data, &owner)
+	})
+	return owner, registered, err
+}
+
+// GetOwnerByFingerprint returns the owner of the key with the given fingerprint.
+// The owner registry takes precedence over the key comment; if neither knows
+// the key, the returned Owner has an empty Name.
+// The fingerprint may be in SHA256 or MD5 format; the returned Owner always
+// has the SHA256 one if the key is in the database.
+func (m *Monitor) GetOwnerByFingerprint(fp string) (Owner, error) {
+	bucket := m.opts.Bucket
+	var owner Owner
+	err := m.db.View(func(tx *bolt.Tx) error {
+		fp = canonicalFingerprint(tx, bucket, fp)
+		owner.Fingerprint = fp
+		if b := tx.Bucket(ownersBucket(bucket)); b != nil {
+			if data := b.Get([]byte(fp)); data != nil {
+				return json.Unmarshal(data, &owner)
+			}
+		}
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return errors.New("bucket not found")
+		}
+		owner.Name = string(b.Get([]byte(fp)))
+		return nil
+	})
+	if err != nil {
+		return Owner{}, err
+	}
+	return owner, nil
+}
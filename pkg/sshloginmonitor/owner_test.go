@@ -0,0 +1,125 @@
+package sshloginmonitor
+
+import (
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestGetOwners(t *testing.T) {
+	tests := []struct {
+		name    string
+		reader  io.Reader
+		yaml    bool
+		want    []Owner
+		wantErr bool
+	}{
+		{
+			name: "csv with optional columns",
+			reader: strings.NewReader(`# name,fingerprint,email,team
+alice,5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8,alice@example.com,platform
+bob,is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY
+`),
+			want: []Owner{
+				{Name: "alice", Fingerprint: "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8", Email: "alice@example.com", Team: "platform"},
+				{Name: "bob", Fingerprint: "is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY"},
+			},
+		},
+		{
+			name:    "csv without fingerprint",
+			reader:  strings.NewReader("alice\n"),
+			wantErr: true,
+		},
+		{
+			name: "yaml",
+			reader: strings.NewReader(`- name: alice
+  fingerprint: SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8
+  email: alice@example.com
+  team: platform
+`),
+			yaml: true,
+			want: []Owner{
+				{Name: "alice", Fingerprint: "SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8", Email: "alice@example.com", Team: "platform"},
+			},
+		},
+		{
+			name:    "yaml without name",
+			reader:  strings.NewReader("- fingerprint: abc\n"),
+			yaml:    true,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Owner
+			var err error
+			if tt.yaml {
+				got, err = getOwnersYAML(tt.reader)
+			} else {
+				got, err = getOwners(tt.reader)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getOwners() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getOwners() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetOwnerByFingerprint(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bucket := "LoginMonitor"
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte("5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8"), []byte("root@laptop"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY"), []byte("bob@fedora"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMonitor(db, Options{Bucket: bucket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.UpdateOwnersDB("../../test/owners.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		fp   string
+		want string
+	}{
+		{name: "registry wins over comment", fp: "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8", want: "Alice Smith"},
+		{name: "registry without prefix", fp: "is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY", want: "Bob Jones"},
+		{name: "unknown key", fp: "QgAov0UZI25hWxnbLiHa00j64/zD1m80UMsSIZtxr2s", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.GetOwnerByFingerprint(tt.fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != tt.want {
+				t.Errorf("GetOwnerByFingerprint() = %q, want %q", got.Name, tt.want)
+			}
+		})
+	}
+}
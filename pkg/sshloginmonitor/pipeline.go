@@ -0,0 +1,250 @@
+package sshloginmonitor
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultBuffer is the number of events a sink can lag behind before it
+// slows the pipeline down.
+const defaultBuffer = 64
+
+// Source emits session events on out until it runs out of events or ctx is
+// cancelled. It must not close out.
+type Source interface {
+	Events(ctx context.Context, out chan<- SessionEvent) error
+}
+
+// Sink consumes session events until events is closed or ctx is cancelled.
+type Sink interface {
+	Consume(ctx context.Context, events <-chan SessionEvent) error
+}
+
+// SessionLister returns the sessions built from the events seen so far.
+// Pipeline and Correlator implement it, so sinks can show the sessions of the
+// pipeline feeding them instead of correlating the events again.
+type SessionLister interface {
+	Sessions() []Session
+}
+
+// Pipeline reads events from its sources, pairs logins with logouts and
+// delivers every event to all its sinks. Each sink runs in its own goroutine
+// with a bounded buffer; a sink that falls behind blocks the pipeline instead
+// of losing events.
+type Pipeline struct {
+	Sources []Source
+	Sinks   []Sink
+	Buffer  int // per-sink buffer size; defaultBuffer if zero
+	// Rules, if set, are evaluated against every event; the alerts they
+	// produce are delivered to the sinks after the event
+	Rules *RuleEngine
+	// Store, if set, stores every event and alert before they are delivered.
+	// Events it already has, replayed when a followed log is read again from
+	// the start, go to Sinks only: Rules and LiveSinks see new events alone,
+	// so alerts and notifications don't fire again on every restart.
+	Store *DBSink
+	// LiveSinks receive the events new to Store and their alerts, or every
+	// event if Store is nil
+	LiveSinks []Sink
+	// LiveSince, if set, is when the monitor started following the log.
+	// Events logged before it are the backlog: they are stored and go to
+	// Sinks, but not to Rules and LiveSinks, even on a first run with an
+	// empty Store.
+	LiveSince time.Time
+
+	correlator *Correlator
+}
+
+// NewPipeline returns a pipeline delivering events from the sources to the sinks.
+func NewPipeline(sources []Source, sinks []Sink) *Pipeline {
+	return &Pipeline{
+		Sources:    sources,
+		Sinks:      sinks,
+		correlator: NewCorrelator(),
+	}
+}
+
+// Sessions returns the sessions built from the events seen so far.
+func (p *Pipeline) Sessions() []Session {
+	return p.correlator.Sessions()
+}
+
+// Run runs the pipeline until all sources are exhausted and the sinks have
+// consumed every event, or until ctx is cancelled. The first error returned
+// by a source or a sink stops the pipeline and is returned.
+func (p *Pipeline) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	buffer := p.Buffer
+	if buffer <= 0 {
+		buffer = defaultBuffer
+	}
+
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		if err != nil {
+			once.Do(func() {
+				firstErr = err
+				cancel()
+			})
+		}
+	}
+
+	merged := make(chan SessionEvent, buffer)
+	var sources sync.WaitGroup
+	for _, source := range p.Sources {
+		sources.Add(1)
+		go func(source Source) {
+			defer sources.Done()
+			fail(source.Events(ctx, merged))
+		}(source)
+	}
+	go func() {
+		sources.Wait()
+		close(merged)
+	}()
+
+	// The channels of the live sinks follow those of the others
+	all := append(append([]Sink{}, p.Sinks...), p.LiveSinks...)
+	channels := make([]chan SessionEvent, len(all))
+	var sinks sync.WaitGroup
+	for i, sink := range all {
+		channels[i] = make(chan SessionEvent, buffer)
+		sinks.Add(1)
+		go func(sink Sink, events <-chan SessionEvent) {
+			defer sinks.Done()
+			fail(sink.Consume(ctx, events))
+		}(sink, channels[i])
+	}
+
+fanout:
+	for event := range merged {
+		event = p.correlator.Process(event)
+		live, err := p.store(event)
+		if err != nil {
+			fail(err)
+			break
+		}
+		live = live && !event.EventTime.Before(p.LiveSince)
+		batch := []SessionEvent{event}
+		if live && p.Rules != nil {
+			for _, alert := range p.Rules.Evaluate(event) {
+				if _, err := p.store(alert); err != nil {
+					fail(err)
+					break fanout
+				}
+				batch = append(batch, alert)
+			}
+		}
+		targets := channels
+		if !live {
+			targets = channels[:len(p.Sinks)]
+		}
+		for _, event := range batch {
+			for _, ch := range targets {
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					break fanout
+				}
+			}
+		}
+	}
+	for _, ch := range channels {
+		close(ch)
+	}
+	sinks.Wait()
+	return firstErr
+}
+
+// store stores the event in Store, if set, and reports whether it is new.
+func (p *Pipeline) store(event SessionEvent) (bool, error) {
+	if p.Store == nil {
+		return true, nil
+	}
+	return p.Store.store(event)
+}
+
+// Correlator pairs logout events with the logins on the same port,
+// builds sessions and fills in the key user of logout events.
+// It is safe for concurrent use.
+type Correlator struct {
+	mu         sync.Mutex
+	sessions   []Session
+	portToUser map[string]string
+}
+
+// NewCorrelator returns an empty Correlator.
+func NewCorrelator() *Correlator {
+	return &Correlator{
+		sessions:   []Session{},
+		portToUser: make(map[string]string),
+	}
+}
+
+// Process adds the event to the sessions and returns it with the key user filled in.
+func (c *Correlator) Process(event SessionEvent) SessionEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	updated, err := processEvent(event, &c.sessions, c.portToUser)
+	if err != nil {
+		log.Println(err)
+		return event
+	}
+	return updated
+}
+
+// Sessions returns a copy of the sessions built so far.
+func (c *Correlator) Sessions() []Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sessions := make([]Session, len(c.sessions))
+	copy(sessions, c.sessions)
+	return sessions
+}
+
+// SessionsBetween returns the sessions that were open at some point between
+// from and to. A zero to means no upper limit.
+func SessionsBetween(sessions []Session, from, to time.Time) []Session {
+	between := make([]Session, 0)
+	for _, session := range sessions {
+		if !session.EndTime.IsZero() && session.EndTime.Before(from) {
+			continue
+		}
+		if !to.IsZero() && session.StartTime.After(to) {
+			continue
+		}
+		between = append(between, session)
+	}
+	return between
+}
+
+// sendEvent sends the event to out unless ctx is cancelled first.
+// It returns false if the event wasn't sent.
+func sendEvent(ctx context.Context, out chan<- SessionEvent, event SessionEvent) bool {
+	select {
+	case out <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// collectEvents runs the source to completion and returns all its events.
+func collectEvents(ctx context.Context, source Source) ([]SessionEvent, error) {
+	out := make(chan SessionEvent)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- source.Events(ctx, out)
+		close(out)
+	}()
+	events := make([]SessionEvent, 0)
+	for event := range out {
+		events = append(events, event)
+	}
+	return events, <-errc
+}
@@ -0,0 +1,240 @@
+package sshloginmonitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const testLog = `Apr 27 10:21:19 deep-rh sshd[1337250]: Accepted publickey for root from 192.168.1.24 port 49090 ssh2: ED25519 SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8
+Apr 27 10:21:22 deep-rh sshd[1337282]: Disconnected from user root 192.168.1.24 port 49090
+Apr 27 10:21:34 deep-rh sshd[1337458]: Accepted publickey for root from 192.168.1.24 port 41254 ssh2: ED25519 SHA256:is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY
+`
+
+// newTestMonitor returns a monitor with a temporary database holding alice's and bob's keys.
+func newTestMonitor(t *testing.T) *Monitor {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := NewMonitor(db, Options{Bucket: "LoginMonitor", UpdateKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make([]User, 0)
+	err = getAuthKeys(strings.NewReader(`ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG8Obx1FsUu1jlYDtzfEDHYSDjG82xE7ysxZVzhgpGC5 alice@fedora
+ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJgclT4eQ5RlYabZfkdjFV5wGrroXxmd5n2X7okmiaN8 bob@fedora`), &users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAccount(users, "root")
+	err = m.addUsersToDB(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestPipeline(t *testing.T) {
+	m := newTestMonitor(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		lines := make([]string, 0)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	file := filepath.Join(t.TempDir(), "events.json")
+	first, second := &CollectSink{}, &CollectSink{}
+	p := NewPipeline(
+		[]Source{NewReaderSource(m, strings.NewReader(testLog))},
+		[]Sink{first, second, NewDBSink(m), &FileSink{Path: file},
+			&NetworkSink{Network: "tcp", Address: listener.Addr().String()}})
+	p.Buffer = 1
+	err = p.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := first.Events()
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3", len(events))
+	}
+	if !reflect.DeepEqual(events, second.Events()) {
+		t.Errorf("sinks got different events: %v and %v", events, second.Events())
+	}
+	if events[1].EventType != "logout" || events[1].KeyUser != "alice@fedora" {
+		t.Errorf("logout event = %v, want key user alice@fedora", events[1])
+	}
+	sessions := p.Sessions()
+	if len(sessions) != 2 || sessions[0].EndTime.IsZero() || !sessions[1].EndTime.IsZero() {
+		t.Errorf("sessions = %v, want one closed and one open session", sessions)
+	}
+
+	stored, err := m.GetEvents(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range events {
+		events[i].ID = uint64(i + 1)
+		// JSON keeps the instant and the offset, not the *time.Location
+		if i < len(stored) && stored[i].EventTime.Equal(events[i].EventTime) {
+			stored[i].EventTime = events[i].EventTime
+		}
+	}
+	if !reflect.DeepEqual(stored, events) {
+		t.Errorf("stored events = %v, want %v", stored, events)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Errorf("file sink wrote %d lines, want 3", len(lines))
+	}
+	var event SessionEvent
+	err = json.Unmarshal([]byte(lines[0]), &event)
+	if err != nil || event.KeyUser != "alice@fedora" {
+		t.Errorf("file sink first line = %s (%v)", lines[0], err)
+	}
+
+	select {
+	case got := <-received:
+		if len(got) != 3 {
+			t.Errorf("network sink sent %d lines, want 3", len(got))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("network sink: nothing received")
+	}
+}
+
+// blockingSink never reads its events.
+type blockingSink struct{}
+
+func (blockingSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	<-ctx.Done()
+	return nil
+}
+
+// endlessSource emits the same event until cancelled.
+type endlessSource struct{}
+
+func (endlessSource) Events(ctx context.Context, out chan<- SessionEvent) error {
+	for sendEvent(ctx, out, SessionEvent{EventType: "login", Port: "22"}) {
+	}
+	return nil
+}
+
+func TestPipelineCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewPipeline([]Source{endlessSource{}}, []Sink{blockingSink{}, &CollectSink{}})
+	p.Buffer = 1
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v, want nil after cancellation", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() didn't return after cancellation")
+	}
+}
+
+func TestSessionsBetween(t *testing.T) {
+	start := time.Date(2023, 4, 27, 10, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+	sessions := []Session{
+		{Port: "ended before", StartTime: at(0), EndTime: at(10)},
+		{Port: "ended inside", StartTime: at(0), EndTime: at(30)},
+		{Port: "inside", StartTime: at(25), EndTime: at(35)},
+		{Port: "open", StartTime: at(5)},
+		{Port: "started after", StartTime: at(50)},
+	}
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []string
+	}{
+		{name: "window", from: at(20), to: at(40), want: []string{"ended inside", "inside", "open"}},
+		{name: "no upper limit", from: at(20), want: []string{"ended inside", "inside", "open", "started after"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]string, 0)
+			for _, session := range SessionsBetween(sessions, tt.from, tt.to) {
+				got = append(got, session.Port)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SessionsBetween() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{4, 40 * time.Second},
+		{5, time.Minute},
+		{50, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.attempts, 5*time.Second, time.Minute); got != tt.want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestQuotedLines(t *testing.T) {
+	m := newTestMonitor(t)
+	// The monitor's own messages can quote sshd lines, e.g. through its journal
+	log := "Apr 27 10:21:20 deep-rh sshlm[4242]: quoting Apr 27 10:21:19 deep-rh sshd[1337250]: Accepted publickey for root " +
+		"from 192.168.1.24 port 49090 ssh2: ED25519 SHA256:5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8\n" +
+		"Apr 27 10:21:21 deep-rh sshlm[4242]: quoting Apr 27 10:21:19 deep-rh sshd[1337250]: Failed password for root " +
+		"from 192.168.1.24 port 49091 ssh2\n"
+	events, err := collectEvents(context.Background(), NewReaderSource(m, strings.NewReader(log)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("got events %v from quoted lines, want none", events)
+	}
+}
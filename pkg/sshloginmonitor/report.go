@@ -0,0 +1,317 @@
+package sshloginmonitor
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Report is an access review of a period: the sessions, summaries per key
+// user and per account, and anomalies worth a closer look.
+type Report struct {
+	Generated time.Time
+	From      time.Time
+	To        time.Time
+	Sessions  []Session
+	KeyUsers  []ReportSummary
+	Accounts  []ReportSummary
+	Anomalies []Anomaly
+	Failures  int
+}
+
+// ReportSummary aggregates the sessions of one key user or one account.
+type ReportSummary struct {
+	Name      string
+	Sessions  int
+	Duration  time.Duration // total; open sessions count until the end of the report
+	Related   []string      // accounts of a key user, key users of an account
+	SourceIPs []string
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// Anomaly is something in the report that needs a closer look.
+type Anomaly struct {
+	Kind    string // "unknown key", "orphaned session" or "failed attempts"
+	Time    time.Time
+	Message string
+}
+
+// BuildReport builds a report from events in the order they happened and
+// the sessions built from them. The report covers the period from the first
+// to the last event; sessions still open at the end count until the last event.
+//
+// Parameters:
+//   - events: login, logout and failure events, correlated by the pipeline
+//     or a Correlator that saw the logins before them
+//   - sessions: the sessions of the period, e.g. from SessionsBetween
+//   - now: the time the report is generated
+//
+// Returns:
+//   - Report: the report
+func BuildReport(events []SessionEvent, sessions []Session, now time.Time) Report {
+	report := Report{Generated: now}
+	failures := make(map[string][]SessionEvent)
+	failureKeys := make([]string, 0)
+	for _, event := range events {
+		if report.From.IsZero() || event.EventTime.Before(report.From) {
+			report.From = event.EventTime
+		}
+		if event.EventTime.After(report.To) {
+			report.To = event.EventTime
+		}
+		switch event.EventType {
+		case "login":
+			if event.KeyUser == UnknownOwner {
+				report.Anomalies = append(report.Anomalies, Anomaly{
+					Kind:    "unknown key",
+					Time:    event.EventTime,
+					Message: fmt.Sprintf("%s logged in from %s with unknown key %s", event.Username, event.SourceIP, event.Fingerprint),
+				})
+			}
+		case "logout":
+			if event.KeyUser == "????" {
+				report.Anomalies = append(report.Anomalies, Anomaly{
+					Kind:    "orphaned session",
+					Time:    event.EventTime,
+					Message: fmt.Sprintf("%s logged out from %s port %s without a recorded login", event.Username, event.SourceIP, event.Port),
+				})
+			}
+		case "failure":
+			report.Failures++
+			key := event.Username + " " + event.SourceIP
+			if _, ok := failures[key]; !ok {
+				failureKeys = append(failureKeys, key)
+			}
+			failures[key] = append(failures[key], event)
+		}
+	}
+	report.Sessions = sessions
+	if len(events) == 0 {
+		report.From, report.To = now, now
+	}
+
+	for _, key := range failureKeys {
+		attempts := failures[key]
+		first, last := attempts[0], attempts[len(attempts)-1]
+		report.Anomalies = append(report.Anomalies, Anomaly{
+			Kind:    "failed attempts",
+			Time:    first.EventTime,
+			Message: fmt.Sprintf("%d failed attempts for %s from %s until %s", len(attempts), first.Username, first.SourceIP, last.EventTime.Format("2006-01-02 15:04:05")),
+		})
+	}
+
+	keyUsers := make(map[string]*ReportSummary)
+	accounts := make(map[string]*ReportSummary)
+	for _, session := range report.Sessions {
+		if session.EndTime.IsZero() {
+			report.Anomalies = append(report.Anomalies, Anomaly{
+				Kind:    "orphaned session",
+				Time:    session.StartTime,
+				Message: fmt.Sprintf("%s (%s) logged in from %s port %s and no logout was recorded", session.Username, session.KeyUser, session.SourceIP, session.Port),
+			})
+		}
+		addToSummary(keyUsers, session.KeyUser, session.Username, session, report.To)
+		addToSummary(accounts, session.Username, session.KeyUser, session, report.To)
+	}
+	report.KeyUsers = sortedSummaries(keyUsers)
+	report.Accounts = sortedSummaries(accounts)
+	sort.SliceStable(report.Anomalies, func(i, j int) bool {
+		return report.Anomalies[i].Time.Before(report.Anomalies[j].Time)
+	})
+	return report
+}
+
+// addToSummary adds the session to the summary of name, creating it if needed.
+// end is used as the end of open sessions.
+func addToSummary(summaries map[string]*ReportSummary, name, related string, session Session, end time.Time) {
+	s, ok := summaries[name]
+	if !ok {
+		s = &ReportSummary{Name: name, FirstSeen: session.StartTime}
+		summaries[name] = s
+	}
+	if !session.EndTime.IsZero() {
+		end = session.EndTime
+	}
+	s.Sessions++
+	s.Duration += end.Sub(session.StartTime)
+	s.Related = appendUnique(s.Related, related)
+	s.SourceIPs = appendUnique(s.SourceIPs, session.SourceIP)
+	if session.StartTime.Before(s.FirstSeen) {
+		s.FirstSeen = session.StartTime
+	}
+	if end.After(s.LastSeen) {
+		s.LastSeen = end
+	}
+}
+
+// sortedSummaries returns the summaries by decreasing number of sessions.
+func sortedSummaries(summaries map[string]*ReportSummary) []ReportSummary {
+	list := make([]ReportSummary, 0, len(summaries))
+	for _, s := range summaries {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Sessions != list[j].Sessions {
+			return list[i].Sessions > list[j].Sessions
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// timelineBar is a session drawn on the SVG timeline.
+type timelineBar struct {
+	X, Y, Width float64
+	Open        bool
+	Title       string
+}
+
+// timelineRow is a key user's row on the SVG timeline.
+type timelineRow struct {
+	Y    float64
+	Name string
+}
+
+const (
+	timelineLabelWidth = 160.0
+	timelineWidth      = 800.0
+	timelineRowHeight  = 22.0
+)
+
+// timeline places the sessions on an SVG timeline with one row per key user.
+func (r Report) timeline() ([]timelineRow, []timelineBar, float64) {
+	rows := make([]timelineRow, 0, len(r.KeyUsers))
+	rowY := make(map[string]float64)
+	for i, s := range r.KeyUsers {
+		y := float64(i)*timelineRowHeight + 30
+		rows = append(rows, timelineRow{Y: y, Name: s.Name})
+		rowY[s.Name] = y
+	}
+	span := r.To.Sub(r.From).Seconds()
+	if span <= 0 {
+		span = 1
+	}
+	bars := make([]timelineBar, 0, len(r.Sessions))
+	for _, session := range r.Sessions {
+		end := session.EndTime
+		if end.IsZero() {
+			end = r.To
+		}
+		x := timelineLabelWidth + session.StartTime.Sub(r.From).Seconds()/span*timelineWidth
+		width := end.Sub(session.StartTime).Seconds() / span * timelineWidth
+		if width < 2 {
+			width = 2 // keep short sessions visible
+		}
+		bars = append(bars, timelineBar{
+			X:     x,
+			Y:     rowY[session.KeyUser] - 14,
+			Width: width,
+			Open:  session.EndTime.IsZero(),
+			Title: fmt.Sprintf("%s as %s from %s, %s - %s", session.KeyUser, session.Username, session.SourceIP,
+				session.StartTime.Format("2006-01-02 15:04:05"), end.Format("2006-01-02 15:04:05")),
+		})
+	}
+	height := float64(len(rows))*timelineRowHeight + 40
+	return rows, bars, height
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"duration": func(d time.Duration) string {
+		return d.Truncate(time.Second).String()
+	},
+	"session": func(s Session, now time.Time) string {
+		if s.EndTime.IsZero() {
+			return now.Sub(s.StartTime).Truncate(time.Second).String() + " (open)"
+		}
+		return s.EndTime.Sub(s.StartTime).String()
+	},
+	"join": func(list []string) string {
+		return strings.Join(list, ", ")
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>SSH access report {{date .From}} - {{date .To}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; font-size: 0.9em; }
+th { background: #f0f0f0; }
+.anomaly { color: #a00; }
+svg text { font-size: 12px; font-family: sans-serif; }
+</style>
+</head>
+<body>
+<h1>SSH access report</h1>
+<p>Period: {{date .From}} - {{date .To}}. Generated {{date .Generated}}.
+{{len .Sessions}} sessions, {{.Failures}} failed attempts, {{len .Anomalies}} anomalies.</p>
+
+<h2>Anomalies</h2>
+{{if .Anomalies}}<table>
+<tr><th>Time</th><th>Kind</th><th>Details</th></tr>
+{{range .Anomalies}}<tr class="anomaly"><td>{{date .Time}}</td><td>{{.Kind}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+
+<h2>Timeline</h2>
+{{$report := .}}{{with .Timeline}}<svg xmlns="http://www.w3.org/2000/svg" width="970" height="{{.Height}}">
+<text x="160" y="14">{{date $report.From}}</text>
+<text x="960" y="14" text-anchor="end">{{date $report.To}}</text>
+{{range .Rows}}<text x="0" y="{{.Y}}">{{.Name}}</text>
+<line x1="160" x2="960" y1="{{.Y}}" y2="{{.Y}}" stroke="#eee"/>
+{{end}}{{range .Bars}}<rect x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="16" fill="{{if .Open}}#e8a33d{{else}}#4a7fb5{{end}}"><title>{{.Title}}</title></rect>
+{{end}}</svg>{{end}}
+
+<h2>Key users</h2>
+<table>
+<tr><th>Key user</th><th>Sessions</th><th>Total time</th><th>Accounts</th><th>Source IPs</th><th>First seen</th><th>Last seen</th></tr>
+{{range .KeyUsers}}<tr><td>{{.Name}}</td><td>{{.Sessions}}</td><td>{{duration .Duration}}</td><td>{{join .Related}}</td><td>{{join .SourceIPs}}</td><td>{{date .FirstSeen}}</td><td>{{date .LastSeen}}</td></tr>
+{{end}}</table>
+
+<h2>Accounts</h2>
+<table>
+<tr><th>Account</th><th>Sessions</th><th>Total time</th><th>Key users</th><th>Source IPs</th><th>First seen</th><th>Last seen</th></tr>
+{{range .Accounts}}<tr><td>{{.Name}}</td><td>{{.Sessions}}</td><td>{{duration .Duration}}</td><td>{{join .Related}}</td><td>{{join .SourceIPs}}</td><td>{{date .FirstSeen}}</td><td>{{date .LastSeen}}</td></tr>
+{{end}}</table>
+
+<h2>Sessions</h2>
+<table>
+<tr><th>Account</th><th>Key user</th><th>Source IP</th><th>Port</th><th>Start</th><th>End</th><th>Duration</th></tr>
+{{range .Sessions}}<tr><td>{{.Username}}</td><td>{{.KeyUser}}</td><td>{{.SourceIP}}</td><td>{{.Port}}</td><td>{{date .StartTime}}</td><td>{{date .EndTime}}</td><td>{{session . $report.To}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// WriteHTML writes the report as a single HTML file with no external resources.
+//
+// Parameters:
+//   - w: the writer to write the HTML to
+//
+// Returns:
+//   - error: an error if the report can't be written
+func (r Report) WriteHTML(w io.Writer) error {
+	rows, bars, height := r.timeline()
+	data := struct {
+		Report
+		Timeline struct {
+			Rows   []timelineRow
+			Bars   []timelineBar
+			Height float64
+		}
+	}{Report: r}
+	data.Timeline.Rows = rows
+	data.Timeline.Bars = bars
+	data.Timeline.Height = height
+	return reportTemplate.Execute(w, data)
+}
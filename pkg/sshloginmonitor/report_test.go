@@ -0,0 +1,79 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildReport(t *testing.T) {
+	start := time.Date(2023, 4, 27, 10, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+	events := []SessionEvent{
+		{EventType: "login", EventTime: at(0), Username: "root", SourceIP: "192.168.1.24", Port: "1000", KeyUser: "alice@fedora"},
+		{EventType: "logout", EventTime: at(10), Username: "root", SourceIP: "192.168.1.24", Port: "1000", KeyUser: "????"},
+		{EventType: "login", EventTime: at(20), Username: "deploy", SourceIP: "192.168.1.25", Port: "2000", KeyUser: "alice@fedora"},
+		{EventType: "login", EventTime: at(30), Username: "root", SourceIP: "10.0.0.7", Port: "3000", KeyUser: UnknownOwner, Fingerprint: "abc"},
+		{EventType: "logout", EventTime: at(35), Username: "root", SourceIP: "10.0.0.7", Port: "3000", KeyUser: "????"},
+		{EventType: "logout", EventTime: at(40), Username: "root", SourceIP: "10.0.0.8", Port: "4000", KeyUser: "????"},
+		{EventType: "failure", EventTime: at(50), Username: "admin", SourceIP: "10.0.0.9", Port: "5000", AuthMethod: "password"},
+		{EventType: "failure", EventTime: at(51), Username: "admin", SourceIP: "10.0.0.9", Port: "5001", AuthMethod: "password"},
+		{EventType: "failure", EventTime: at(60), Username: "root", SourceIP: "10.0.0.9", Port: "5002", AuthMethod: "password"},
+	}
+	correlator := NewCorrelator()
+	for i, event := range events {
+		events[i] = correlator.Process(event)
+	}
+	report := BuildReport(events, correlator.Sessions(), at(120))
+
+	if !report.From.Equal(at(0)) || !report.To.Equal(at(60)) {
+		t.Errorf("BuildReport() period = %v - %v, want %v - %v", report.From, report.To, at(0), at(60))
+	}
+	if len(report.Sessions) != 3 || report.Failures != 3 {
+		t.Errorf("BuildReport() has %d sessions and %d failures, want 3 and 3", len(report.Sessions), report.Failures)
+	}
+	kinds := make([]string, 0)
+	for _, a := range report.Anomalies {
+		kinds = append(kinds, a.Kind)
+	}
+	wantKinds := []string{"orphaned session", "unknown key", "orphaned session", "failed attempts", "failed attempts"}
+	if !reflect.DeepEqual(kinds, wantKinds) {
+		t.Errorf("BuildReport() anomalies = %v, want %v", kinds, wantKinds)
+	}
+	wantAlice := ReportSummary{
+		Name:      "alice@fedora",
+		Sessions:  2,
+		Duration:  50 * time.Minute, // 10 minutes, and 40 for the session still open at the end
+		Related:   []string{"root", "deploy"},
+		SourceIPs: []string{"192.168.1.24", "192.168.1.25"},
+		FirstSeen: at(0),
+		LastSeen:  at(60),
+	}
+	if !reflect.DeepEqual(report.KeyUsers[0], wantAlice) {
+		t.Errorf("BuildReport() key user = %+v, want %+v", report.KeyUsers[0], wantAlice)
+	}
+	if len(report.Accounts) != 2 || report.Accounts[0].Name != "root" || report.Accounts[0].Sessions != 2 {
+		t.Errorf("BuildReport() accounts = %+v", report.Accounts)
+	}
+
+	var buf bytes.Buffer
+	err := report.WriteHTML(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, want := range []string{"<svg", "alice@fedora", "2 failed attempts for admin from 10.0.0.9", "unknown key abc", "(open)"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("WriteHTML() doesn't contain %q", want)
+		}
+	}
+	for _, notWant := range []string{"<script", "http://", "https://"} {
+		if strings.Contains(strings.ReplaceAll(html, `xmlns="http://www.w3.org/2000/svg"`, ""), notWant) {
+			t.Errorf("WriteHTML() contains %q, the report must be self-contained", notWant)
+		}
+	}
+}
@@ -1,29 +1,36 @@
 package sshloginmonitor
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"regexp"
 	"time"
-
-	"github.com/coreos/go-systemd/sdjournal"
-	"github.com/fsnotify/fsnotify"
-	"github.com/pavelanni/ssh-login-monitor/pkg/config"
-	"github.com/rs/zerolog"
-	bolt "go.etcd.io/bbolt"
 )
 
 type SessionEvent struct {
+	// ID is the sequence number of the event in the database; it is zero
+	// for events that weren't read from the database
+	ID        uint64    `json:"id,omitempty"`
 	EventType string    `json:"event_type"`
 	EventTime time.Time `json:"event_time"`
 	Username  string    `json:"username"`
 	SourceIP  string    `json:"source_ip"`
 	Port      string    `json:"port"`
 	KeyUser   string    `json:"key_user"`
+	KeyEmail  string    `json:"key_email,omitempty"`
+	KeyTeam   string    `json:"key_team,omitempty"`
+	// Fingerprint is the SHA256 fingerprint of the key used to log in
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// AuthMethod is the authentication method of a failed attempt, e.g. "password"
+	AuthMethod string `json:"auth_method,omitempty"`
+	// Host and PID are the host name and sshd process ID of the log line,
+	// which together with the time, port and type identify the event
+	Host string `json:"host,omitempty"`
+	PID  string `json:"pid,omitempty"`
+	// Alert is set on events of type "alert", produced by alert rules
+	Alert *Alert `json:"alert,omitempty"`
 }
 
 type Session struct {
@@ -33,122 +40,26 @@ type Session struct {
 	StartTime time.Time `json:"start_time"`
 	EndTime   time.Time `json:"end_time"`
 	KeyUser   string    `json:"key_user"`
+	KeyEmail  string    `json:"key_email,omitempty"`
+	KeyTeam   string    `json:"key_team,omitempty"`
 }
 
-// LogToEvents takes a filename string and a pointer to a slice of User structs.
-// It returns a slice of SessionEvent structs and an error. This function reads
-// a log file, parses each line, and creates SessionEvent structs based on the
-// contents of each line. The SessionEvent structs are returned in a slice.
+// LogToEvents reads a log, parses each line, and creates SessionEvent structs
+// based on the contents of each line, with the key users from the monitor's
+// database. The SessionEvent structs are returned in a slice.
 //
 // Parameters:
-//   - filename: string representing the path to the log file to be read
-//
-// users - pointer to a slice of User structs to be used when creating SessionEvent
-// structs
+//   - reader: the log in /var/log/secure format
 //
 // Returns:
 //   - ([]SessionEvent): a slice of SessionEvent structs and an error, if it occurs
-func LogToEvents(reader io.Reader, db *bolt.DB, bucket string) ([]SessionEvent, error) {
-	events := make([]SessionEvent, 0)
-
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
-
-		event, err := getLogEvent(line, db, bucket)
-		if err != nil {
-			return nil, err
-		}
-		if event == (SessionEvent{}) {
-			continue
-		}
-		events = append(events, event)
-	}
-	return events, nil
-}
-
-func JournalToEvents(ctx context.Context, db *bolt.DB, bucket string) error {
-	sessions := &[]Session{}
-	portToUser := make(map[string]string)
-
-	//logger := zerolog.New(os.Stderr).With().Logger()
-	consoleLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, NoColor: false})
-
-	j, err := sdjournal.NewJournal()
+func (m *Monitor) LogToEvents(reader io.Reader) ([]SessionEvent, error) {
+	source := NewReaderSource(m, reader)
+	events, err := collectEvents(context.Background(), source)
 	if err != nil {
-		return err
-	}
-	defer j.Close()
-
-	// Match by SYSLOG_IDENTIFIER
-	err = j.AddMatch("SYSLOG_IDENTIFIER=sshd")
-	if err != nil {
-		return err
-	}
-
-	// Start at the beginning of the journal
-	err = j.SeekHead()
-	if err != nil {
-		return err
-	}
-
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
-			n, err := j.Next()
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			if n == 0 {
-				// No new entries, wait for new ones if "follow" is set
-				if config.K.Bool("follow") {
-					j.Wait(sdjournal.IndefiniteWait)
-					continue
-				} else {
-					return nil
-				}
-			}
-			entry, err := j.GetEntry()
-			if err != nil {
-				return err
-			}
-			if _, ok := entry.Fields["MESSAGE"]; ok {
-				line := fmt.Sprintf("%s %s %s[%s]: %s", // reproduce format of journalctl output; should be refactored
-					entry.Fields["SYSLOG_TIMESTAMP"],
-					entry.Fields["_HOSTNAME"],
-					entry.Fields["SYSLOG_IDENTIFIER"],
-					entry.Fields["_PID"],
-					entry.Fields["MESSAGE"],
-				)
-				event, err := getLogEvent(line, db, bucket)
-				if err != nil {
-					return err
-				}
-				if event == (SessionEvent{}) {
-					continue
-				}
-				event, err = processEvent(event, sessions, portToUser)
-				if err != nil {
-					return err
-				}
-				consoleLogger.Info().
-					Str("event time", event.EventTime.String()).
-					Str("event type", event.EventType).
-					Str("username", event.Username).
-					Str("source ip", event.SourceIP).
-					Str("port", event.Port).
-					Str("key user", event.KeyUser).
-					Msg("ssh event")
-				// PrintEvent(event, config.K.Bool("color"))
-			}
-		}
+		return nil, err
 	}
+	return events, nil
 }
 
 // EventsToSessions converts a slice of SessionEvent into a slice of Session.
@@ -175,76 +86,40 @@ func EventsToSessions(events *[]SessionEvent) []Session {
 	return sessions
 }
 
-// WatchLog watches the logFile for login events and logs them to the output.
-func WatchLog(ctx context.Context, input *os.File, db *bolt.DB, bucket string, sessions *[]Session) error {
-	portToUser := make(map[string]string)
-
-	var offset int64
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
-	}
-	defer watcher.Close()
-
-	err = watcher.Add(input.Name())
-	if err != nil {
-		return err
-	}
-
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case event := <-watcher.Events:
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				_, err := input.Seek(offset, io.SeekStart)
-				if err != nil {
-					return err
-				}
-				scanner := bufio.NewScanner(input)
-
-				for scanner.Scan() {
-					line := scanner.Text()
-					logEvent, err := getLogEvent(line, db, bucket)
-					if err != nil {
-						return err
-					}
-
-					if (logEvent == SessionEvent{}) {
-						continue
-					}
-					logEvent, err = processEvent(logEvent, sessions, portToUser)
-					if err != nil {
-						log.Println(err)
-					}
-					PrintEvent(logEvent, config.K.Bool("color"))
-					offset, _ = input.Seek(0, io.SeekCurrent)
-				}
-			}
-		case err := <-watcher.Errors:
-			return err
-		}
-	}
+// parseLogTime parses the date and time of a log line. Syslog timestamps
+// have neither a year nor a time zone: they are local times of this year.
+func parseLogTime(date, clock string) (time.Time, error) {
+	return time.ParseInLocation("2006 Jan 02 15:04:05", fmt.Sprintf("%d %s %s", time.Now().Year(), date, clock), time.Local)
 }
 
-func getLogEvent(line string, db *bolt.DB, bucket string) (SessionEvent, error) {
+// reLogHeader matches the host name and process ID at the start of a log line.
+var reLogHeader = regexp.MustCompile(`^[A-Z][a-z]{2} +[0-9]{1,2} [0-9]{2}:[0-9]{2}:[0-9]{2} (\S+) [^\s\[]+\[([0-9]+)\]:`)
+
+func (m *Monitor) getLogEvent(line string) (SessionEvent, error) {
 	// regexp for login pattern
 	reLogin := regexp.MustCompile(`Accepted publickey for `)
 	// regexp for logout pattern
 	reLogout := regexp.MustCompile(`Disconnected from user `)
-	reParseLogin := regexp.MustCompile(`(?P<date>[A-Z][a-z]{2} [0-9]{2}) (?P<time>[0-9]{2}:[0-9]{2}:[0-9]{2})` +
-		`.*Accepted publickey for (?P<username>[a-zA-Z0-9_]*) from (?P<loginIP>[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}) ` +
+	// The messages must follow the log header, so a line quoted in another
+	// message isn't parsed again
+	reParseLogin := regexp.MustCompile(`^(?P<date>[A-Z][a-z]{2} [0-9]{2}) (?P<time>[0-9]{2}:[0-9]{2}:[0-9]{2})` +
+		` \S+ [^\s\[]+\[[0-9]+\]: Accepted publickey for (?P<username>[a-zA-Z0-9_]*) from (?P<loginIP>[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}) ` +
 		`port (?P<port>[0-9]{1,6})` +
-		`.* SHA256:(?P<fingerprint>[a-zA-Z0-9+\/]*$)`)
-	reParseLogout := regexp.MustCompile(`(?P<date>[A-Z][a-z]{2} [0-9]{2}) (?P<time>[0-9]{2}:[0-9]{2}:[0-9]{2})` +
-		`.*Disconnected from user (?P<username>[a-zA-Z0-9_]*) (?P<loginIP>[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}) ` +
+		`.* (?:SHA256:(?P<fingerprint>[a-zA-Z0-9+\/]+)|(?P<md5>(?:MD5:)?[0-9a-f]{2}(?::[0-9a-f]{2}){15}))$`)
+	reParseLogout := regexp.MustCompile(`^(?P<date>[A-Z][a-z]{2} [0-9]{2}) (?P<time>[0-9]{2}:[0-9]{2}:[0-9]{2})` +
+		` \S+ [^\s\[]+\[[0-9]+\]: Disconnected from user (?P<username>[a-zA-Z0-9_]*) (?P<loginIP>[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}) ` +
 		`port (?P<port>[0-9]{1,6})`)
+	// regexp for failed attempts, which are logged for existing and invalid users
+	reParseFailure := regexp.MustCompile(`^(?P<date>[A-Z][a-z]{2} [0-9]{2}) (?P<time>[0-9]{2}:[0-9]{2}:[0-9]{2})` +
+		` \S+ [^\s\[]+\[[0-9]+\]: Failed (?P<method>[a-z-]+) for (?:invalid user )?(?P<username>[a-zA-Z0-9_.-]*) ` +
+		`from (?P<loginIP>[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}.[0-9]{1,3}) port (?P<port>[0-9]{1,6})`)
 
 	event := SessionEvent{}
 
 	if reLogin.MatchString(line) {
 		match := reParseLogin.FindStringSubmatch(line)
 		if match == nil {
+			m.parseErrors.Add(1)
 			return SessionEvent{}, nil
 		}
 		result := make(map[string]string)
@@ -253,17 +128,21 @@ func getLogEvent(line string, db *bolt.DB, bucket string) (SessionEvent, error)
 				result[name] = match[i]
 			}
 		}
-		eventTime, err := time.Parse("2006 Jan 02 15:04:05",
-			fmt.Sprintf("%d ", time.Now().Year())+result["date"]+" "+result["time"])
+		eventTime, err := parseLogTime(result["date"], result["time"])
 		if err != nil {
 			return SessionEvent{}, err
 		}
-		keyUser, err := GetUserByFingerprint(result["fingerprint"], db, bucket)
+		fingerprint := result["fingerprint"]
+		if fingerprint == "" { // old sshd versions log MD5 fingerprints
+			fingerprint = result["md5"]
+		}
+		owner, err := m.GetOwnerByFingerprint(fingerprint)
 		if err != nil {
 			return SessionEvent{}, err
 		}
-		if keyUser == "" {
-			log.Println("key user not found in line " + line)
+		if owner.Name == "" {
+			log.Printf("key owner not found for the key of %s from %s port %s", result["username"], result["loginIP"], result["port"])
+			owner.Name = UnknownOwner
 		}
 		event = SessionEvent{
 			EventType: "login",
@@ -271,12 +150,17 @@ func getLogEvent(line string, db *bolt.DB, bucket string) (SessionEvent, error)
 			Username:  result["username"],
 			SourceIP:  result["loginIP"],
 			Port:      result["port"],
-			KeyUser:   keyUser,
+			KeyUser:   owner.Name,
+			KeyEmail:  owner.Email,
+			KeyTeam:   owner.Team,
+
+			Fingerprint: owner.Fingerprint,
 		}
 	}
 	if reLogout.MatchString(line) {
 		match := reParseLogout.FindStringSubmatch(line)
 		if match == nil {
+			m.parseErrors.Add(1)
 			return SessionEvent{}, nil
 		}
 		result := make(map[string]string)
@@ -285,9 +169,7 @@ func getLogEvent(line string, db *bolt.DB, bucket string) (SessionEvent, error)
 				result[name] = match[i]
 			}
 		}
-		d := result["date"]
-		t := result["time"]
-		eventTime, err := time.Parse("2006 Jan 02 15:04:05", fmt.Sprintf("%d ", time.Now().Year())+d+" "+t)
+		eventTime, err := parseLogTime(result["date"], result["time"])
 		if err != nil {
 			return SessionEvent{}, err
 		}
@@ -300,9 +182,56 @@ func getLogEvent(line string, db *bolt.DB, bucket string) (SessionEvent, error)
 			Port:      result["port"],
 		}
 	}
+	if match := reParseFailure.FindStringSubmatch(line); match != nil {
+		result := make(map[string]string)
+		for i, name := range reParseFailure.SubexpNames() {
+			if i != 0 {
+				result[name] = match[i]
+			}
+		}
+		eventTime, err := parseLogTime(result["date"], result["time"])
+		if err != nil {
+			return SessionEvent{}, err
+		}
+		event = SessionEvent{
+			EventType:  "failure",
+			EventTime:  eventTime,
+			Username:   result["username"],
+			SourceIP:   result["loginIP"],
+			Port:       result["port"],
+			AuthMethod: result["method"],
+		}
+	}
+	if event != (SessionEvent{}) {
+		if match := reLogHeader.FindStringSubmatch(line); match != nil {
+			event.Host, event.PID = match[1], match[2]
+		}
+	}
 	return event, nil
 }
 
+// reOfferedKey matches the line AuthorizedKeysCommand logs for an offered key.
+var reOfferedKey = regexp.MustCompile(`^(?P<date>[A-Z][a-z]{2} [0-9]{2}) (?P<time>[0-9]{2}:[0-9]{2}:[0-9]{2})` +
+	` \S+ ` + OfferedKeyIdentifier + `\[[0-9]+\]: offered key (?P<fingerprint>\S+) for (?P<account>\S+)$`)
+
+// recordOfferedKey records the offered key logged in the line, if any, and
+// reports whether the line was an offered key. Offers are only recorded while
+// following the log, so parsing a log doesn't change the database.
+func (m *Monitor) recordOfferedKey(line string) (bool, error) {
+	match := reOfferedKey.FindStringSubmatch(line)
+	if match == nil {
+		return false, nil
+	}
+	if !m.opts.Follow {
+		return true, nil
+	}
+	eventTime, err := parseLogTime(match[1], match[2])
+	if err != nil {
+		return true, err
+	}
+	return true, m.RecordOfferedKey(eventTime, match[4], match[3])
+}
+
 // processEvent updated []sessions and returns the updated event
 // where user is replaced with the actual user based on the sessions database
 func processEvent(event SessionEvent, sessions *[]Session, portToUser map[string]string) (SessionEvent, error) {
@@ -314,6 +243,8 @@ func processEvent(event SessionEvent, sessions *[]Session, portToUser map[string
 			SourceIP:  event.SourceIP,
 			StartTime: event.EventTime,
 			KeyUser:   event.KeyUser,
+			KeyEmail:  event.KeyEmail,
+			KeyTeam:   event.KeyTeam,
 		}
 		*sessions = append(*sessions, session)
 		return event, nil
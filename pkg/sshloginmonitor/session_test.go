@@ -2,7 +2,6 @@ package sshloginmonitor
 
 import (
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"reflect"
@@ -15,22 +14,14 @@ import (
 )
 
 func TestLogToEvents(t *testing.T) {
-	time1, err := time.Parse("2006 Jan 02 15:04:05", fmt.Sprintf("%d ", time.Now().Year())+"Apr 27 10:21:19")
-	if err != nil {
-		t.Fatal(err)
-	}
-	time2, err := time.Parse("2006 Jan 02 15:04:05", fmt.Sprintf("%d ", time.Now().Year())+"Apr 27 10:21:34")
-	if err != nil {
-		t.Fatal(err)
-	}
-	time3, err := time.Parse("2006 Jan 02 15:04:05", fmt.Sprintf("%d ", time.Now().Year())+"Apr 27 10:21:22")
-	if err != nil {
-		t.Fatal(err)
-	}
-	time4, err := time.Parse("2006 Jan 02 15:04:05", fmt.Sprintf("%d ", time.Now().Year())+"Apr 27 10:21:37")
-	if err != nil {
-		t.Fatal(err)
+	// Log timestamps are local times of this year
+	at := func(hour, min, sec int) time.Time {
+		return time.Date(time.Now().Year(), time.April, 27, hour, min, sec, 0, time.Local)
 	}
+	time1 := at(10, 21, 19)
+	time2 := at(10, 21, 34)
+	time3 := at(10, 21, 22)
+	time4 := at(10, 21, 37)
 
 	db, err := bolt.Open("../../fingerprints.db", 0400, nil)
 	if err != nil {
@@ -85,6 +76,10 @@ Apr 27 10:21:34 deep-rh sshd[1337458]: pam_unix(sshd:session): session opened fo
 					Username:  "root",
 					SourceIP:  "192.168.1.24",
 					Port:      "49090",
+					Host:      "deep-rh",
+					PID:       "1337250",
+
+					Fingerprint: "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8",
 				},
 				{
 					EventTime: time2,
@@ -93,6 +88,10 @@ Apr 27 10:21:34 deep-rh sshd[1337458]: pam_unix(sshd:session): session opened fo
 					Username:  "root",
 					SourceIP:  "192.168.1.24",
 					Port:      "41254",
+					Host:      "deep-rh",
+					PID:       "1337458",
+
+					Fingerprint: "is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY",
 				},
 			},
 			wantErr: nil,
@@ -122,6 +121,8 @@ Apr 27 10:21:37 deep-rh sshd[1337458]: pam_unix(sshd:session): session closed fo
 					KeyUser:   "????",
 					SourceIP:  "192.168.1.24",
 					Port:      "49090",
+					Host:      "deep-rh",
+					PID:       "1337282",
 				},
 				{
 					EventTime: time4,
@@ -130,6 +131,43 @@ Apr 27 10:21:37 deep-rh sshd[1337458]: pam_unix(sshd:session): session closed fo
 					KeyUser:   "????",
 					SourceIP:  "192.168.1.24",
 					Port:      "41254",
+					Host:      "deep-rh",
+					PID:       "1337493",
+				},
+			},
+			wantErr: nil,
+		},
+		{
+			name: "failed attempts",
+			args: args{
+				reader: strings.NewReader(
+					`Apr 27 10:21:19 deep-rh sshd[1337250]: Failed password for root from 192.168.1.24 port 49090 ssh2
+Apr 27 10:21:22 deep-rh sshd[1337282]: Invalid user admin from 10.0.0.7 port 41254
+Apr 27 10:21:22 deep-rh sshd[1337282]: Failed publickey for invalid user admin from 10.0.0.7 port 41254 ssh2: RSA SHA256:is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY
+`),
+				db:     db,
+				bucket: bucket,
+			},
+			want: []SessionEvent{
+				{
+					EventTime:  time1,
+					EventType:  "failure",
+					Username:   "root",
+					SourceIP:   "192.168.1.24",
+					Port:       "49090",
+					AuthMethod: "password",
+					Host:       "deep-rh",
+					PID:        "1337250",
+				},
+				{
+					EventTime:  time3,
+					EventType:  "failure",
+					Username:   "admin",
+					SourceIP:   "10.0.0.7",
+					Port:       "41254",
+					AuthMethod: "publickey",
+					Host:       "deep-rh",
+					PID:        "1337282",
 				},
 			},
 			wantErr: nil,
@@ -159,7 +197,10 @@ Apr 27 10:21:37 deep-rh sshd[1337458]: pam_unix(sshd:session): session closed fo
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := LogToEvents(tt.args.reader, tt.args.db, tt.args.bucket)
+			// The database is part of the repository: read it without NewMonitor,
+			// which writes to it
+			m := &Monitor{db: tt.args.db, opts: Options{Bucket: tt.args.bucket}}
+			got, err := m.LogToEvents(tt.args.reader)
 			if err != nil {
 				if err.Error() != tt.wantErr.Error() {
 					t.Errorf("LogToEvents() error = %v, wantErr %v", err, tt.wantErr)
@@ -0,0 +1,385 @@
+package sshloginmonitor
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// retryBackoff returns the delay before the retry following the given
+// attempt: delay, doubled on each attempt, up to max.
+func retryBackoff(attempts int, delay, max time.Duration) time.Duration {
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// httpStatusError is an HTTP response with an unexpected status.
+type httpStatusError struct {
+	status int
+	body   string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s: %s", http.StatusText(e.status), e.body)
+}
+
+// permanent reports whether retrying can't help: a client error other than
+// a timeout or rate limiting.
+func (e *httpStatusError) permanent() bool {
+	return e.status >= 400 && e.status < 500 &&
+		e.status != http.StatusRequestTimeout && e.status != http.StatusTooManyRequests
+}
+
+// consume calls handle for every event until events is closed or ctx is
+// cancelled. It is the loop shared by the sinks that handle events one by one.
+func consume(ctx context.Context, events <-chan SessionEvent, handle func(SessionEvent) error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			err := handle(event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ConsoleSink prints events to the console in the "log" output format.
+type ConsoleSink struct {
+	m *Monitor
+}
+
+// NewConsoleSink returns a Sink printing events with the monitor's theme.
+func NewConsoleSink(m *Monitor) *ConsoleSink {
+	return &ConsoleSink{m: m}
+}
+
+// Consume implements Sink.
+func (s *ConsoleSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	return consume(ctx, events, func(event SessionEvent) error {
+		s.m.PrintEvent(event)
+		return nil
+	})
+}
+
+// LoggerSink logs events as zerolog console lines, which is how events read
+// from the journal have always been reported.
+type LoggerSink struct {
+	logger zerolog.Logger
+}
+
+// NewLoggerSink returns a Sink logging events to w.
+func NewLoggerSink(w io.Writer) *LoggerSink {
+	return &LoggerSink{logger: zerolog.New(zerolog.ConsoleWriter{Out: w, NoColor: false})}
+}
+
+// Consume implements Sink.
+func (s *LoggerSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	return consume(ctx, events, func(event SessionEvent) error {
+		if event.Alert != nil {
+			s.logger.Warn().
+				Str("event time", event.EventTime.String()).
+				Str("rule", event.Alert.Rule).
+				Str("severity", event.Alert.Severity).
+				Str("username", event.Username).
+				Str("source ip", event.SourceIP).
+				Str("key user", event.KeyUser).
+				Msg(event.Alert.Message)
+			return nil
+		}
+		s.logger.Info().
+			Str("event time", event.EventTime.String()).
+			Str("event type", event.EventType).
+			Str("username", event.Username).
+			Str("source ip", event.SourceIP).
+			Str("port", event.Port).
+			Str("key user", event.KeyUser).
+			Msg("ssh event")
+		return nil
+	})
+}
+
+// FileSink appends events to a file, one per line, as JSON or with Encoder.
+type FileSink struct {
+	Path    string
+	Encoder Encoder // JSON if nil
+}
+
+// Consume implements Sink.
+func (s *FileSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return consume(ctx, events, func(event SessionEvent) error {
+		data, err := encodeEvent(s.Encoder, event)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// DBSink stores events in the database and adds logins to the key login history.
+// If Stream is set, new events are published to it with their IDs.
+type DBSink struct {
+	Stream *EventStream
+
+	m *Monitor
+}
+
+// NewDBSink returns a Sink storing events in the monitor's database.
+func NewDBSink(m *Monitor) *DBSink {
+	return &DBSink{m: m}
+}
+
+// Consume implements Sink.
+func (s *DBSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	return consume(ctx, events, func(event SessionEvent) error {
+		_, err := s.store(event)
+		return err
+	})
+}
+
+// store stores the event and reports whether it is new.
+func (s *DBSink) store(event SessionEvent) (bool, error) {
+	id, stored, err := s.m.storeEvent(event)
+	if err != nil {
+		return false, err
+	}
+	err = s.m.RecordKeyUsage([]SessionEvent{event})
+	if err != nil {
+		return false, err
+	}
+	if stored && s.Stream != nil {
+		event.ID = id
+		s.Stream.Publish(event)
+	}
+	return stored, nil
+}
+
+// NetworkSink sends events as newline-delimited JSON, or lines of Encoder,
+// over TCP or UDP, reconnecting when a write fails.
+type NetworkSink struct {
+	Network   string // "tcp" or "udp"
+	Address   string // host:port
+	Timeout   time.Duration
+	TLSConfig *tls.Config // if set, TCP connections use TLS
+	Encoder   Encoder     // JSON if nil
+
+	conn net.Conn
+}
+
+// Consume implements Sink.
+func (s *NetworkSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+	return consume(ctx, events, func(event SessionEvent) error {
+		data, err := encodeEvent(s.Encoder, event)
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		// Try twice: the first write may fail on a connection the peer has closed
+		for attempt := 0; attempt < 2; attempt++ {
+			err = s.write(ctx, data)
+			if err == nil {
+				return nil
+			}
+		}
+		log.Printf("%s sink %s: event dropped: %s", s.Network, s.Address, err)
+		return nil
+	})
+}
+
+// write sends data, dialing a new connection if there is none.
+func (s *NetworkSink) write(ctx context.Context, data []byte) error {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	if s.conn != nil && s.Network != "udp" && peerClosed(s.conn) {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: timeout}
+		var conn net.Conn
+		var err error
+		if s.TLSConfig != nil {
+			conn, err = (&tls.Dialer{NetDialer: dialer, Config: s.TLSConfig}).DialContext(ctx, s.Network, s.Address)
+		} else {
+			conn, err = dialer.DialContext(ctx, s.Network, s.Address)
+		}
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := s.conn.Write(data)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// CollectSink keeps the events it receives in memory.
+type CollectSink struct {
+	mu     sync.Mutex
+	events []SessionEvent
+}
+
+// Consume implements Sink.
+func (s *CollectSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	return consume(ctx, events, func(event SessionEvent) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.events = append(s.events, event)
+		return nil
+	})
+}
+
+// Events returns the events collected so far.
+func (s *CollectSink) Events() []SessionEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]SessionEvent, len(s.events))
+	copy(events, s.events)
+	return events
+}
+
+// NewOutputSink returns a Sink printing events to w as they arrive in the
+// given output format: "log" prints one line per event, "json" prints
+// newline-delimited JSON, "csv" prints a header and one row per event,
+// "cef", "leef" and "ecs" print one record per event (see NewEncoder), and
+// "sum" keeps redrawing a table of the open sessions listed by sessions,
+// usually the pipeline feeding the sink.
+func NewOutputSink(m *Monitor, format string, w io.Writer, sessions SessionLister) (Sink, error) {
+	switch format {
+	case "log":
+		return NewConsoleSink(m), nil
+	case "json":
+		enc := json.NewEncoder(w)
+		return sinkFunc(func(event SessionEvent) error {
+			return enc.Encode(event)
+		}), nil
+	case "csv":
+		return &csvSink{w: csv.NewWriter(w)}, nil
+	case "sum":
+		return &liveSummarySink{m: m, w: w, sessions: sessions, refresh: time.Second}, nil
+	case "cef", "leef", "ecs":
+		enc, err := NewEncoder(format)
+		if err != nil {
+			return nil, err
+		}
+		return sinkFunc(func(event SessionEvent) error {
+			data, err := enc.EncodeEvent(event)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(append(data, '\n'))
+			return err
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// sinkFunc is a Sink handling events one by one with a function.
+type sinkFunc func(SessionEvent) error
+
+// Consume implements Sink.
+func (f sinkFunc) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	return consume(ctx, events, f)
+}
+
+// csvSink prints events as CSV rows, flushing after each one.
+type csvSink struct {
+	w *csv.Writer
+}
+
+// Consume implements Sink.
+func (s *csvSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	err := s.w.Write(csvHeader)
+	if err != nil {
+		return err
+	}
+	s.w.Flush()
+	return consume(ctx, events, func(event SessionEvent) error {
+		err := s.w.Write(csvRecord(event))
+		if err != nil {
+			return err
+		}
+		s.w.Flush()
+		return s.w.Error()
+	})
+}
+
+// liveSummarySink redraws the table of open sessions on every event and
+// every refresh interval.
+type liveSummarySink struct {
+	m        *Monitor
+	w        io.Writer
+	sessions SessionLister
+	refresh  time.Duration
+}
+
+// Consume implements Sink.
+func (s *liveSummarySink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-events:
+			if !ok {
+				return nil
+			}
+		case <-ticker.C:
+		}
+		s.m.printLiveSummary(s.w, s.sessions.Sessions(), time.Now())
+	}
+}
+
+// peerClosed reports whether the peer of a stream connection has closed it,
+// so the next write would be lost. The peers of the sinks never send data.
+func peerClosed(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	var buf [1]byte
+	_, err := conn.Read(buf[:])
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return err != nil
+}
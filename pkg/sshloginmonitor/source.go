@@ -0,0 +1,213 @@
+package sshloginmonitor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/coreos/go-systemd/sdjournal"
+	"github.com/fsnotify/fsnotify"
+)
+
+// ReaderSource parses a log in /var/log/secure format from a reader.
+type ReaderSource struct {
+	reader io.Reader
+	m      *Monitor
+}
+
+// NewReaderSource returns a Source parsing the log read from reader.
+func NewReaderSource(m *Monitor, reader io.Reader) *ReaderSource {
+	return &ReaderSource{reader: reader, m: m}
+}
+
+// Events implements Source.
+func (s *ReaderSource) Events(ctx context.Context, out chan<- SessionEvent) error {
+	_, err := s.m.scanEvents(ctx, s.reader, out)
+	return err
+}
+
+// scanEvents parses the lines read from reader and sends the events to out.
+// It returns false if ctx was cancelled before the reader was exhausted.
+func (m *Monitor) scanEvents(ctx context.Context, reader io.Reader, out chan<- SessionEvent) (bool, error) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		offered, err := m.recordOfferedKey(line)
+		if err != nil {
+			return false, err
+		}
+		if offered {
+			continue
+		}
+		event, err := m.getLogEvent(line)
+		if err != nil {
+			return false, err
+		}
+		if event == (SessionEvent{}) {
+			continue
+		}
+		if !sendEvent(ctx, out, event) {
+			return false, nil
+		}
+	}
+	return true, scanner.Err()
+}
+
+// FileSource parses a log file in /var/log/secure format and, if Follow is
+// set, keeps watching it for new lines.
+type FileSource struct {
+	Path   string
+	Follow bool
+	m      *Monitor
+}
+
+// NewFileSource returns a Source parsing the log file at path.
+func NewFileSource(m *Monitor, path string, follow bool) *FileSource {
+	return &FileSource{Path: path, Follow: follow, m: m}
+}
+
+// Events implements Source.
+func (s *FileSource) Events(ctx context.Context, out chan<- SessionEvent) error {
+	input, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	more, err := s.m.scanEvents(ctx, input, out)
+	if err != nil || !more || !s.Follow {
+		return err
+	}
+	offset, err := input.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	err = watcher.Add(s.Path)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-watcher.Events:
+			if event.Op&fsnotify.Write != fsnotify.Write {
+				continue
+			}
+			_, err := input.Seek(offset, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			more, err := s.m.scanEvents(ctx, input, out)
+			if err != nil || !more {
+				return err
+			}
+			offset, err = input.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+		case err := <-watcher.Errors:
+			return err
+		}
+	}
+}
+
+// JournalSource reads sshd entries from the systemd journal and, if Follow
+// is set, keeps waiting for new ones.
+type JournalSource struct {
+	Follow bool
+	m      *Monitor
+}
+
+// NewJournalSource returns a Source reading sshd entries from the journal.
+func NewJournalSource(m *Monitor, follow bool) *JournalSource {
+	return &JournalSource{Follow: follow, m: m}
+}
+
+// Events implements Source.
+func (s *JournalSource) Events(ctx context.Context, out chan<- SessionEvent) error {
+	j, err := sdjournal.NewJournal()
+	if err != nil {
+		return err
+	}
+	defer j.Close()
+
+	// Match by SYSLOG_IDENTIFIER; matches of the same field are ORed, so this
+	// also reads the offered keys logged by authorized-keys-command
+	err = j.AddMatch("SYSLOG_IDENTIFIER=sshd")
+	if err != nil {
+		return err
+	}
+	err = j.AddMatch("SYSLOG_IDENTIFIER=" + OfferedKeyIdentifier)
+	if err != nil {
+		return err
+	}
+
+	// Start at the beginning of the journal
+	err = j.SeekHead()
+	if err != nil {
+		return err
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		n, err := j.Next()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// No new entries, wait for new ones if "follow" is set
+			if !s.Follow {
+				return nil
+			}
+			j.Wait(time.Second) // wake up regularly to notice cancellation
+			continue
+		}
+		entry, err := j.GetEntry()
+		if err != nil {
+			return err
+		}
+		if _, ok := entry.Fields["MESSAGE"]; !ok {
+			continue
+		}
+		line := fmt.Sprintf("%s %s %s[%s]: %s", // reproduce format of journalctl output; should be refactored
+			entry.Fields["SYSLOG_TIMESTAMP"],
+			entry.Fields["_HOSTNAME"],
+			entry.Fields["SYSLOG_IDENTIFIER"],
+			entry.Fields["_PID"],
+			entry.Fields["MESSAGE"],
+		)
+		offered, err := s.m.recordOfferedKey(line)
+		if err != nil {
+			return err
+		}
+		if offered {
+			continue
+		}
+		event, err := s.m.getLogEvent(line)
+		if err != nil {
+			return err
+		}
+		if event == (SessionEvent{}) {
+			continue
+		}
+		if !sendEvent(ctx, out, event) {
+			return nil
+		}
+	}
+}
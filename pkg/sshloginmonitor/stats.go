@@ -0,0 +1,213 @@
+package sshloginmonitor
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Stats groups
+const (
+	StatsKeyUser  = "key_user"
+	StatsAccount  = "account"
+	StatsSourceIP = "source_ip"
+)
+
+// Stats are the session totals of one key user, account or source IP.
+// Durations only include sessions that have ended.
+type Stats struct {
+	Group          string        `json:"group"` // StatsKeyUser, StatsAccount or StatsSourceIP
+	Name           string        `json:"name"`
+	Sessions       int           `json:"sessions"`
+	TotalDuration  time.Duration `json:"-"` // encoded as total_seconds
+	MedianDuration time.Duration `json:"-"` // encoded as median_seconds
+	FirstSeen      time.Time     `json:"first_seen"`
+	LastSeen       time.Time     `json:"last_seen"`
+	DistinctIPs    int           `json:"distinct_ips"`
+	LoginHours     [24]int       `json:"login_hours"` // logins per hour of the day
+
+	durations []time.Duration
+	ips       map[string]bool
+}
+
+// ComputeStats aggregates the sessions per key user, per account and per
+// source IP. The result is sorted by group, then by decreasing number of sessions.
+//
+// Parameters:
+//   - sessions: the sessions to aggregate
+//
+// Returns:
+//   - []Stats: the statistics of every key user, account and source IP
+func ComputeStats(sessions []Session) []Stats {
+	groups := []struct {
+		group string
+		name  func(Session) string
+	}{
+		{StatsKeyUser, func(s Session) string { return s.KeyUser }},
+		{StatsAccount, func(s Session) string { return s.Username }},
+		{StatsSourceIP, func(s Session) string { return s.SourceIP }},
+	}
+	stats := make([]Stats, 0)
+	for _, g := range groups {
+		byName := make(map[string]*Stats)
+		for _, session := range sessions {
+			name := g.name(session)
+			st, ok := byName[name]
+			if !ok {
+				st = &Stats{Group: g.group, Name: name, FirstSeen: session.StartTime, ips: make(map[string]bool)}
+				byName[name] = st
+			}
+			st.add(session)
+		}
+		list := make([]Stats, 0, len(byName))
+		for _, st := range byName {
+			st.finish()
+			list = append(list, *st)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Sessions != list[j].Sessions {
+				return list[i].Sessions > list[j].Sessions
+			}
+			return list[i].Name < list[j].Name
+		})
+		stats = append(stats, list...)
+	}
+	return stats
+}
+
+// add counts the session.
+func (st *Stats) add(session Session) {
+	st.Sessions++
+	st.LoginHours[session.StartTime.Hour()]++
+	st.ips[session.SourceIP] = true
+	if session.StartTime.Before(st.FirstSeen) {
+		st.FirstSeen = session.StartTime
+	}
+	last := session.StartTime
+	if !session.EndTime.IsZero() {
+		last = session.EndTime
+		d := session.EndTime.Sub(session.StartTime)
+		st.TotalDuration += d
+		st.durations = append(st.durations, d)
+	}
+	if last.After(st.LastSeen) {
+		st.LastSeen = last
+	}
+}
+
+// finish computes the median and the number of distinct IPs.
+func (st *Stats) finish() {
+	st.DistinctIPs = len(st.ips)
+	if len(st.durations) == 0 {
+		return
+	}
+	sort.Slice(st.durations, func(i, j int) bool { return st.durations[i] < st.durations[j] })
+	n := len(st.durations)
+	if n%2 == 1 {
+		st.MedianDuration = st.durations[n/2]
+	} else {
+		st.MedianDuration = (st.durations[n/2-1] + st.durations[n/2]) / 2
+	}
+}
+
+// MarshalJSON encodes durations in seconds.
+func (st Stats) MarshalJSON() ([]byte, error) {
+	type stats Stats // without the MarshalJSON method
+	return json.Marshal(struct {
+		stats
+		TotalSeconds  float64 `json:"total_seconds"`
+		MedianSeconds float64 `json:"median_seconds"`
+	}{stats(st), st.TotalDuration.Seconds(), st.MedianDuration.Seconds()})
+}
+
+// histogram draws the login hours as a 24-character bar, one per hour.
+func histogram(hours [24]int) string {
+	levels := []rune(" ▁▂▃▄▅▆▇█")
+	max := 0
+	for _, n := range hours {
+		if n > max {
+			max = n
+		}
+	}
+	bar := make([]rune, 24)
+	for i, n := range hours {
+		level := 0
+		if max > 0 && n > 0 {
+			level = 1 + n*(len(levels)-2)/max
+		}
+		bar[i] = levels[level]
+	}
+	return string(bar)
+}
+
+// PrintStats prints the statistics as a table, JSON or CSV.
+//
+// Parameters:
+//   - w: the writer to print to
+//   - stats: statistics returned by ComputeStats
+//   - format: "table", "json" or "csv"
+//
+// Returns:
+//   - error: an error if the format is unknown or the output can't be written
+func PrintStats(w io.Writer, stats []Stats, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	case "csv":
+		cw := csv.NewWriter(w)
+		header := []string{"group", "name", "sessions", "total_seconds", "median_seconds", "first_seen", "last_seen", "distinct_ips"}
+		for h := 0; h < 24; h++ {
+			header = append(header, fmt.Sprintf("logins_%02d", h))
+		}
+		err := cw.Write(header)
+		if err != nil {
+			return err
+		}
+		for _, st := range stats {
+			record := []string{st.Group, st.Name, strconv.Itoa(st.Sessions),
+				strconv.FormatFloat(st.TotalDuration.Seconds(), 'f', -1, 64),
+				strconv.FormatFloat(st.MedianDuration.Seconds(), 'f', -1, 64),
+				st.FirstSeen.Format(time.RFC3339), st.LastSeen.Format(time.RFC3339),
+				strconv.Itoa(st.DistinctIPs)}
+			for _, n := range st.LoginHours {
+				record = append(record, strconv.Itoa(n))
+			}
+			err = cw.Write(record)
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table":
+		group := ""
+		for _, st := range stats {
+			if st.Group != group {
+				if group != "" {
+					fmt.Fprintln(w)
+				}
+				group = st.Group
+				fmt.Fprintf(w, "%-20s %8s %12s %10s %-20s %-20s %4s %-24s\n", statsTitles[group], "SESSIONS", "TOTAL",
+					"MEDIAN", "FIRST SEEN", "LAST SEEN", "IPS", "LOGIN HOURS 00-23")
+			}
+			fmt.Fprintf(w, "%-20s %8d %12s %10s %-20s %-20s %4d %s\n", st.Name, st.Sessions, st.TotalDuration,
+				st.MedianDuration, st.FirstSeen.Format("2006-01-02 15:04:05"), st.LastSeen.Format("2006-01-02 15:04:05"),
+				st.DistinctIPs, histogram(st.LoginHours))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown stats format %q", format)
+}
+
+// statsTitles are the table headers of the stats groups.
+var statsTitles = map[string]string{
+	StatsKeyUser:  "KEY USER",
+	StatsAccount:  "ACCOUNT",
+	StatsSourceIP: "SOURCE IP",
+}
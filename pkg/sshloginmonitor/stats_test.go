@@ -0,0 +1,102 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeStats(t *testing.T) {
+	day := time.Date(2023, 4, 27, 0, 0, 0, 0, time.UTC)
+	session := func(keyUser, account, ip string, start, minutes int) Session {
+		s := Session{KeyUser: keyUser, Username: account, SourceIP: ip, StartTime: day.Add(time.Duration(start) * time.Hour)}
+		if minutes > 0 {
+			s.EndTime = s.StartTime.Add(time.Duration(minutes) * time.Minute)
+		}
+		return s
+	}
+	sessions := []Session{
+		session("alice", "root", "10.0.0.1", 9, 10),
+		session("alice", "root", "10.0.0.2", 10, 30),
+		session("alice", "deploy", "10.0.0.1", 9, 20),
+		session("bob", "root", "10.0.0.3", 22, 0), // still open
+	}
+	stats := ComputeStats(sessions)
+
+	got := make(map[string]Stats)
+	for _, st := range stats {
+		got[st.Group+" "+st.Name] = st
+	}
+	if len(stats) != 7 {
+		t.Fatalf("ComputeStats() returned %d stats, want 7", len(stats))
+	}
+	if stats[0].Name != "alice" || stats[2].Name != "root" {
+		t.Errorf("ComputeStats() isn't sorted by group and sessions: %v, %v", stats[0].Name, stats[2].Name)
+	}
+
+	tests := []struct {
+		key        string
+		sessions   int
+		total      time.Duration
+		median     time.Duration
+		ips        int
+		hours      map[int]int
+		firstHour  int
+		lastSeenAt time.Time
+	}{
+		{"key_user alice", 3, time.Hour, 20 * time.Minute, 2, map[int]int{9: 2, 10: 1}, 9, day.Add(10*time.Hour + 30*time.Minute)},
+		{"key_user bob", 1, 0, 0, 1, map[int]int{22: 1}, 22, day.Add(22 * time.Hour)},
+		{"account root", 3, 40 * time.Minute, 20 * time.Minute, 3, map[int]int{9: 1, 10: 1, 22: 1}, 9, day.Add(22 * time.Hour)},
+		{"source_ip 10.0.0.1", 2, 30 * time.Minute, 15 * time.Minute, 1, map[int]int{9: 2}, 9, day.Add(9*time.Hour + 20*time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			st, ok := got[tt.key]
+			if !ok {
+				t.Fatalf("no stats for %s", tt.key)
+			}
+			if st.Sessions != tt.sessions || st.TotalDuration != tt.total || st.MedianDuration != tt.median || st.DistinctIPs != tt.ips {
+				t.Errorf("stats = %d sessions, total %v, median %v, %d IPs; want %d, %v, %v, %d",
+					st.Sessions, st.TotalDuration, st.MedianDuration, st.DistinctIPs, tt.sessions, tt.total, tt.median, tt.ips)
+			}
+			for hour, n := range st.LoginHours {
+				if n != tt.hours[hour] {
+					t.Errorf("LoginHours[%d] = %d, want %d", hour, n, tt.hours[hour])
+				}
+			}
+			if st.FirstSeen.Hour() != tt.firstHour || !st.LastSeen.Equal(tt.lastSeenAt) {
+				t.Errorf("seen %v - %v", st.FirstSeen, st.LastSeen)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	err := PrintStats(&buf, stats[:1], "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded[0]["total_seconds"] != 3600.0 || decoded[0]["median_seconds"] != 1200.0 {
+		t.Errorf("PrintStats() JSON = %s", buf.String())
+	}
+
+	buf.Reset()
+	err = PrintStats(&buf, stats[:1], "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "key_user,alice,3,3600,1200,") {
+		t.Errorf("PrintStats() CSV = %q", buf.String())
+	}
+
+	if err := PrintStats(&buf, stats, "xml"); err == nil {
+		t.Error("PrintStats() accepted an unknown format")
+	}
+}
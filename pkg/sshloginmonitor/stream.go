@@ -0,0 +1,189 @@
+package sshloginmonitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamBuffer is the number of events a stream client can lag behind
+// before it is disconnected. It resumes from the database when it reconnects.
+const streamBuffer = 256
+
+// streamKeepAlive is how often an idle stream sends a comment so proxies
+// don't close the connection.
+const streamKeepAlive = 15 * time.Second
+
+// EventStream broadcasts stored events to the clients of the stream endpoint.
+// Set it as the Stream of the DBSink so every event is published with its ID.
+type EventStream struct {
+	mu          sync.Mutex
+	subscribers map[chan SessionEvent]struct{}
+}
+
+// NewEventStream returns an EventStream with no subscribers.
+func NewEventStream() *EventStream {
+	return &EventStream{subscribers: make(map[chan SessionEvent]struct{})}
+}
+
+// Publish sends the event to every subscriber. Subscribers that fall too far
+// behind are dropped: their channel is closed.
+func (s *EventStream) Publish(event SessionEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the published events and a function
+// to unsubscribe.
+func (s *EventStream) Subscribe() (<-chan SessionEvent, func()) {
+	ch := make(chan SessionEvent, streamBuffer)
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// streamFilter selects the events sent to a stream client.
+type streamFilter struct {
+	accounts map[string]bool
+	keyUsers map[string]bool
+	types    map[string]bool
+}
+
+// newStreamFilter reads the account, key_user and type parameters; each may
+// be repeated or hold a comma-separated list.
+func newStreamFilter(r *http.Request) streamFilter {
+	set := func(name string) map[string]bool {
+		values := make(map[string]bool)
+		for _, value := range r.URL.Query()[name] {
+			for _, v := range strings.Split(value, ",") {
+				if v != "" {
+					values[v] = true
+				}
+			}
+		}
+		return values
+	}
+	return streamFilter{accounts: set("account"), keyUsers: set("key_user"), types: set("type")}
+}
+
+// match reports whether the event passes the filter.
+func (f streamFilter) match(event SessionEvent) bool {
+	return (len(f.accounts) == 0 || f.accounts[event.Username]) &&
+		(len(f.keyUsers) == 0 || f.keyUsers[event.KeyUser]) &&
+		(len(f.types) == 0 || f.types[event.EventType])
+}
+
+// stream serves GET /stream as server-sent events: each event is sent with its
+// ID, so a client reconnecting with Last-Event-ID (or ?last_event_id=) gets
+// the events it missed from the database before the live ones.
+func (api *API) stream(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	if api.Stream == nil {
+		writeError(w, http.StatusNotFound, errors.New("streaming is not enabled"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	var last uint64
+	if lastID != "" {
+		var err error
+		last, err = strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid last event ID"))
+			return
+		}
+	}
+	filter := newStreamFilter(r)
+
+	// Subscribe before reading the database, so no event falls in between
+	live, unsubscribe := api.Stream.Subscribe()
+	defer unsubscribe()
+
+	var missed []SessionEvent
+	if lastID != "" {
+		var err error
+		missed, err = api.m.GetEventsAfter(last)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event SessionEvent) error {
+		if event.ID <= last {
+			return nil
+		}
+		last = event.ID
+		if !filter.match(event) {
+			return nil
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, data)
+		return err
+	}
+
+	for _, event := range missed {
+		if send(event) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-live:
+			if !ok {
+				return // too slow; the client resumes from its last event ID
+			}
+			if send(event) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
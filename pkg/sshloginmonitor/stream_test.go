@@ -0,0 +1,109 @@
+package sshloginmonitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSSE reads n server-sent events and returns their IDs and events.
+func readSSE(t *testing.T, scanner *bufio.Scanner, n int) ([]string, []SessionEvent) {
+	t.Helper()
+	ids := make([]string, 0, n)
+	events := make([]SessionEvent, 0, n)
+	for len(events) < n && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "data: "):
+			var event SessionEvent
+			err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, event)
+		}
+	}
+	if len(events) != n {
+		t.Fatalf("got %d events, want %d (%v)", len(events), n, scanner.Err())
+	}
+	return ids, events
+}
+
+func TestStream(t *testing.T) {
+	m := newTestMonitor(t)
+	stream := NewEventStream()
+	dbSink := NewDBSink(m)
+	dbSink.Stream = stream
+	api := NewAPI(m, "")
+	api.Stream = stream
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close) // after the clients below disconnect
+
+	// The first login is stored before any client connects
+	lines := strings.SplitAfter(testLog, "\n")
+	err := NewPipeline([]Source{NewReaderSource(m, strings.NewReader(lines[0]))}, []Sink{dbSink}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string, lastID string) *bufio.Scanner {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		t.Cleanup(cancel)
+		req, err := http.NewRequestWithContext(ctx, "GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Content-Type = %q", ct)
+		}
+		return bufio.NewScanner(resp.Body)
+	}
+	resumed := get("/stream", "0")
+	logins := get("/stream?type=login", "")
+	bob := get("/stream?key_user=bob@fedora&account=root", "")
+
+	// The missed event is replayed to the client resuming from ID 0
+	ids, events := readSSE(t, resumed, 1)
+	if ids[0] != "1" || events[0].ID != 1 || events[0].KeyUser != "alice@fedora" {
+		t.Errorf("resumed stream = %v %v", ids, events)
+	}
+
+	// The live events are sent to every client that wants them
+	err = NewPipeline([]Source{NewReaderSource(m, strings.NewReader(testLog))}, []Sink{dbSink}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, events = readSSE(t, resumed, 2)
+	if ids[0] != "2" || ids[1] != "3" || events[0].EventType != "logout" {
+		t.Errorf("resumed stream = %v %v, want the logout and bob's login; the stored login isn't repeated", ids, events)
+	}
+	_, events = readSSE(t, logins, 1)
+	if events[0].KeyUser != "bob@fedora" || events[0].EventType != "login" {
+		t.Errorf("login stream = %v", events)
+	}
+	_, events = readSSE(t, bob, 1)
+	if events[0].KeyUser != "bob@fedora" {
+		t.Errorf("bob's stream = %v", events)
+	}
+
+	// A client that was offline gets what it missed
+	ids, _ = readSSE(t, get("/stream", "1"), 2)
+	if ids[0] != "2" || ids[1] != "3" {
+		t.Errorf("stream resumed after 1 = %v, want 2 and 3", ids)
+	}
+}
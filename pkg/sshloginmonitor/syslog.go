@@ -0,0 +1,166 @@
+package sshloginmonitor
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// syslogEnterprise is the private enterprise number of the structured data
+// ID sshlm@32473; 32473 is the number reserved for documentation by RFC 5612.
+const syslogEnterprise = "32473"
+
+// Syslog facilities and severities used by the syslog sink.
+const (
+	syslogAuthPriv = 10
+	syslogCrit     = 2
+	syslogWarning  = 4
+	syslogNotice   = 5
+	syslogInfo     = 6
+)
+
+// SyslogSink sends events to a syslog server in the RFC 5424 format, with
+// the event fields as structured data:
+//
+//	<85>1 2023-04-27T10:21:19+02:00 bastion sshlm 4242 login [sshlm@32473 user="root" keyuser="alice@fedora" srcip="192.168.1.24" port="49090"] login of root by alice@fedora from 192.168.1.24 port 49090
+//
+// Messages are sent one per datagram over UDP, and with octet counting
+// framing (RFC 6587, RFC 5425) over TCP and TLS. The connection is
+// re-established when it fails.
+type SyslogSink struct {
+	Network   string      // "udp", "tcp" or "tls"
+	Address   string      // host:port
+	TLSConfig *tls.Config // for "tls"; the system roots if nil
+	Facility  int         // LOG_AUTHPRIV (10) if zero
+	Hostname  string      // os.Hostname() if empty
+	// Encoder encodes the message part, e.g. as CEF; a one-line
+	// description of the event if nil
+	Encoder Encoder
+
+	conn *NetworkSink
+}
+
+// Consume implements Sink.
+func (s *SyslogSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	if s.Hostname == "" {
+		s.Hostname, _ = os.Hostname()
+	}
+	network := s.Network
+	tlsConfig := s.TLSConfig
+	if network == "tls" {
+		network = "tcp"
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{} // system roots, server name from the address
+		}
+	} else {
+		tlsConfig = nil
+	}
+	s.conn = &NetworkSink{Network: network, Address: s.Address, TLSConfig: tlsConfig}
+	defer func() {
+		if s.conn.conn != nil {
+			s.conn.conn.Close()
+		}
+	}()
+	return consume(ctx, events, func(event SessionEvent) error {
+		formatted, err := s.format(event)
+		if err != nil {
+			return err
+		}
+		msg := []byte(formatted)
+		if network != "udp" {
+			msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+		}
+		for attempt := 0; attempt < 2; attempt++ {
+			err = s.conn.write(ctx, msg)
+			if err == nil {
+				return nil
+			}
+		}
+		log.Printf("syslog sink %s: event dropped: %s", s.Address, err)
+		return nil
+	})
+}
+
+// format returns the RFC 5424 message of the event.
+func (s *SyslogSink) format(event SessionEvent) (string, error) {
+	facility := s.Facility
+	if facility == 0 {
+		facility = syslogAuthPriv
+	}
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	timestamp := "-"
+	if !event.EventTime.IsZero() {
+		timestamp = event.EventTime.Format("2006-01-02T15:04:05.999999Z07:00")
+	}
+	msgID := event.EventType
+	if msgID == "" {
+		msgID = "-"
+	}
+	msg := eventMessage(event)
+	if s.Encoder != nil {
+		data, err := s.Encoder.EncodeEvent(event)
+		if err != nil {
+			return "", err
+		}
+		msg = string(data)
+	}
+	return fmt.Sprintf("<%d>1 %s %s sshlm %d %s %s %s", facility*8+syslogSeverity(event), timestamp,
+		hostname, os.Getpid(), msgID, syslogData(event), msg), nil
+}
+
+// syslogSeverity returns the syslog severity of the event.
+func syslogSeverity(event SessionEvent) int {
+	switch event.EventType {
+	case "login":
+		return syslogNotice
+	case "failure":
+		return syslogWarning
+	case "alert":
+		if event.Alert != nil {
+			switch event.Alert.Severity {
+			case SeverityCritical:
+				return syslogCrit
+			case SeverityInfo:
+				return syslogInfo
+			}
+		}
+		return syslogWarning
+	}
+	return syslogInfo
+}
+
+// syslogData returns the structured data element of the event.
+func syslogData(event SessionEvent) string {
+	params := [][2]string{
+		{"user", event.Username},
+		{"keyuser", event.KeyUser},
+		{"keyemail", event.KeyEmail},
+		{"keyteam", event.KeyTeam},
+		{"srcip", event.SourceIP},
+		{"port", event.Port},
+		{"fingerprint", event.Fingerprint},
+		{"authmethod", event.AuthMethod},
+	}
+	if event.Alert != nil {
+		params = append(params, [2]string{"rule", event.Alert.Rule}, [2]string{"severity", event.Alert.Severity})
+	}
+	var b strings.Builder
+	b.WriteString("[sshlm@" + syslogEnterprise)
+	for _, p := range params {
+		if p[1] != "" {
+			b.WriteString(" " + p[0] + `="` + sdEscaper.Replace(p[1]) + `"`)
+		}
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// sdEscaper escapes structured data parameter values.
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
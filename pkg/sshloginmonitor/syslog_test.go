@@ -0,0 +1,185 @@
+package sshloginmonitor
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogFormat(t *testing.T) {
+	at := time.Date(2023, 4, 27, 10, 21, 19, 0, time.UTC)
+	timestamp := at.Format("2006-01-02T15:04:05.999999Z07:00")
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name  string
+		event SessionEvent
+		want  string
+	}{
+		{
+			name: "login",
+			event: SessionEvent{EventType: "login", EventTime: at, Username: "root", KeyUser: "alice@fedora",
+				SourceIP: "192.168.1.24", Port: "49090", AuthMethod: "publickey"},
+			want: "<85>1 " + timestamp + " bastion sshlm " + pid + ` login [sshlm@32473 user="root" keyuser="alice@fedora" srcip="192.168.1.24" port="49090" authmethod="publickey"] login of root by alice@fedora from 192.168.1.24 port 49090`,
+		},
+		{
+			name:  "failure",
+			event: SessionEvent{EventType: "failure", EventTime: at, Username: `a"b]c\d`, SourceIP: "10.0.0.1", Port: "22", AuthMethod: "password"},
+			want:  "<84>1 " + timestamp + " bastion sshlm " + pid + ` failure [sshlm@32473 user="a\"b\]c\\d" srcip="10.0.0.1" port="22" authmethod="password"] failed password login for a"b]c\d from 10.0.0.1 port 22`,
+		},
+		{
+			name: "critical alert",
+			event: SessionEvent{EventType: "alert", EventTime: at, Username: "root",
+				Alert: &Alert{Rule: "root-login", Severity: SeverityCritical, Message: "login of root"}},
+			want: "<82>1 " + timestamp + " bastion sshlm " + pid + ` alert [sshlm@32473 user="root" rule="root-login" severity="critical"] [critical] root-login: login of root`,
+		},
+	}
+	sink := &SyslogSink{Hostname: "bastion"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sink.format(tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("format() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink := &SyslogSink{Network: "udp", Address: conn.LocalAddr().String(), Hostname: "bastion"}
+	events := make(chan SessionEvent, 2)
+	events <- SessionEvent{EventType: "login", Username: "root"}
+	events <- SessionEvent{EventType: "logout", Username: "root"}
+	close(events)
+	err = sink.Consume(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for _, want := range []string{"<85>1 - bastion sshlm ", "<86>1 - bastion sshlm "} {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); !strings.HasPrefix(got, want) {
+			t.Errorf("datagram = %q, want prefix %q", got, want)
+		}
+	}
+}
+
+// readFramed reads an octet counted message.
+func readFramed(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	return string(msg), err
+}
+
+func TestSyslogSinkStream(t *testing.T) {
+	// Borrow the test certificate of httptest for TLS
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	tests := []struct {
+		network string
+		listen  func() (net.Listener, error)
+	}{
+		{"tcp", func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") }},
+		{"tls", func() (net.Listener, error) {
+			return tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			listener, err := tt.listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			// The server closes the first connection after one message: the
+			// sink must reconnect for the next ones.
+			received := make(chan string, 3)
+			go func() {
+				for conns := 0; ; conns++ {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					r := bufio.NewReader(conn)
+					for {
+						msg, err := readFramed(r)
+						if err != nil {
+							break
+						}
+						received <- fmt.Sprintf("%d %s", conns, msg)
+						if conns == 0 {
+							break
+						}
+					}
+					conn.Close()
+				}
+			}()
+
+			sink := &SyslogSink{Network: tt.network, Address: listener.Addr().String(), Hostname: "bastion",
+				TLSConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"}}
+			events := make(chan SessionEvent)
+			done := make(chan error)
+			go func() { done <- sink.Consume(context.Background(), events) }()
+			for _, user := range []string{"alice", "bob", "carol"} {
+				events <- SessionEvent{EventType: "login", Username: user}
+				if user == "alice" {
+					<-time.After(100 * time.Millisecond) // let the server close the connection
+				}
+			}
+			close(events)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			for i, user := range []string{"alice", "bob", "carol"} {
+				select {
+				case msg := <-received:
+					conn := "1"
+					if i == 0 {
+						conn = "0"
+					}
+					want := fmt.Sprintf("user=%q", user)
+					if !strings.HasPrefix(msg, conn+" <85>1 - bastion sshlm ") || !strings.Contains(msg, want) {
+						t.Errorf("message %d = %q, want %s", i, msg, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("message %d not received", i)
+				}
+			}
+		})
+	}
+}
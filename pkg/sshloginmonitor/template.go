@@ -0,0 +1,69 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"io"
+	"text/template"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// templateFuncs returns the helper functions available in output templates:
+//
+//   - duration START END: the time between two times, or "open" if END is zero
+//   - since T: the time elapsed since T
+//   - tz NAME T: T converted to the time zone NAME, e.g. "UTC" or "Europe/Berlin"
+//   - color NAME VALUE: VALUE colored with the theme color of the element NAME
+//     (e.g. "username") or with the color NAME (e.g. "red"), if colors are on
+func (m *Monitor) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"duration": func(start, end time.Time) string {
+			if end.IsZero() {
+				return "open"
+			}
+			return end.Sub(start).String()
+		},
+		"since": func(t time.Time) string {
+			return time.Since(t).Truncate(time.Second).String()
+		},
+		"tz": func(name string, t time.Time) (time.Time, error) {
+			loc, err := time.LoadLocation(name)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return t.In(loc), nil
+		},
+		"color": func(name string, value interface{}) string {
+			if _, ok := m.opts.Theme[name]; ok {
+				return m.colorFunc(name)("%v", value)
+			}
+			c := color.New(colorMap[name])
+			if !m.opts.Color {
+				c.DisableColor()
+			}
+			return c.Sprint(value)
+		},
+	}
+}
+
+// parseTemplate parses an output template with the helper functions.
+func (m *Monitor) parseTemplate(text string) (*template.Template, error) {
+	return template.New("output").Funcs(m.templateFuncs()).Parse(text)
+}
+
+// executeTemplate writes the output template applied to data (a SessionEvent
+// for the event template, a Session for the session template) to w, adding a
+// newline unless the template ends with one.
+func executeTemplate(w io.Writer, tmpl *template.Template, data interface{}) error {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
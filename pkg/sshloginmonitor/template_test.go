@@ -0,0 +1,128 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestTemplate(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// fatih/color turns colors off when the output isn't a terminal
+	noColor := color.NoColor
+	color.NoColor = false
+	defer func() { color.NoColor = noColor }()
+
+	start := time.Date(2023, 4, 27, 10, 21, 19, 0, time.UTC)
+	event := SessionEvent{
+		EventType: "login",
+		EventTime: start,
+		Username:  "root",
+		SourceIP:  "192.168.1.24",
+		Port:      "49090",
+		KeyUser:   "alice@fedora",
+	}
+	session := Session{
+		Username:  "root",
+		SourceIP:  "192.168.1.24",
+		Port:      "49090",
+		StartTime: start,
+		EndTime:   start.Add(90 * time.Second),
+		KeyUser:   "alice@fedora",
+	}
+	tests := []struct {
+		name     string
+		template string
+		color    bool
+		data     interface{}
+		want     string
+	}{
+		{
+			name:     "event fields",
+			template: "{{.KeyUser}} {{.SourceIP}}:{{.Port}}",
+			data:     event,
+			want:     "alice@fedora 192.168.1.24:49090\n",
+		},
+		{
+			name:     "duration",
+			template: "{{duration .StartTime .EndTime}}\n",
+			data:     session,
+			want:     "1m30s\n",
+		},
+		{
+			name:     "open session",
+			template: "{{duration .StartTime .EndTime}}",
+			data:     Session{StartTime: start},
+			want:     "open\n",
+		},
+		{
+			name:     "time zone",
+			template: `{{(tz "Asia/Tokyo" .EventTime).Format "15:04 MST"}}`,
+			data:     event,
+			want:     "19:21 JST\n",
+		},
+		{
+			name:     "color off",
+			template: `{{color "username" .Username}}`,
+			data:     event,
+			want:     "root\n",
+		},
+		{
+			name:     "theme color",
+			template: `{{color "username" .Username}}`,
+			color:    true,
+			data:     event,
+			want:     "\033[32mroot\033[0m\n",
+		},
+		{
+			name:     "named color",
+			template: `{{color "red" .Username}}`,
+			color:    true,
+			data:     event,
+			want:     "\033[31mroot\033[0m\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMonitor(db, Options{
+				Bucket:          "LoginMonitor",
+				Color:           tt.color,
+				Theme:           Theme{"username": "green"},
+				EventTemplate:   tt.template,
+				SessionTemplate: tt.template,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tmpl := m.eventTmpl
+			if _, ok := tt.data.(Session); ok {
+				tmpl = m.sessionTmpl
+			}
+			var buf bytes.Buffer
+			err = executeTemplate(&buf, tmpl, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("executeTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	_, err = NewMonitor(db, Options{Bucket: "LoginMonitor", EventTemplate: "{{.Username"})
+	if err == nil {
+		t.Error("NewMonitor() accepted an invalid event template")
+	}
+	_, err = NewMonitor(db, Options{Bucket: "LoginMonitor", SessionTemplate: "{{.StartTime"})
+	if err == nil {
+		t.Error("NewMonitor() accepted an invalid session template")
+	}
+}
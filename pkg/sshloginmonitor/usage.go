@@ -0,0 +1,162 @@
+package sshloginmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// KeyUsage is the login history of one key.
+type KeyUsage struct {
+	Fingerprint string    `json:"fingerprint"`
+	FirstUsed   time.Time `json:"first_used"`
+	LastUsed    time.Time `json:"last_used"`
+	SourceIPs   []string  `json:"source_ips"`
+}
+
+// StaleKey is a key reported by StaleKeys.
+type StaleKey struct {
+	Fingerprint string     `json:"fingerprint"`
+	KeyUser     string     `json:"key_user"`
+	Accounts    []string   `json:"accounts"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+	SourceIPs   []string   `json:"source_ips,omitempty"`
+	Reasons     []string   `json:"reasons"`
+}
+
+// usageBucket returns the name of the bucket mapping fingerprints to KeyUsage records.
+func usageBucket(bucket string) []byte {
+	return []byte(bucket + "/usage")
+}
+
+// RecordKeyUsage adds the login events to the login history of their keys.
+// Recording the same events again doesn't change the history, so a log file
+// can be parsed more than once.
+//
+// Parameters:
+//   - events: events to record; only logins with a fingerprint are used
+//
+// Returns:
+//   - error: an error if the database can't be updated
+func (m *Monitor) RecordKeyUsage(events []SessionEvent) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(usageBucket(m.opts.Bucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		for _, event := range events {
+			if event.EventType != "login" || event.Fingerprint == "" {
+				continue
+			}
+			usage := KeyUsage{Fingerprint: event.Fingerprint}
+			if data := b.Get([]byte(event.Fingerprint)); data != nil {
+				err = json.Unmarshal(data, &usage)
+				if err != nil {
+					return err
+				}
+			}
+			if usage.FirstUsed.IsZero() || event.EventTime.Before(usage.FirstUsed) {
+				usage.FirstUsed = event.EventTime
+			}
+			if event.EventTime.After(usage.LastUsed) {
+				usage.LastUsed = event.EventTime
+			}
+			usage.SourceIPs = appendUnique(usage.SourceIPs, event.SourceIP)
+			data, err := json.Marshal(usage)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(event.Fingerprint), data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetKeyUsage returns the login history of the key, and false if the key was never used.
+func (m *Monitor) GetKeyUsage(fp string) (KeyUsage, bool, error) {
+	var usage KeyUsage
+	var found bool
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket(m.opts.Bucket))
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(fp))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &usage)
+	})
+	return usage, found, err
+}
+
+// StaleKeys returns the keys in the key store that were never used, were not
+// used since now minus olderThan, or were used from only one source IP.
+//
+// Parameters:
+//   - olderThan: how long a key may stay unused
+//   - now: the time to measure olderThan from
+//
+// Returns:
+//   - []StaleKey: the reported keys, ordered by fingerprint
+//   - error: an error if the database can't be read
+func (m *Monitor) StaleKeys(olderThan time.Duration, now time.Time) ([]StaleKey, error) {
+	users, err := m.GetAllKeys()
+	if err != nil {
+		return nil, err
+	}
+	accounts := make(map[string][]string)
+	for _, user := range users {
+		accounts[user.Fingerprint] = appendUnique(accounts[user.Fingerprint], user.Account)
+	}
+	fingerprints := make([]string, 0, len(accounts))
+	for fp := range accounts {
+		fingerprints = append(fingerprints, fp)
+	}
+	sort.Strings(fingerprints)
+
+	stale := make([]StaleKey, 0)
+	for _, fp := range fingerprints {
+		keyUser, err := m.GetUserByFingerprint(fp)
+		if err != nil {
+			return nil, err
+		}
+		if keyUser == "" {
+			keyUser = UnknownOwner
+		}
+		usage, used, err := m.GetKeyUsage(fp)
+		if err != nil {
+			return nil, err
+		}
+		key := StaleKey{
+			Fingerprint: fp,
+			KeyUser:     keyUser,
+			Accounts:    accounts[fp],
+		}
+		if !used {
+			key.Reasons = append(key.Reasons, "never used")
+			stale = append(stale, key)
+			continue
+		}
+		lastUsed := usage.LastUsed
+		key.LastUsed = &lastUsed
+		key.SourceIPs = usage.SourceIPs
+		if now.Sub(usage.LastUsed) > olderThan {
+			key.Reasons = append(key.Reasons, "not used since "+usage.LastUsed.Format("2006-01-02"))
+		}
+		if len(usage.SourceIPs) == 1 {
+			key.Reasons = append(key.Reasons, "used only from "+usage.SourceIPs[0])
+		}
+		if len(key.Reasons) > 0 {
+			stale = append(stale, key)
+		}
+	}
+	return stale, nil
+}
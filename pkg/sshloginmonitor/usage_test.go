@@ -0,0 +1,77 @@
+package sshloginmonitor
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStaleKeys(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := NewMonitor(db, Options{Bucket: "LoginMonitor", UpdateKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make([]User, 0)
+	err = getAuthKeys(strings.NewReader(`ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG8Obx1FsUu1jlYDtzfEDHYSDjG82xE7ysxZVzhgpGC5 alice@fedora
+ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJgclT4eQ5RlYabZfkdjFV5wGrroXxmd5n2X7okmiaN8 bob@fedora
+ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJWcjljox2NKwDFllZ5KQc4LSVrBEKoaOE/t/up1XbyD charlie@fedora`), &users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAccount(users, "root")
+	err = m.addUsersToDB(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	events := []SessionEvent{
+		{EventType: "login", EventTime: now.AddDate(0, 0, -1), SourceIP: "192.168.1.24",
+			Fingerprint: "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8"},
+		{EventType: "login", EventTime: now.AddDate(0, 0, -2), SourceIP: "192.168.1.25",
+			Fingerprint: "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8"},
+		{EventType: "login", EventTime: now.AddDate(0, 0, -100), SourceIP: "192.168.1.24",
+			Fingerprint: "is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY"},
+		{EventType: "logout", EventTime: now, SourceIP: "192.168.1.24"},
+	}
+	// recording the same events twice must not change the history
+	for i := 0; i < 2; i++ {
+		err = m.RecordKeyUsage(events)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := m.StaleKeys(90*24*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string][]string)
+	for _, k := range got {
+		reasons[k.KeyUser] = k.Reasons
+	}
+	want := map[string][]string{
+		"bob@fedora":     {"not used since 2023-02-21", "used only from 192.168.1.24"},
+		"charlie@fedora": {"never used"},
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("StaleKeys() reasons = %v, want %v", reasons, want)
+	}
+
+	usage, used, err := m.GetKeyUsage("5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !used || !usage.FirstUsed.Equal(now.AddDate(0, 0, -2)) || !usage.LastUsed.Equal(now.AddDate(0, 0, -1)) {
+		t.Errorf("GetKeyUsage() = %v, %v", usage, used)
+	}
+}
@@ -11,17 +11,21 @@ import (
 	"strings"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/pavelanni/ssh-login-monitor/pkg/config"
 	bolt "go.etcd.io/bbolt"
 	"golang.org/x/crypto/ssh"
 )
 
 type User struct {
-	Username    string
-	Fingerprint string
+	Username       string
+	Fingerprint    string
+	FingerprintMD5 string // legacy fingerprint logged by old sshd versions
+	Key            string // the authorized_keys line, including options
+	Account        string // the local account the key grants access to
 }
 
-func UpdateKeysDB(ctx context.Context, keysFiles []string, db *bolt.DB, bucket string, follow bool) error {
+// UpdateKeysDB adds the keys from the authorized_keys files to the database.
+// If follow is true, it keeps watching the files and adds new keys until ctx is cancelled.
+func (m *Monitor) UpdateKeysDB(ctx context.Context, keysFiles []string, follow bool) error {
 	offsets := make(map[string]int64)
 	files := make(map[string]*os.File)
 
@@ -42,18 +46,20 @@ func UpdateKeysDB(ctx context.Context, keysFiles []string, db *bolt.DB, bucket s
 		if err != nil {
 			return err
 		}
+		setAccount(users, fileAccount(f))
 		offset, err := f.Seek(0, io.SeekCurrent)
 		if err != nil {
 			return err
 		}
 		offsets[keysFile] = offset
-		err = addUsersToDB(users, db, bucket)
+		err = m.addUsersToDB(users)
 		if err != nil {
 			return err
 		}
 	}
-	if !follow {
-		return nil
+	err := m.ExportKeys()
+	if err != nil || !follow {
+		return err
 	}
 
 	// if follow is true, watch the authkeys file for changes and update the database
@@ -83,31 +89,26 @@ func UpdateKeysDB(ctx context.Context, keysFiles []string, db *bolt.DB, bucket s
 				if err != nil {
 					return err
 				}
-				scanner := bufio.NewScanner(f)
-				for scanner.Scan() {
-					// Parse the authorized key and extract the comment and fingerprint
-					out, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(scanner.Text()))
-					if err != nil {
-						return err
-					}
-
-					// If the comment is empty, log a warning and skip this key
-					if comment == "" {
-						log.Printf("empty comment, remove this fingerprint: %s", out)
-						continue
-					}
-
-					// Calculate the fingerprint and create a new User struct
-					fingerprint := strings.Split(ssh.FingerprintSHA256(out), ":")[1]
-					user := User{
-						Username:    comment,
-						Fingerprint: fingerprint,
-					}
-					err = addOneUserToDB(user, db, bucket)
+				users := make([]User, 0)
+				err = getAuthKeys(f, &users)
+				if err != nil {
+					return err
+				}
+				offsets[ev.Name], err = f.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return err
+				}
+				setAccount(users, fileAccount(f))
+				for _, user := range users {
+					err = m.addOneUserToDB(user, m.opts.UpdateKeys)
 					if err != nil {
 						return err
 					}
 				}
+				err = m.ExportKeys()
+				if err != nil {
+					return err
+				}
 			}
 		case err := <-watcher.Errors:
 			return err
@@ -127,23 +128,28 @@ func getAuthKeys(reader io.Reader, users *[]User) error {
 	scanner.Split(bufio.ScanLines)
 
 	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
 		// Parse the authorized key and extract the comment and fingerprint
-		out, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(scanner.Text()))
+		out, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
 		if err != nil {
 			return err
 		}
 
-		// If the comment is empty, log a warning and skip this key
+		// Calculate the fingerprints and create a new User struct
+		fingerprint, fingerprintMD5 := fingerprints(out)
+
+		// If the comment is empty, keep the key: the owner registry may know it
 		if comment == "" {
-			log.Printf("empty comment, remove this fingerprint: %s", out)
-			continue
+			log.Printf("empty comment for fingerprint %s; add it to the owner registry", fingerprint)
 		}
-
-		// Calculate the fingerprint and create a new User struct
-		fingerprint := strings.Split(ssh.FingerprintSHA256(out), ":")[1]
 		user := User{
-			Username:    comment,
-			Fingerprint: fingerprint,
+			Username:       comment,
+			Fingerprint:    fingerprint,
+			FingerprintMD5: fingerprintMD5,
+			Key:            line,
 		}
 
 		// Append the new User to the slice
@@ -153,21 +159,20 @@ func getAuthKeys(reader io.Reader, users *[]User) error {
 	return nil
 }
 
-// addUsersToDB adds a slice of User structs to the database.
+// addUsersToDB adds a slice of User structs to the database, overwriting the
+// users of fingerprints already in the database if the UpdateKeys option is set.
 // Parameters:
 //   - users: a slice of User structs to be added to the database
-//   - db: a database connection
-//   - bucket: the name of the bucket to add the users to
 //
 // Returns:
 //   - error: an error if there was an issue adding the users
-func addUsersToDB(users []User, db *bolt.DB, bucket string) error {
+func (m *Monitor) addUsersToDB(users []User) error {
 	if len(users) == 0 {
 		return errors.New("empty users slice")
 	}
 
 	for _, user := range users {
-		err := addOneUserToDB(user, db, bucket)
+		err := m.addOneUserToDB(user, m.opts.UpdateKeys)
 		if err != nil {
 			return err
 		}
@@ -175,20 +180,29 @@ func addUsersToDB(users []User, db *bolt.DB, bucket string) error {
 	return nil
 }
 
-func addOneUserToDB(user User, db *bolt.DB, bucket string) error {
-	err := db.Update(func(tx *bolt.Tx) error {
+func (m *Monitor) addOneUserToDB(user User, update bool) error {
+	bucket := m.opts.Bucket
+	err := m.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
 		if b == nil {
 			return fmt.Errorf("bucket %s not found", bucket)
 		}
 		u := b.Get([]byte(user.Fingerprint))
-		if u != nil { // If the fingerprint is already in the database
-			if !config.K.Bool("updatekeys") { // skip if --updatekeys is set to false
-				return nil
+		if u == nil || update { // skip existing fingerprints unless updating
+			log.Printf("adding fingerprint for user %s", user.Username)
+			err := b.Put([]byte(user.Fingerprint), []byte(user.Username))
+			if err != nil {
+				return err
 			}
 		}
-		log.Printf("adding fingerprint for user %s", user.Username)
-		return b.Put([]byte(user.Fingerprint), []byte(user.Username))
+		err := putMD5Fingerprint(tx, bucket, user)
+		if err != nil {
+			return err
+		}
+		if user.Account == "" || user.Key == "" {
+			return nil
+		}
+		return putAccountKey(tx, bucket, user)
 	})
 	if err != nil {
 		return err
@@ -196,18 +210,13 @@ func addOneUserToDB(user User, db *bolt.DB, bucket string) error {
 	return nil
 }
 
-func GetUserByFingerprint(fp string, db *bolt.DB, bucket string) (string, error) {
-	var username string
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
-		if b == nil {
-			return errors.New("bucket not found")
-		}
-		username = string(b.Get([]byte(fp)))
-		return nil
-	})
+// GetUserByFingerprint returns the name of the key owner: from the owner registry
+// if the key is mapped there, otherwise from the key comment.
+// The fingerprint may be in SHA256 or MD5 format.
+func (m *Monitor) GetUserByFingerprint(fp string) (string, error) {
+	owner, err := m.GetOwnerByFingerprint(fp)
 	if err != nil {
 		return "", err
 	}
-	return username, err
+	return owner.Name, nil
 }
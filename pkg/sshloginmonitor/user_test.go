@@ -36,9 +36,28 @@ ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJWcjljox2NKwDFllZ5KQc4LSVrBEKoaOE/t/up1XbyD
 				users: &[]User{},
 			},
 			want: &[]User{
-				{Username: "alice@fedora", Fingerprint: "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8"},
-				{Username: "bob@fedora", Fingerprint: "is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY"},
-				{Username: "charlie@fedora", Fingerprint: "QgAov0UZI25hWxnbLiHa00j64/zD1m80UMsSIZtxr2s"},
+				{Username: "alice@fedora", Fingerprint: "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8",
+					FingerprintMD5: "79:ae:3c:8f:b4:57:4c:5a:47:64:3f:e3:d1:c9:bc:14",
+					Key:            "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG8Obx1FsUu1jlYDtzfEDHYSDjG82xE7ysxZVzhgpGC5 alice@fedora"},
+				{Username: "bob@fedora", Fingerprint: "is6l6bRqCCBVKunT+zVGHoUF0A06p8lt/04EoRbyCUY",
+					FingerprintMD5: "e0:ea:19:e7:16:46:ee:0c:6a:48:f1:5f:84:bf:e2:ee",
+					Key:            "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJgclT4eQ5RlYabZfkdjFV5wGrroXxmd5n2X7okmiaN8 bob@fedora"},
+				{Username: "charlie@fedora", Fingerprint: "QgAov0UZI25hWxnbLiHa00j64/zD1m80UMsSIZtxr2s",
+					FingerprintMD5: "9d:f7:d8:e7:6e:f4:48:64:1a:30:93:aa:89:de:4e:69",
+					Key:            "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJWcjljox2NKwDFllZ5KQc4LSVrBEKoaOE/t/up1XbyD charlie@fedora"},
+			},
+			wantErr: nil,
+		},
+		{
+			name: "key without comment",
+			args: args{
+				reader: strings.NewReader(`ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG8Obx1FsUu1jlYDtzfEDHYSDjG82xE7ysxZVzhgpGC5`),
+				users:  &[]User{},
+			},
+			want: &[]User{
+				{Username: "", Fingerprint: "5xuxPx8QnPv19/6IZ5frmQj1N0hRCP9J364ddE6avL8",
+					FingerprintMD5: "79:ae:3c:8f:b4:57:4c:5a:47:64:3f:e3:d1:c9:bc:14",
+					Key:            "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG8Obx1FsUu1jlYDtzfEDHYSDjG82xE7ysxZVzhgpGC5"},
 			},
 			wantErr: nil,
 		},
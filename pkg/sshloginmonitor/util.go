@@ -2,6 +2,10 @@ package sshloginmonitor
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // createUserMap takes in a slice of User objects and returns a map with
@@ -26,3 +30,22 @@ func createUserMap(users []User) (map[string]User, error) {
 	}
 	return userMap, nil
 }
+
+// ParseAge parses a duration like time.ParseDuration, and also accepts
+// days and weeks, e.g. "90d" or "2w".
+func ParseAge(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+	for suffix, unit := range units {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
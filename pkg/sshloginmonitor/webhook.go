@@ -0,0 +1,385 @@
+package sshloginmonitor
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Webhook presets: the shape of the JSON body.
+const (
+	PresetJSON       = "json"       // the event as JSON
+	PresetSlack      = "slack"      // a Slack incoming webhook message
+	PresetMattermost = "mattermost" // a Mattermost incoming webhook message
+	PresetTeams      = "teams"      // a Microsoft Teams message card
+)
+
+// Webhook is a URL receiving events, from the webhooks section of the
+// configuration, e.g.
+//
+//	webhooks:
+//	  - url: https://hooks.slack.com/services/...
+//	    preset: slack
+//	  - url: https://siem.example.com/ssh
+//	    when: 'type == "alert" || username == "root"'
+//	    secret: s3cr3t
+type Webhook struct {
+	URL    string `json:"url"`
+	Preset string `json:"preset"` // PresetJSON (default), PresetSlack, PresetMattermost or PresetTeams
+	// When selects the events to send, see ParseExpr; only alerts by default
+	When string `json:"when"`
+	// Secret signs the body: the X-Sshlm-Signature header is "sha256=" and
+	// the hex HMAC-SHA256 of the body
+	Secret  string            `json:"secret"`
+	Headers map[string]string `json:"headers"`
+}
+
+// webhookDelivery is a queued request.
+type webhookDelivery struct {
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+	Attempts int             `json:"attempts"`
+	Next     time.Time       `json:"next"`
+}
+
+// webhookQueueBucket returns the name of the bucket queuing webhook deliveries.
+func webhookQueueBucket(bucket string) []byte {
+	return []byte(bucket + "/webhooks")
+}
+
+// WebhookSink posts the selected events to webhooks. Deliveries are queued
+// in the database first, so they survive restarts, and retried with
+// exponential backoff until they succeed, the webhook rejects them with a
+// client error, or MaxAttempts is reached.
+type WebhookSink struct {
+	Client      *http.Client
+	MaxAttempts int           // 20 if zero
+	Backoff     time.Duration // delay before the first retry, doubled on each attempt; 5s by default
+	MaxBackoff  time.Duration // 15m by default
+
+	hooks  map[string]Webhook
+	when   map[string]Expr
+	order  []string
+	db     *bolt.DB
+	bucket string
+	mu     sync.Mutex // serializes deliveries
+}
+
+// NewWebhookSink returns a Sink posting events to the webhooks, queued in
+// the monitor's database.
+//
+// Parameters:
+//   - m: the monitor whose database holds the queue
+//   - hooks: the webhooks, usually from the webhooks section of the configuration
+//
+// Returns:
+//   - *WebhookSink: the sink
+//   - error: an error if a webhook has an invalid URL, preset or condition
+func NewWebhookSink(m *Monitor, hooks []Webhook) (*WebhookSink, error) {
+	s := &WebhookSink{
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		Backoff:    5 * time.Second,
+		MaxBackoff: 15 * time.Minute,
+		hooks:      make(map[string]Webhook),
+		when:       make(map[string]Expr),
+		db:         m.db,
+		bucket:     m.opts.Bucket,
+	}
+	for _, hook := range hooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("webhook %q: invalid URL", hook.URL)
+		}
+		switch hook.Preset {
+		case "":
+			hook.Preset = PresetJSON
+		case PresetJSON, PresetSlack, PresetMattermost, PresetTeams:
+		default:
+			return nil, fmt.Errorf("webhook %s: unknown preset %q", hook.URL, hook.Preset)
+		}
+		if hook.When == "" {
+			hook.When = `type == "alert"`
+		}
+		when, err := ParseExpr(hook.When)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: when: %w", hook.URL, err)
+		}
+		if _, ok := s.hooks[hook.URL]; ok {
+			return nil, fmt.Errorf("webhook %s is configured twice", hook.URL)
+		}
+		s.hooks[hook.URL] = hook
+		s.when[hook.URL] = when
+		s.order = append(s.order, hook.URL)
+	}
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(webhookQueueBucket(s.bucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Consume implements Sink. Deliveries run in the background while events
+// are queued; the deliveries due when events is closed are attempted once
+// more before Consume returns.
+func (s *WebhookSink) Consume(ctx context.Context, events <-chan SessionEvent) error {
+	wake := make(chan struct{}, 1)
+	deliverCtx, stop := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.run(deliverCtx, wake)
+	}()
+	err := consume(ctx, events, func(event SessionEvent) error {
+		queued, err := s.enqueue(event, time.Now())
+		if queued > 0 {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+		return err
+	})
+	stop()
+	wg.Wait()
+	if err == nil && ctx.Err() == nil {
+		s.deliverDue(ctx, time.Now())
+	}
+	return err
+}
+
+// run delivers the queue whenever a delivery is due or wake is signaled,
+// until ctx is cancelled.
+func (s *WebhookSink) run(ctx context.Context, wake <-chan struct{}) {
+	for {
+		next := s.deliverDue(ctx, time.Now())
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// enqueue queues a delivery of the event to every webhook selecting it and
+// returns the number of deliveries queued.
+func (s *WebhookSink) enqueue(event SessionEvent, now time.Time) (int, error) {
+	deliveries := make([]webhookDelivery, 0)
+	for _, u := range s.order {
+		if !s.when[u].Eval(event) {
+			continue
+		}
+		body, err := webhookBody(s.hooks[u].Preset, event)
+		if err != nil {
+			return 0, err
+		}
+		deliveries = append(deliveries, webhookDelivery{URL: u, Body: body, Next: now})
+	}
+	if len(deliveries) == 0 {
+		return 0, nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhookQueueBucket(s.bucket))
+		for _, d := range deliveries {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			err = b.Put(itob(seq), data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(deliveries), nil
+}
+
+// deliverDue attempts the deliveries due at now, in the order they were
+// queued, and returns the time the next one is due, or the zero time if the
+// queue is empty.
+func (s *WebhookSink) deliverDue(ctx context.Context, now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type queued struct {
+		key []byte
+		webhookDelivery
+	}
+	due := make([]queued, 0)
+	var next time.Time
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookQueueBucket(s.bucket)).ForEach(func(k, v []byte) error {
+			var d webhookDelivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				log.Printf("webhook queue: dropping invalid delivery: %s", err)
+				d = webhookDelivery{} // no URL: deleted below
+			}
+			if d.Next.After(now) {
+				if next.IsZero() || d.Next.Before(next) {
+					next = d.Next
+				}
+				return nil
+			}
+			due = append(due, queued{append([]byte(nil), k...), d})
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("webhook queue: %s", err)
+		return now.Add(retryBackoff(1, s.Backoff, s.MaxBackoff))
+	}
+
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return now
+		}
+		hook, ok := s.hooks[d.URL]
+		done := true
+		if !ok {
+			log.Printf("webhook %s is no longer configured: delivery dropped", d.URL)
+		} else if err := s.post(ctx, hook, d.key, d.Body); err != nil {
+			d.Attempts++
+			var status *httpStatusError
+			switch {
+			case errors.As(err, &status) && status.permanent():
+				log.Printf("webhook %s: delivery dropped: %s", d.URL, err)
+			case d.Attempts >= s.maxAttempts():
+				log.Printf("webhook %s: delivery dropped after %d attempts: %s", d.URL, d.Attempts, err)
+			default:
+				log.Printf("webhook %s: attempt %d failed, retrying: %s", d.URL, d.Attempts, err)
+				d.Next = now.Add(retryBackoff(d.Attempts, s.Backoff, s.MaxBackoff))
+				if next.IsZero() || d.Next.Before(next) {
+					next = d.Next
+				}
+				done = false
+			}
+		}
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(webhookQueueBucket(s.bucket))
+			if done {
+				return b.Delete(d.key)
+			}
+			data, err := json.Marshal(d.webhookDelivery)
+			if err != nil {
+				return err
+			}
+			return b.Put(d.key, data)
+		})
+		if err != nil {
+			log.Printf("webhook queue: %s", err)
+		}
+	}
+	return next
+}
+
+// maxAttempts returns MaxAttempts or its default.
+func (s *WebhookSink) maxAttempts() int {
+	if s.MaxAttempts > 0 {
+		return s.MaxAttempts
+	}
+	return 20
+}
+
+// post sends one delivery. The key identifies the delivery across retries.
+func (s *WebhookSink) post(ctx context.Context, hook Webhook, key []byte, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sshlm")
+	req.Header.Set("X-Sshlm-Delivery", strconv.FormatUint(binary.BigEndian.Uint64(key), 10))
+	for name, value := range hook.Headers {
+		req.Header.Set(name, value)
+	}
+	if hook.Secret != "" {
+		req.Header.Set("X-Sshlm-Signature", SignWebhook(hook.Secret, body))
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &httpStatusError{status: resp.StatusCode, body: string(bytes.TrimSpace(text))}
+}
+
+// SignWebhook returns the X-Sshlm-Signature header of a webhook body:
+// "sha256=" and the hex HMAC-SHA256 of the body with the secret.
+// Receivers compute it the same way and compare with hmac.Equal.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBody returns the body posted for the event with the preset.
+func webhookBody(preset string, event SessionEvent) ([]byte, error) {
+	text := eventMessage(event)
+	switch preset {
+	case PresetSlack, PresetMattermost:
+		return json.Marshal(map[string]string{"text": text})
+	case PresetTeams:
+		color := "0076D7"
+		if event.Alert != nil {
+			color = map[string]string{
+				SeverityInfo:     "0076D7",
+				SeverityWarning:  "FFA500",
+				SeverityCritical: "D70000",
+			}[event.Alert.Severity]
+		}
+		facts := []map[string]string{
+			{"name": "Account", "value": event.Username},
+			{"name": "Key user", "value": event.KeyUser},
+			{"name": "Source", "value": event.SourceIP + " port " + event.Port},
+			{"name": "Time", "value": event.EventTime.Format("2006-01-02 15:04:05")},
+		}
+		return json.Marshal(map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    text,
+			"themeColor": color,
+			"title":      text,
+			"sections":   []map[string]interface{}{{"facts": facts}},
+		})
+	}
+	return json.Marshal(event)
+}
@@ -0,0 +1,224 @@
+package sshloginmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// webhookRecorder is a test webhook answering with the given statuses in turn,
+// then 200.
+type webhookRecorder struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.requests = append(rec.requests, r)
+	rec.bodies = append(rec.bodies, string(body))
+	if len(rec.statuses) > 0 {
+		w.WriteHeader(rec.statuses[0])
+		rec.statuses = rec.statuses[1:]
+	}
+}
+
+// queueLength returns the number of queued webhook deliveries.
+func queueLength(t *testing.T, m *Monitor) int {
+	t.Helper()
+	n := 0
+	err := m.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(webhookQueueBucket(m.opts.Bucket)).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestWebhookSink(t *testing.T) {
+	m := newTestMonitor(t)
+	rec := &webhookRecorder{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	sink, err := NewWebhookSink(m, []Webhook{
+		{URL: server.URL + "/alerts", Secret: "s3cr3t", Headers: map[string]string{"X-Team": "ops"}},
+		{URL: server.URL + "/slack", Preset: PresetSlack, When: `type == "login" && username == "root"`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2023, 4, 27, 10, 21, 19, 0, time.UTC)
+	login := SessionEvent{EventType: "login", EventTime: at, Username: "root", SourceIP: "192.168.1.24", Port: "49090", KeyUser: "alice@fedora"}
+	alert := login
+	alert.EventType = "alert"
+	alert.Alert = &Alert{Rule: "root-login", Severity: SeverityCritical, Message: "root logged in", Trigger: "login"}
+	events := make(chan SessionEvent, 3)
+	events <- login
+	events <- alert
+	events <- SessionEvent{EventType: "logout", Username: "root"}
+	close(events)
+	err = sink.Consume(context.Background(), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(rec.requests))
+	}
+	for i, r := range rec.requests {
+		switch r.URL.Path {
+		case "/slack":
+			want := `{"text":"login of root by alice@fedora from 192.168.1.24 port 49090"}`
+			if rec.bodies[i] != want {
+				t.Errorf("slack body = %s, want %s", rec.bodies[i], want)
+			}
+			if r.Header.Get("X-Sshlm-Signature") != "" {
+				t.Errorf("unsigned webhook got a signature")
+			}
+		case "/alerts":
+			var got SessionEvent
+			err := json.Unmarshal([]byte(rec.bodies[i]), &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Alert == nil || *got.Alert != *alert.Alert {
+				t.Errorf("alert = %+v, want %+v", got.Alert, alert.Alert)
+			}
+			if sig := r.Header.Get("X-Sshlm-Signature"); sig != SignWebhook("s3cr3t", []byte(rec.bodies[i])) {
+				t.Errorf("signature = %q", sig)
+			}
+			if r.Header.Get("X-Team") != "ops" || r.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("headers = %v", r.Header)
+			}
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}
+	if n := queueLength(t, m); n != 0 {
+		t.Errorf("%d deliveries left in the queue", n)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	m := newTestMonitor(t)
+	flaky := &webhookRecorder{statuses: []int{http.StatusInternalServerError, http.StatusTooManyRequests}}
+	flakyServer := httptest.NewServer(flaky)
+	defer flakyServer.Close()
+	rejecting := &webhookRecorder{statuses: []int{http.StatusBadRequest}}
+	rejectingServer := httptest.NewServer(rejecting)
+	defer rejectingServer.Close()
+
+	hooks := []Webhook{{URL: flakyServer.URL, When: `type == "login"`}, {URL: rejectingServer.URL, When: `type == "login"`}}
+	sink, err := NewWebhookSink(m, hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Backoff = time.Minute
+	ctx := context.Background()
+	now := time.Date(2023, 4, 27, 10, 0, 0, 0, time.UTC)
+	_, err = sink.enqueue(SessionEvent{EventType: "login", Username: "root"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		at       time.Duration
+		flaky    int // requests received by the flaky webhook so far
+		queued   int
+		nextWait time.Duration
+	}{
+		{at: 0, flaky: 1, queued: 1, nextWait: time.Minute}, // the rejected delivery is dropped
+		{at: 30 * time.Second, flaky: 1, queued: 1, nextWait: 30 * time.Second},
+		{at: time.Minute, flaky: 2, queued: 1, nextWait: 2 * time.Minute},
+		{at: 3 * time.Minute, flaky: 3, queued: 0},
+	}
+	for _, step := range steps {
+		if step.at == 3*time.Minute {
+			// A restarted monitor delivers the queue left by the previous one
+			sink, err = NewWebhookSink(m, hooks)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		next := sink.deliverDue(ctx, now.Add(step.at))
+		if len(flaky.requests) != step.flaky {
+			t.Errorf("at %s: %d requests, want %d", step.at, len(flaky.requests), step.flaky)
+		}
+		if n := queueLength(t, m); n != step.queued {
+			t.Errorf("at %s: %d queued, want %d", step.at, n, step.queued)
+		}
+		if step.queued > 0 && next.Sub(now.Add(step.at)) != step.nextWait {
+			t.Errorf("at %s: next delivery in %s, want %s", step.at, next.Sub(now.Add(step.at)), step.nextWait)
+		}
+	}
+	if len(rejecting.requests) != 1 {
+		t.Errorf("rejected delivery sent %d times, want 1", len(rejecting.requests))
+	}
+	if flaky.requests[0].Header.Get("X-Sshlm-Delivery") != flaky.requests[2].Header.Get("X-Sshlm-Delivery") {
+		t.Errorf("retries must keep the delivery ID")
+	}
+}
+
+func TestNewWebhookSink(t *testing.T) {
+	m := newTestMonitor(t)
+	tests := []struct {
+		name    string
+		hooks   []Webhook
+		wantErr bool
+	}{
+		{name: "valid", hooks: []Webhook{{URL: "https://example.com/hook", Preset: PresetTeams}}},
+		{name: "no URL", hooks: []Webhook{{}}, wantErr: true},
+		{name: "bad scheme", hooks: []Webhook{{URL: "ftp://example.com"}}, wantErr: true},
+		{name: "bad preset", hooks: []Webhook{{URL: "https://example.com", Preset: "discord"}}, wantErr: true},
+		{name: "bad condition", hooks: []Webhook{{URL: "https://example.com", When: "type"}}, wantErr: true},
+		{name: "duplicate", hooks: []Webhook{{URL: "https://example.com"}, {URL: "https://example.com"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewWebhookSink(m, tt.hooks)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewWebhookSink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookBody(t *testing.T) {
+	event := SessionEvent{EventType: "alert", Username: "root", SourceIP: "10.0.0.1", Port: "22",
+		Alert: &Alert{Rule: "root", Severity: SeverityCritical, Message: "root login"}}
+	tests := []struct {
+		preset string
+		want   string
+	}{
+		{PresetSlack, `{"text":"[critical] root: root login"}`},
+		{PresetMattermost, `{"text":"[critical] root: root login"}`},
+		{PresetTeams, `{"@context":"https://schema.org/extensions","@type":"MessageCard","sections":[{"facts":[{"name":"Account","value":"root"},{"name":"Key user","value":""},{"name":"Source","value":"10.0.0.1 port 22"},{"name":"Time","value":"0001-01-01 00:00:00"}]}],"summary":"[critical] root: root login","themeColor":"D70000","title":"[critical] root: root login"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.preset, func(t *testing.T) {
+			got, err := webhookBody(tt.preset, event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("webhookBody() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}